@@ -38,6 +38,20 @@ typedef struct {
     sky_property_descriptor_clear_func clear_func;
 } sky_property_descriptor;
 
+// A saved cursor position. The event data is copied so that the current
+// event can be restored after reading ahead.
+typedef struct {
+    void *data;
+    int32_t session_event_index;
+    void *startptr;
+    void *nextptr;
+    void *endptr;
+    void *ptr;
+    bool eof;
+    bool in_session;
+    uint32_t last_timestamp;
+} sky_cursor_position;
+
 struct sky_cursor {
     void *data;
     uint32_t data_sz;
@@ -52,6 +66,8 @@ struct sky_cursor {
     bool in_session;
     uint32_t last_timestamp;
     uint32_t session_idle_in_sec;
+    int64_t min_ts;
+    int64_t max_ts;
 
     sky_timestamp_descriptor timestamp_descriptor;
     sky_property_descriptor *property_descriptors;
@@ -60,6 +76,8 @@ struct sky_cursor {
 
     void *context;
     sky_cursor_next_object_func next_object_func;
+
+    sky_cursor_position mark;
 };
 
 
@@ -122,10 +140,16 @@ bool sky_cursor_eos(sky_cursor *cursor);
 
 void sky_cursor_set_session_idle(sky_cursor *cursor, uint32_t seconds);
 
+void sky_cursor_set_ts_range(sky_cursor *cursor, int64_t min_ts, int64_t max_ts);
+
 void sky_cursor_next_session(sky_cursor *cursor);
 
 bool sky_lua_cursor_next_session(sky_cursor *cursor);
 
 void sky_cursor_clear_data(sky_cursor *cursor);
 
+void sky_cursor_mark(sky_cursor *cursor);
+
+void sky_cursor_restore(sky_cursor *cursor);
+
 #endif
\ No newline at end of file
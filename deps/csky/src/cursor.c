@@ -36,6 +36,13 @@
 //
 //==============================================================================
 
+//--------------------------------------
+// Event Iteration
+//--------------------------------------
+
+void sky_cursor_set_eof(sky_cursor *cursor);
+
+
 //--------------------------------------
 // Setters
 //--------------------------------------
@@ -115,6 +122,7 @@ void sky_cursor_free(sky_cursor *cursor)
         cursor->property_count = 0;
 
         if(cursor->data != NULL) free(cursor->data);
+        if(cursor->mark.data != NULL) free(cursor->mark.data);
 
         free(cursor);
     }
@@ -141,6 +149,8 @@ void sky_cursor_set_data_sz(sky_cursor *cursor, uint32_t sz) {
     cursor->data_sz = sz;
     if(cursor->data != NULL) free(cursor->data);
     cursor->data = calloc(1, sz);
+    if(cursor->mark.data != NULL) free(cursor->mark.data);
+    cursor->mark.data = calloc(1, sz);
 }
 
 void sky_cursor_set_timestamp_offset(sky_cursor *cursor, uint32_t offset) {
@@ -236,22 +246,23 @@ void sky_cursor_next_event(sky_cursor *cursor)
         return;
     }
 
-    // Move the pointer to the next position.
-    void *prevptr = cursor->ptr;
-    cursor->ptr = cursor->nextptr;
-    void *ptr = cursor->ptr;
-
-    // If pointer is beyond the last event then set eof.
-    if(cursor->ptr >= cursor->endptr) {
-        cursor->eof        = true;
-        cursor->in_session = false;
-        cursor->ptr        = NULL;
-        cursor->startptr   = NULL;
-        cursor->nextptr    = NULL;
-        cursor->endptr     = NULL;
-    }
-    // Otherwise update the event object with data.
-    else {
+    // Events before the minimum timestamp are still read so that permanent
+    // properties are set on the data object but they are skipped over.
+    bool skipped;
+    do {
+        skipped = false;
+
+        // Move the pointer to the next position.
+        void *prevptr = cursor->ptr;
+        cursor->ptr = cursor->nextptr;
+        void *ptr = cursor->ptr;
+
+        // If pointer is beyond the last event then set eof.
+        if(cursor->ptr >= cursor->endptr) {
+            sky_cursor_set_eof(cursor);
+            return;
+        }
+
         sky_event_flag_t flag = *((sky_event_flag_t*)ptr);
         
         // If flag isn't correct then report and exit.
@@ -265,9 +276,16 @@ void sky_cursor_next_event(sky_cursor *cursor)
         uint32_t timestamp = sky_timestamp_to_seconds(ts);
         ptr += sz;
 
+        // Events are ordered so nothing after the maximum timestamp is read.
+        if(cursor->max_ts > 0 && ts >= cursor->max_ts) {
+            sky_cursor_set_eof(cursor);
+            return;
+        }
+        skipped = (cursor->min_ts > 0 && ts < cursor->min_ts);
+
         // Check for session boundry. This only applies if this is not the
         // first event in the session and a session idle time has been set.
-        if(cursor->last_timestamp > 0 && cursor->session_idle_in_sec > 0) {
+        if(!skipped && cursor->last_timestamp > 0 && cursor->session_idle_in_sec > 0) {
             // If the elapsed time is greater than the idle time then rewind
             // back to the event we started on at the beginning of the function
             // and mark the cursor as being "out of session".
@@ -276,11 +294,15 @@ void sky_cursor_next_event(sky_cursor *cursor)
                 cursor->in_session = false;
             }
         }
-        cursor->last_timestamp = timestamp;
+        if(!skipped) {
+            cursor->last_timestamp = timestamp;
+        }
 
         // Only process the event if we're still in session.
         if(cursor->in_session) {
-            cursor->session_event_index++;
+            if(!skipped) {
+                cursor->session_event_index++;
+            }
             
             // Set timestamp.
             int64_t *data_ts = (int64_t*)(cursor->data + cursor->timestamp_descriptor.ts_offset);
@@ -322,7 +344,18 @@ void sky_cursor_next_event(sky_cursor *cursor)
 
             cursor->nextptr = ptr;
         }
-    }
+    } while(skipped);
+}
+
+// Marks the cursor as being at the end of the object's events.
+void sky_cursor_set_eof(sky_cursor *cursor)
+{
+    cursor->eof        = true;
+    cursor->in_session = false;
+    cursor->ptr        = NULL;
+    cursor->startptr   = NULL;
+    cursor->nextptr    = NULL;
+    cursor->endptr     = NULL;
 }
 
 bool sky_lua_cursor_next_event(sky_cursor *cursor)
@@ -350,6 +383,14 @@ void sky_cursor_set_session_idle(sky_cursor *cursor, uint32_t seconds)
     cursor->in_session = (seconds > 0 ? false : !cursor->eof);
 }
 
+// Limits the events returned by the cursor to those on or after the minimum
+// timestamp and before the maximum timestamp. Zero means there is no limit.
+void sky_cursor_set_ts_range(sky_cursor *cursor, int64_t min_ts, int64_t max_ts)
+{
+    cursor->min_ts = min_ts;
+    cursor->max_ts = max_ts;
+}
+
 void sky_cursor_next_session(sky_cursor *cursor)
 {
     // Set a flag to allow the cursor to continue iterating unless EOF is set.
@@ -365,6 +406,36 @@ bool sky_lua_cursor_next_session(sky_cursor *cursor)
     return !cursor->eof;
 }
 
+// Saves the current position and event data of the cursor so that it can
+// read ahead and then return with sky_cursor_restore(). Only one position
+// is saved at a time.
+void sky_cursor_mark(sky_cursor *cursor)
+{
+    memcpy(cursor->mark.data, cursor->data, cursor->data_sz);
+    cursor->mark.session_event_index = cursor->session_event_index;
+    cursor->mark.startptr            = cursor->startptr;
+    cursor->mark.nextptr             = cursor->nextptr;
+    cursor->mark.endptr              = cursor->endptr;
+    cursor->mark.ptr                 = cursor->ptr;
+    cursor->mark.eof                 = cursor->eof;
+    cursor->mark.in_session          = cursor->in_session;
+    cursor->mark.last_timestamp      = cursor->last_timestamp;
+}
+
+// Moves the cursor back to the position saved by sky_cursor_mark().
+void sky_cursor_restore(sky_cursor *cursor)
+{
+    memcpy(cursor->data, cursor->mark.data, cursor->data_sz);
+    cursor->session_event_index = cursor->mark.session_event_index;
+    cursor->startptr            = cursor->mark.startptr;
+    cursor->nextptr             = cursor->mark.nextptr;
+    cursor->endptr              = cursor->mark.endptr;
+    cursor->ptr                 = cursor->mark.ptr;
+    cursor->eof                 = cursor->mark.eof;
+    cursor->in_session          = cursor->mark.in_session;
+    cursor->last_timestamp      = cursor->mark.last_timestamp;
+}
+
 
 
 //--------------------------------------
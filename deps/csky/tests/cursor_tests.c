@@ -336,6 +336,80 @@ int test_sky_cursor_object_iteration() {
 }
 
 
+//--------------------------------------
+// Timestamp Range
+//--------------------------------------
+
+int test_sky_cursor_ts_range() {
+    // Setup data object.
+    sky_cursor *cursor = sky_cursor_new(-2, 1);
+    sky_cursor_set_timestamp_offset(cursor, offsetof(test_t, timestamp));
+    sky_cursor_set_ts_offset(cursor, offsetof(test_t, ts));
+    sky_cursor_set_property(cursor, -2, offsetof(test_t, action_int), sizeof(int32_t), "integer");
+    sky_cursor_set_property(cursor, -1, offsetof(test_t, action), sizeof(sky_string), "string");
+    sky_cursor_set_property(cursor, 1, offsetof(test_t, object_int), sizeof(int32_t), "integer");
+    sky_cursor_set_data_sz(cursor, sizeof(test_t));
+
+    // Only return events from 1 second up to 20 seconds.
+    sky_cursor_set_ts_range(cursor, sky_timestamp_shift(1000000LL), sky_timestamp_shift(20000000LL));
+    sky_cursor_set_ptr(cursor, DATA1, DATA1_LENGTH);
+
+    // The first event is skipped but its permanent data is kept.
+    mu_assert_bool(sky_lua_cursor_next_event(cursor));
+    mu_assert_int_equals(cursor->session_event_index, 0);
+    ASSERT_OBJ_STATE2(cursor->data, 1, "A2", 1000LL, 100LL);
+
+    mu_assert_bool(sky_lua_cursor_next_event(cursor));
+    mu_assert_int_equals(cursor->session_event_index, 1);
+    ASSERT_OBJ_STATE2(cursor->data, 10, "A3", 1000LL, 200LL);
+
+    // Events at the end of the range are not returned.
+    mu_assert_bool(!sky_lua_cursor_next_event(cursor));
+    mu_assert_bool(sky_cursor_eof(cursor));
+
+    sky_cursor_free(cursor);
+    return 0;
+}
+
+
+//--------------------------------------
+// Mark & Restore
+//--------------------------------------
+
+int test_sky_cursor_mark_restore() {
+    // Setup data object.
+    sky_cursor *cursor = sky_cursor_new(-2, 1);
+    sky_cursor_set_timestamp_offset(cursor, offsetof(test_t, timestamp));
+    sky_cursor_set_ts_offset(cursor, offsetof(test_t, ts));
+    sky_cursor_set_property(cursor, -2, offsetof(test_t, action_int), sizeof(int32_t), "integer");
+    sky_cursor_set_property(cursor, -1, offsetof(test_t, action), sizeof(sky_string), "string");
+    sky_cursor_set_property(cursor, 1, offsetof(test_t, object_int), sizeof(int32_t), "integer");
+    sky_cursor_set_data_sz(cursor, sizeof(test_t));
+    sky_cursor_set_ptr(cursor, DATA1, DATA1_LENGTH);
+
+    mu_assert_bool(sky_lua_cursor_next_event(cursor));
+    mu_assert_bool(sky_lua_cursor_next_event(cursor));
+    ASSERT_OBJ_STATE2(cursor->data, 1, "A2", 1000LL, 100LL);
+
+    // Read to the end and then restore the second event.
+    sky_cursor_mark(cursor);
+    while(sky_lua_cursor_next_event(cursor)) {}
+    mu_assert_bool(sky_cursor_eof(cursor));
+    sky_cursor_restore(cursor);
+    mu_assert_bool(!sky_cursor_eof(cursor));
+    mu_assert_int_equals(cursor->session_event_index, 1);
+    ASSERT_OBJ_STATE2(cursor->data, 1, "A2", 1000LL, 100LL);
+
+    // Events after the restored position are read again.
+    mu_assert_bool(sky_lua_cursor_next_event(cursor));
+    mu_assert_int_equals(cursor->session_event_index, 2);
+    ASSERT_OBJ_STATE2(cursor->data, 10, "A3", 1000LL, 200LL);
+
+    sky_cursor_free(cursor);
+    return 0;
+}
+
+
 //--------------------------------------
 // Property Management
 //--------------------------------------
@@ -408,6 +482,8 @@ int all_tests() {
     mu_run_test(test_sky_cursor_set_data);
     mu_run_test(test_sky_cursor_sessionize);
     mu_run_test(test_sky_cursor_object_iteration);
+    mu_run_test(test_sky_cursor_ts_range);
+    mu_run_test(test_sky_cursor_mark_restore);
     
     mu_run_test(test_sky_cursor_set_integer);
     mu_run_test(test_sky_cursor_set_double);
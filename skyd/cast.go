@@ -18,3 +18,25 @@ func normalize(value interface{}) interface{} {
 	}
 	return value
 }
+
+// Converts a numeric value to a float64. Non-numeric values return zero.
+func toFloat64(value interface{}) float64 {
+	switch v := normalize(value).(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// Converts a numeric value to an int64. Non-numeric values return zero.
+func toInt64(value interface{}) int64 {
+	switch v := normalize(value).(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
@@ -1,5 +1,9 @@
 package skyd
 
+import (
+	"fmt"
+)
+
 const (
 	FactorDataType  = "factor"
 	StringDataType  = "string"
@@ -7,3 +11,30 @@ const (
 	FloatDataType   = "float"
 	BooleanDataType = "boolean"
 )
+
+// The number of values that are sampled for an inferred string property
+// before deciding whether it should be converted to a factor.
+const InferredFactorSampleSize = 100
+
+// The most distinct values that an inferred string property can have within
+// its sample and still be converted to a factor.
+const MaxInferredFactorCardinality = 20
+
+// Infers the data type of a value that was received for an unknown property.
+// Strings always start out as strings and are only converted to factors once
+// their cardinality has been observed. Integer values are treated as
+// integers and any floating point value is treated as a float, even if it is
+// a whole number.
+func InferDataType(value interface{}) (string, error) {
+	switch value.(type) {
+	case string:
+		return StringDataType, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return IntegerDataType, nil
+	case float32, float64:
+		return FloatDataType, nil
+	case bool:
+		return BooleanDataType, nil
+	}
+	return "", fmt.Errorf("Unable to infer data type: %v", value)
+}
@@ -21,6 +21,131 @@ void executionEngine_setNextObjectFunc(void *cursor) {
 	((sky_cursor*)cursor)->next_object_func = executionEngine_c_next_object;
 }
 
+// The number of instructions between checks of the limits.
+#define EXECUTION_ENGINE_HOOK_COUNT 1000
+
+// Tracks the resources used by a Lua state.
+typedef struct {
+	size_t memory_used;
+	size_t memory_limit;
+	long instructions;
+	long instruction_limit;
+} executionEngine_limits;
+
+// Allocates memory for a Lua state. Requests that would exceed the limit
+// fail and Lua raises a memory error. Shrinking always succeeds.
+void *executionEngine_alloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+	executionEngine_limits *limits = (executionEngine_limits*)ud;
+	if(nsize == 0) {
+		free(ptr);
+		limits->memory_used -= osize;
+		return NULL;
+	}
+	if(nsize > osize && limits->memory_limit > 0 && limits->memory_used - osize + nsize > limits->memory_limit) {
+		return NULL;
+	}
+	void *p = realloc(ptr, nsize);
+	if(p != NULL) {
+		limits->memory_used = limits->memory_used - osize + nsize;
+	}
+	return p;
+}
+
+// Creates a Lua state using the limited allocator. 64-bit LuaJIT must use
+// its own allocator so memory is only checked between objects and merges
+// and while snippets run there.
+lua_State *executionEngine_newstate(executionEngine_limits *limits) {
+#if defined(__x86_64__)
+	return luaL_newstate();
+#else
+	return lua_newstate(executionEngine_alloc, limits);
+#endif
+}
+
+// Retrieves the limits attached to a Lua state.
+executionEngine_limits *executionEngine_getLimits(lua_State *L) {
+	lua_getfield(L, LUA_REGISTRYINDEX, "sky.limits");
+	executionEngine_limits *limits = (executionEngine_limits*)lua_touserdata(L, -1);
+	lua_pop(L, 1);
+	return limits;
+}
+
+// Raises an error if the state uses more memory than the limit. The header
+// calls this after each object and merge.
+int executionEngine_checkMemory(lua_State *L) {
+	executionEngine_limits *limits = executionEngine_getLimits(L);
+	if(limits != NULL && limits->memory_limit > 0 && (size_t)lua_gc(L, LUA_GCCOUNT, 0) * 1024 > limits->memory_limit) {
+		luaL_error(L, "Memory limit exceeded");
+	}
+	return 0;
+}
+
+// Raises an error once the query has run too many instructions or uses
+// more memory than the limit. Instructions are counted for the whole query
+// and are only reset when the engine is reset.
+void executionEngine_hook(lua_State *L, lua_Debug *ar) {
+	executionEngine_limits *limits = executionEngine_getLimits(L);
+	if(limits == NULL) {
+		return;
+	}
+	limits->instructions += EXECUTION_ENGINE_HOOK_COUNT;
+	if(limits->instruction_limit > 0 && limits->instructions > limits->instruction_limit) {
+		luaL_error(L, "Instruction limit exceeded");
+	}
+	executionEngine_checkMemory(L);
+}
+
+// Calls a function with the hook installed. Hooks don't run in JIT compiled
+// code so they are only used for untrusted snippets, which are never
+// compiled, and the generated code runs at full speed.
+int executionEngine_callLimited(lua_State *L) {
+	int rc;
+	lua_sethook(L, executionEngine_hook, LUA_MASKCOUNT, EXECUTION_ENGINE_HOOK_COUNT);
+	rc = lua_pcall(L, lua_gettop(L) - 1, LUA_MULTRET, 0);
+	lua_sethook(L, NULL, 0, 0);
+	if(rc != 0) {
+		return lua_error(L);
+	}
+	return lua_gettop(L);
+}
+
+// Attaches limits to a Lua state and registers the functions the header
+// uses to enforce them.
+void executionEngine_setLimits(lua_State *L, executionEngine_limits *limits) {
+	lua_pushlightuserdata(L, limits);
+	lua_setfield(L, LUA_REGISTRYINDEX, "sky.limits");
+	lua_pushcfunction(L, executionEngine_checkMemory);
+	lua_setfield(L, LUA_GLOBALSINDEX, "sky_check_memory");
+	lua_pushcfunction(L, executionEngine_callLimited);
+	lua_setfield(L, LUA_GLOBALSINDEX, "sky_call_limited");
+}
+
+// Opens the libraries used by the header. The "io", "os", "package" and
+// "debug" libraries are never opened and the "ffi" library is only made
+// available to the header.
+void executionEngine_openlibs(lua_State *L) {
+	const luaL_Reg libs[] = {
+		{"", luaopen_base},
+		{LUA_TABLIBNAME, luaopen_table},
+		{LUA_STRLIBNAME, luaopen_string},
+		{LUA_MATHLIBNAME, luaopen_math},
+		{LUA_BITLIBNAME, luaopen_bit},
+		{LUA_JITLIBNAME, luaopen_jit},
+		{NULL, NULL}
+	};
+	const luaL_Reg *lib;
+	for(lib = libs; lib->func; lib++) {
+		lua_pushcfunction(L, lib->func);
+		lua_pushstring(L, lib->name);
+		lua_call(L, 1, 0);
+	}
+
+	lua_pushcfunction(L, luaopen_ffi);
+	lua_pushstring(L, LUA_FFILIBNAME);
+	lua_call(L, 1, 1);
+	lua_setfield(L, LUA_GLOBALSINDEX, LUA_FFILIBNAME);
+}
+
 */
 import "C"
 
@@ -30,12 +155,40 @@ import (
 	"fmt"
 	"github.com/jmhodges/levigo"
 	"github.com/ugorji/go-msgpack"
+	"hash/fnv"
 	"regexp"
 	"sort"
 	"text/template"
+	"time"
 	"unsafe"
 )
 
+//------------------------------------------------------------------------------
+//
+// Globals
+//
+//------------------------------------------------------------------------------
+
+// Matches references to event properties such as "event.name" and
+// "event:name()" in a script.
+var eventPropertyReferenceRegexp = regexp.MustCompile(`\bevent(?:\.|:)(\w+)`)
+
+// Fields that every event has and that aren't properties.
+var eventBuiltinFields = map[string]bool{"timestamp": true, "ts": true}
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The maximum number of bytes a query can allocate by default.
+const DefaultExecutionEngineMemoryLimit = 256 * 1024 * 1024
+
+// The maximum number of instructions the Lua steps of a query can run by
+// default.
+const DefaultExecutionEngineInstructionLimit = 100 * 1000 * 1000
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -48,12 +201,21 @@ type ExecutionEngine struct {
 	iterator     *levigo.Iterator
 	cursor       *C.sky_cursor
 	prefix       []byte
+	keyStart     []byte
+	keyLimit     []byte
 	state        *C.lua_State
+	limits       *C.executionEngine_limits
 	header       string
 	source       string
 	fullSource   string
 	propertyFile *PropertyFile
 	propertyRefs []*Property
+	poolKey      string
+	poolVersion  uint64
+	start        time.Time
+	filter       *QueryFilter
+	sample       float64
+	err          error
 
 	cprefix    unsafe.Pointer
 	cprefix_sz C.size_t
@@ -93,6 +255,7 @@ func NewExecutionEngine(table *Table, source string) (*ExecutionEngine, error) {
 		propertyFile: propertyFile,
 		source:       source,
 		propertyRefs: propertyRefs,
+		sample:       1,
 	}
 
 	// Initialize the engine.
@@ -146,11 +309,81 @@ func (e *ExecutionEngine) SetIterator(iterator *levigo.Iterator) error {
 
 	// Attach the new iterator.
 	e.iterator = iterator
-	if e.iterator != nil {
+	e.err = nil
+	e.seek()
+
+	return nil
+}
+
+// Limits the objects scanned to those with keys on or after the start key
+// and before the limit key. Nil keys are unbounded within the table.
+func (e *ExecutionEngine) SetKeyRange(start []byte, limit []byte) {
+	e.keyStart = start
+	e.keyLimit = limit
+	e.seek()
+}
+
+// Moves the iterator to the first key in the table and key range.
+func (e *ExecutionEngine) seek() {
+	if e.iterator == nil {
+		return
+	}
+	if bytes.Compare(e.keyStart, e.prefix) > 0 {
+		e.iterator.Seek(e.keyStart)
+	} else {
 		e.iterator.Seek(e.prefix)
 	}
+}
 
-	return nil
+// Limits the events returned by the cursor to those on or after the start
+// time and before the end time. Objects with no events after the start are
+// skipped entirely. Zero times are unbounded.
+func (e *ExecutionEngine) SetRange(start time.Time, end time.Time) {
+	var minTimestamp, maxTimestamp int64
+	if !start.IsZero() {
+		minTimestamp = ShiftTime(start)
+	}
+	if !end.IsZero() {
+		maxTimestamp = ShiftTime(end)
+	}
+	e.start = start
+	C.sky_cursor_set_ts_range(e.cursor, C.int64_t(minTimestamp), C.int64_t(maxTimestamp))
+}
+
+// Sets a filter used to skip objects based on their current state.
+func (e *ExecutionEngine) SetFilter(filter *QueryFilter) {
+	e.filter = filter
+}
+
+// Sets the fraction of objects to include.
+func (e *ExecutionEngine) SetSample(sample float64) {
+	e.sample = sample
+}
+
+// Retrieves the maximum number of bytes the script can allocate.
+func (e *ExecutionEngine) MemoryLimit() int {
+	return int(e.limits.memory_limit)
+}
+
+// Sets the maximum number of bytes the script can allocate. A limit of zero
+// is unbounded. Allocations are limited exactly where LuaJIT can use a custom
+// allocator. On x86_64 the limit is checked after each object and merge and
+// while Lua steps run instead.
+func (e *ExecutionEngine) SetMemoryLimit(limit int) {
+	e.limits.memory_limit = C.size_t(limit)
+}
+
+// Retrieves the maximum number of instructions the Lua steps can run until
+// the engine is reset.
+func (e *ExecutionEngine) InstructionLimit() int {
+	return int(e.limits.instruction_limit)
+}
+
+// Sets the maximum number of instructions the Lua steps can run until the
+// engine is reset. Generated code is trusted and isn't counted. A limit of
+// zero is unbounded.
+func (e *ExecutionEngine) SetInstructionLimit(limit int) {
+	e.limits.instruction_limit = C.long(limit)
 }
 
 //------------------------------------------------------------------------------
@@ -170,11 +403,16 @@ func (e *ExecutionEngine) init() error {
 	}
 
 	// Initialize the state and open the libraries.
-	e.state = C.luaL_newstate()
+	e.limits = (*C.executionEngine_limits)(C.calloc(1, C.sizeof_executionEngine_limits))
+	e.SetMemoryLimit(DefaultExecutionEngineMemoryLimit)
+	e.SetInstructionLimit(DefaultExecutionEngineInstructionLimit)
+	e.state = C.executionEngine_newstate(e.limits)
 	if e.state == nil {
+		e.Destroy()
 		return errors.New("Unable to initialize Lua context.")
 	}
-	C.luaL_openlibs(e.state)
+	C.executionEngine_openlibs(e.state)
+	C.executionEngine_setLimits(e.state, e.limits)
 
 	// Generate the header file.
 	err := e.generateHeader()
@@ -182,21 +420,28 @@ func (e *ExecutionEngine) init() error {
 		e.Destroy()
 		return err
 	}
-
-	// Compile the script.
 	e.fullSource = fmt.Sprintf("%v\n%v", e.header, e.source)
-	source := C.CString(e.fullSource)
-	defer C.free(unsafe.Pointer(source))
-	ret := C.luaL_loadstring(e.state, source)
-	if ret != 0 {
+
+	// Run the header.
+	if err = e.load(e.header, "header"); err != nil {
+		e.Destroy()
+		return err
+	}
+	if ret := C.lua_pcall(e.state, 0, 0, 0); ret != 0 {
 		defer e.Destroy()
 		errstring := C.GoString(C.lua_tolstring(e.state, -1, nil))
-		return fmt.Errorf("skyd.ExecutionEngine: Syntax Error: %v", errstring)
+		return fmt.Errorf("skyd.ExecutionEngine: Init Error: %v", errstring)
 	}
 
-	// Run script once to initialize.
-	ret = C.lua_pcall(e.state, 0, 0, 0)
-	if ret != 0 {
+	// Compile the script and pass it to the header to run in a sandbox.
+	functionName := C.CString("sky_init")
+	defer C.free(unsafe.Pointer(functionName))
+	C.lua_getfield(e.state, -10002, functionName)
+	if err = e.load(e.source, "query"); err != nil {
+		e.Destroy()
+		return err
+	}
+	if ret := C.lua_pcall(e.state, 1, 0, 0); ret != 0 {
 		defer e.Destroy()
 		errstring := C.GoString(C.lua_tolstring(e.state, -1, nil))
 		return fmt.Errorf("skyd.ExecutionEngine: Init Error: %v", errstring)
@@ -212,6 +457,21 @@ func (e *ExecutionEngine) init() error {
 	return nil
 }
 
+// Compiles a chunk and pushes it onto the stack.
+func (e *ExecutionEngine) load(source string, name string) error {
+	csource := C.CString(source)
+	defer C.free(unsafe.Pointer(csource))
+	cname := C.CString("=" + name)
+	defer C.free(unsafe.Pointer(cname))
+
+	ret := C.luaL_loadbuffer(e.state, csource, C.size_t(len(source)), cname)
+	if ret != 0 {
+		errstring := C.GoString(C.lua_tolstring(e.state, -1, nil))
+		return fmt.Errorf("skyd.ExecutionEngine: Syntax Error: %v", errstring)
+	}
+	return nil
+}
+
 // Initializes the cursor used by the script.
 func (e *ExecutionEngine) initCursor() error {
 	// Create the cursor.
@@ -242,11 +502,42 @@ func (e *ExecutionEngine) Destroy() {
 		C.lua_close(e.state)
 		e.state = nil
 	}
+	if e.limits != nil {
+		C.free(unsafe.Pointer(e.limits))
+		e.limits = nil
+	}
 	if e.iterator != nil {
 		e.SetIterator(nil)
 	}
 }
 
+// Resets the engine so that it can be reused by another query. The iterator
+// is closed, the options are cleared and the script is run again in a new
+// sandbox so that no state is carried over.
+func (e *ExecutionEngine) Reset() error {
+	e.SetIterator(nil)
+	e.SetKeyRange(nil, nil)
+	e.SetRange(time.Time{}, time.Time{})
+	e.SetFilter(nil)
+	e.SetSample(1)
+	e.SetMemoryLimit(DefaultExecutionEngineMemoryLimit)
+	e.SetInstructionLimit(DefaultExecutionEngineInstructionLimit)
+	e.limits.instructions = 0
+
+	functionName := C.CString("sky_reset")
+	defer C.free(unsafe.Pointer(functionName))
+
+	C.lua_getfield(e.state, -10002, functionName)
+	rc := C.lua_pcall(e.state, 0, 0, 0)
+	if rc != 0 {
+		luaErrString := C.GoString(C.lua_tolstring(e.state, -1, nil))
+		C.lua_settop(e.state, -(1)-1) // lua_pop()
+		return fmt.Errorf("skyd.ExecutionEngine: Unable to reset: %s", luaErrString)
+	}
+
+	return nil
+}
+
 //--------------------------------------
 // Execution
 //--------------------------------------
@@ -265,6 +556,12 @@ func (e *ExecutionEngine) Aggregate() (interface{}, error) {
 		return nil, fmt.Errorf("skyd.ExecutionEngine: Unable to aggregate: %s", luaErrString)
 	}
 
+	// Objects that couldn't be read stop the iteration and fail the query.
+	if e.err != nil {
+		C.lua_settop(e.state, -(1)-1) // lua_pop()
+		return nil, fmt.Errorf("skyd.ExecutionEngine: Unable to aggregate: %v", e.err)
+	}
+
 	return e.decodeResult()
 }
 
@@ -341,6 +638,56 @@ func (e *ExecutionEngine) decodeResult() (interface{}, error) {
 	return ret, nil
 }
 
+//--------------------------------------
+// Object Filtering
+//--------------------------------------
+
+// Checks if an object should be passed to the cursor. Sampling only uses
+// the key and then only the state at the beginning of the object's data is
+// decoded. An error is returned if the state can't be decoded.
+func (e *ExecutionEngine) matchObject(key []byte, data []byte) (bool, error) {
+	if e.sample < 1 && !sampleObject(key, e.sample) {
+		return false, nil
+	}
+	if e.start.IsZero() && e.filter == nil {
+		return true, nil
+	}
+
+	// The state is wrapped in a raw value.
+	var raw interface{}
+	reader := bytes.NewReader(data)
+	if err := msgpack.NewDecoder(reader, nil).Decode(&raw); err != nil {
+		return false, fmt.Errorf("Unable to decode object state: %v", err)
+	}
+	b, ok := raw.(string)
+	if !ok {
+		return false, fmt.Errorf("Invalid object state: %v", raw)
+	}
+	state := &Event{}
+	if err := state.DecodeRaw(bytes.NewReader([]byte(b))); err != nil {
+		return false, fmt.Errorf("Unable to decode object state: %v", err)
+	}
+
+	// The state timestamp is the time of the last event.
+	if !e.start.IsZero() && state.Timestamp.Before(e.start) {
+		return false, nil
+	}
+	if e.filter != nil && !e.filter.Match(state) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Checks if an object is included in a sample. Objects are chosen using the
+// odd bits of the FNV1a hash of the encoded object identifier so the same
+// objects are always chosen and the choice is independent of the servlet
+// that the object is stored on.
+func sampleObject(encodedObjectId []byte, sample float64) bool {
+	h := fnv.New64a()
+	h.Write(encodedObjectId)
+	return float64(CondenseUint64Odd(h.Sum64())) < sample*(1<<32)
+}
+
 //--------------------------------------
 // Codegen
 //--------------------------------------
@@ -375,12 +722,11 @@ func extractPropertyReferences(propertyFile *PropertyFile, source string) ([]*Pr
 	lookup := make(map[int64]*Property)
 
 	// Find all the event property references in the script.
-	r, err := regexp.Compile(`\bevent(?:\.|:)(\w+)`)
-	if err != nil {
-		return nil, err
-	}
-	for _, match := range r.FindAllStringSubmatch(source, -1) {
+	for _, match := range eventPropertyReferenceRegexp.FindAllStringSubmatch(source, -1) {
 		name := match[1]
+		if eventBuiltinFields[name] {
+			continue
+		}
 		property := propertyFile.GetPropertyByName(name)
 		if property == nil {
 			return nil, fmt.Errorf("Property not found: '%v'", name)
@@ -389,6 +735,20 @@ func extractPropertyReferences(propertyFile *PropertyFile, source string) ([]*Pr
 			properties = append(properties, property)
 			lookup[property.Id] = property
 		}
+
+		// Computed properties need the properties they depend on.
+		if property.IsComputed() {
+			refs, err := computedPropertyReferences(property, propertyFile)
+			if err != nil {
+				return nil, err
+			}
+			for _, ref := range refs {
+				if lookup[ref.Id] == nil {
+					properties = append(properties, ref)
+					lookup[ref.Id] = ref
+				}
+			}
+		}
 	}
 	sort.Sort(PropertyList(properties))
 
@@ -396,14 +756,14 @@ func extractPropertyReferences(propertyFile *PropertyFile, source string) ([]*Pr
 }
 
 func propertyStructDef(args ...interface{}) string {
-	if property, ok := args[0].(*Property); ok {
+	if property, ok := args[0].(*Property); ok && !property.IsComputed() {
 		return fmt.Sprintf("%v _%v;", getPropertyCType(property), property.Name)
 	}
 	return ""
 }
 
 func metatypeFunctionDef(args ...interface{}) string {
-	if property, ok := args[0].(*Property); ok {
+	if property, ok := args[0].(*Property); ok && !property.IsComputed() {
 		switch property.DataType {
 		case StringDataType:
 			return fmt.Sprintf("%v = function(event) return ffi.string(event._%v.data, event._%v.length) end,", property.Name, property.Name, property.Name)
@@ -415,7 +775,7 @@ func metatypeFunctionDef(args ...interface{}) string {
 }
 
 func initDescriptorDef(args ...interface{}) string {
-	if property, ok := args[0].(*Property); ok {
+	if property, ok := args[0].(*Property); ok && !property.IsComputed() {
 		return fmt.Sprintf("cursor:set_property(%d, ffi.offsetof('sky_lua_event_t', '_%s'), ffi.sizeof('%s'), '%s')", property.Id, property.Name, getPropertyCType(property), property.DataType)
 	}
 	return ""
@@ -18,23 +18,37 @@ import (
 func executionEngine_nextObject(cursor unsafe.Pointer) C.int {
 	e := (*ExecutionEngine)(((*C.sky_cursor)(cursor)).context)
 
-	// If the iterator is invalid then exit.
-	if !e.iterator.Valid() {
-		return 0
+	// Move through the iterator until an object matches the filters.
+	for ; e.iterator.Valid(); e.iterator.Next() {
+		// If the key prefix doesn't match or the key is past the end of the
+		// key range then the iterator is done.
+		key := e.iterator.Key()
+		if !bytes.HasPrefix(key, e.prefix) {
+			return 0
+		}
+		if e.keyLimit != nil && bytes.Compare(key, e.keyLimit) >= 0 {
+			return 0
+		}
+
+		// Skip objects outside the sample or range or that don't match the
+		// filter. Objects that can't be read end the iteration so that the
+		// error can be returned from the aggregation.
+		value := e.iterator.Value()
+		if ok, err := e.matchObject(key, value); err != nil {
+			e.err = err
+			return 0
+		} else if !ok {
+			continue
+		}
+
+		// Set the object data on the cursor.
+		C.sky_cursor_set_ptr(e.cursor, unsafe.Pointer(&value[0]), (C.size_t)(len(value)))
+
+		// Move to the next object.
+		e.iterator.Next()
+
+		return 1
 	}
 
-	// If the key prefix doesn't match then the iterator is done.
-	key := e.iterator.Key()
-	if !bytes.HasPrefix(key, e.prefix) {
-		return 0
-	}
-
-	// Set the object data on the cursor.
-	value := e.iterator.Value()
-	C.sky_cursor_set_ptr(e.cursor, unsafe.Pointer(&value[0]), (C.size_t)(len(value)))
-
-	// Move to the next object.
-	e.iterator.Next()
-
-	return 1
+	return 0
 }
@@ -0,0 +1,168 @@
+package skyd
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of idle execution engines kept by default.
+const DefaultExecutionEnginePoolSize = 64
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An ExecutionEnginePool keeps compiled execution engines after a query has
+// finished so that later queries with the same source don't have to create
+// a new Lua state and compile the script again. Engines are keyed by table,
+// schema version and source so an engine is never reused after the
+// properties it was generated from have changed. Schema versions are unique
+// across tables so an engine is not reused by a table that was deleted and
+// created again either. The least recently used idle engines are destroyed
+// once the pool is full.
+type ExecutionEnginePool struct {
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string][]*list.Element
+	purged  map[string]uint64
+	hits    uint64
+	misses  uint64
+	Size    int
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// NewExecutionEnginePool returns a new pool that holds up to size idle
+// engines.
+func NewExecutionEnginePool(size int) *ExecutionEnginePool {
+	return &ExecutionEnginePool{
+		lru:     list.New(),
+		entries: make(map[string][]*list.Element),
+		purged:  make(map[string]uint64),
+		Size:    size,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Retrieves an idle engine for the source or creates a new one if none are
+// available. The engine should be returned with Put() once it is finished.
+func (p *ExecutionEnginePool) Get(table *Table, source string) (*ExecutionEngine, error) {
+	version := table.SchemaVersion()
+	key := fmt.Sprintf("%s\n%d\n%s", table.Name, version, source)
+
+	p.mutex.Lock()
+	if elems := p.entries[key]; len(elems) > 0 {
+		elem := elems[len(elems)-1]
+		p.removeElement(elem)
+		p.hits++
+		p.mutex.Unlock()
+		return elem.Value.(*ExecutionEngine), nil
+	}
+	p.misses++
+	p.mutex.Unlock()
+
+	e, err := NewExecutionEngine(table, source)
+	if err != nil {
+		return nil, err
+	}
+	e.poolKey = key
+	e.poolVersion = version
+	return e, nil
+}
+
+// Resets an engine and adds it to the idle engines. Engines that can't be
+// reset, were created before their table was purged or don't fit in the
+// pool are destroyed.
+func (p *ExecutionEnginePool) Put(e *ExecutionEngine) {
+	if e.poolKey == "" || e.Reset() != nil {
+		e.Destroy()
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if e.poolVersion <= p.purged[e.tableName] {
+		e.Destroy()
+		return
+	}
+	p.entries[e.poolKey] = append(p.entries[e.poolKey], p.lru.PushFront(e))
+	for p.lru.Len() > p.Size {
+		elem := p.lru.Back()
+		p.removeElement(elem)
+		elem.Value.(*ExecutionEngine).Destroy()
+	}
+}
+
+// Destroys all idle engines for a table. Engines that are in use by the
+// table are destroyed when they are returned.
+func (p *ExecutionEnginePool) PurgeTable(tableName string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.purged[tableName] = nextSchemaVersion()
+	for elem := p.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if e := elem.Value.(*ExecutionEngine); e.tableName == tableName {
+			p.removeElement(elem)
+			e.Destroy()
+		}
+		elem = next
+	}
+}
+
+// Destroys all idle engines.
+func (p *ExecutionEnginePool) Purge() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*ExecutionEngine).Destroy()
+	}
+	p.lru.Init()
+	p.entries = make(map[string][]*list.Element)
+}
+
+// Removes an engine from the list and the lookup.
+func (p *ExecutionEnginePool) removeElement(elem *list.Element) {
+	p.lru.Remove(elem)
+	key := elem.Value.(*ExecutionEngine).poolKey
+	elems := p.entries[key]
+	for i, other := range elems {
+		if other == elem {
+			elems = append(elems[:i], elems[i+1:]...)
+			break
+		}
+	}
+	if len(elems) == 0 {
+		delete(p.entries, key)
+	} else {
+		p.entries[key] = elems
+	}
+}
+
+// Retrieves statistics about the pool.
+func (p *ExecutionEnginePool) Stats() map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return map[string]interface{}{
+		"hits":   p.hits,
+		"misses": p.misses,
+		"size":   p.lru.Len(),
+	}
+}
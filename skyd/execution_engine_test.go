@@ -1,6 +1,11 @@
 package skyd
 
 import (
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -32,3 +37,250 @@ func TestExecutionEngineExtractPropertyReferences(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", p, l.propertyRefs[2])
 	}
 }
+
+// Ensure that scripts can only access the sandboxed environment.
+func TestExecutionEngineSandbox(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	_, err := NewExecutionEngine(table, "if os or io or ffi or require or loadstring or getfenv or collectgarbage or string.dump then error('escaped') end")
+	if err != nil {
+		t.Fatalf("Unable to create execution engine: %v", err)
+	}
+	_, err = NewExecutionEngine(table, "os.exit(1)")
+	if err == nil || err.Error() != "skyd.ExecutionEngine: Init Error: query:1: attempt to index global 'os' (a nil value)" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensure that changes to the event accessors don't carry over to the next
+// query that uses the engine.
+func TestExecutionEngineEventIndexReset(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	e, err := NewExecutionEngine(table, "if sky_event_index.x ~= nil then error('leaked') end sky_event_index.x = function(event) return 1 end")
+	if err != nil {
+		t.Fatalf("Unable to create execution engine: %v", err)
+	}
+	defer e.Destroy()
+	if err = e.Reset(); err != nil {
+		t.Fatalf("Unable to reset execution engine: %v", err)
+	}
+
+	// Snippets can't see the accessors at all.
+	source := codegenTestLuaQuery(t, "if sky_event_index ~= nil then error('exposed') end", "results.x = 1")
+	e2, cleanup := createSingleObjectTestEngine(t, source)
+	defer cleanup()
+	if _, err := e2.Aggregate(); err != nil {
+		t.Fatalf("Unable to aggregate: %v", err)
+	}
+}
+
+// Ensure that scripts are stopped once they exceed the memory limit.
+func TestExecutionEngineMemoryLimit(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	e, err := NewExecutionEngine(table, "function merge(results, data) for i=1,1000000 do results[i] = i end end")
+	if err != nil {
+		t.Fatalf("Unable to create execution engine: %v", err)
+	}
+	defer e.Destroy()
+	e.SetMemoryLimit(4 * 1024 * 1024)
+	if _, err = e.Merge(map[string]interface{}{}, map[string]interface{}{}); err == nil {
+		t.Fatalf("Expected memory limit error")
+	}
+}
+
+// Ensure that generated code is stopped once an object has used more than
+// the memory limit, even where the allocator can't enforce it.
+func TestExecutionEngineMemoryLimitAfterObject(t *testing.T) {
+	e, cleanup := createSingleObjectTestEngine(t, "function aggregate(cursor, data) data.t = {} for i=1,1000000 do data.t[i] = i end end")
+	defer cleanup()
+	e.SetMemoryLimit(4 * 1024 * 1024)
+	if _, err := e.Aggregate(); err == nil {
+		t.Fatalf("Expected memory limit error")
+	}
+}
+
+// Ensure that snippets are stopped while they run once they exceed the
+// memory limit.
+func TestExecutionEngineMemoryLimitWithinSnippet(t *testing.T) {
+	e, cleanup := createSingleObjectTestEngine(t, codegenTestLuaQuery(t, "local t = {} for i=1,10000000 do t[i] = i end", "results.x = 1"))
+	defer cleanup()
+	e.SetMemoryLimit(4 * 1024 * 1024)
+	if _, err := e.Aggregate(); err == nil {
+		t.Fatalf("Expected memory limit error")
+	}
+}
+
+// Ensure that the instruction limit is shared by all objects in a query and
+// is only restored when the engine is reset.
+func TestExecutionEngineInstructionLimit(t *testing.T) {
+	objectIds := []string{}
+	for i := 0; i < 20; i++ {
+		objectIds = append(objectIds, fmt.Sprintf("o%d", i))
+	}
+	e, cleanup := createTestEngine(t, codegenTestLuaQuery(t, "for i=1,100000 do end", "results.x = 1"), objectIds)
+	defer cleanup()
+	e.SetInstructionLimit(1000000)
+	if _, err := e.Aggregate(); err == nil || !strings.Contains(err.Error(), "Instruction limit exceeded") {
+		t.Fatalf("Expected instruction limit error: %v", err)
+	}
+}
+
+// Ensure that an infinite loop is stopped by the default limit.
+func TestExecutionEngineDefaultInstructionLimit(t *testing.T) {
+	e, cleanup := createSingleObjectTestEngine(t, codegenTestLuaQuery(t, "while true do end", "results.x = 1"))
+	defer cleanup()
+	if e.InstructionLimit() != DefaultExecutionEngineInstructionLimit {
+		t.Fatalf("Unexpected instruction limit: %v", e.InstructionLimit())
+	}
+	if _, err := e.Aggregate(); err == nil || !strings.Contains(err.Error(), "Instruction limit exceeded") {
+		t.Fatalf("Expected instruction limit error: %v", err)
+	}
+}
+
+// Ensure that Lua step snippets are compiled as separate chunks.
+func TestExecutionEngineLuaStepSnippets(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	// Snippets can't close the function they are called from.
+	source := codegenTestLuaQuery(t, "end function aggregate(cursor, data) end do", "results.x = 1")
+	if _, err := NewExecutionEngine(table, source); err == nil || !strings.Contains(err.Error(), "Invalid Lua step: lua.aggregate:1:") {
+		t.Fatalf("Expected snippet syntax error: %v", err)
+	}
+
+	// Snippets are stopped by the instruction limit.
+	e, cleanup := createSingleObjectTestEngine(t, codegenTestLuaQuery(t, "while true do end", "results.x = 1"))
+	defer cleanup()
+	e.SetInstructionLimit(1000000)
+	if _, err := e.Aggregate(); err == nil || !strings.Contains(err.Error(), "Instruction limit exceeded") {
+		t.Fatalf("Expected instruction limit error: %v", err)
+	}
+}
+
+// Ensure that Lua step snippets only get a read-only proxy of the cursor.
+func TestExecutionEngineLuaStepCursor(t *testing.T) {
+	source := codegenTestLuaQuery(t, "if type(cursor) ~= 'table' or type(cursor.event) ~= 'table' or cursor.nextObject ~= nil or cursor.event[0] ~= nil then error('exposed') end data.ts = cursor.event:timestamp()", "results.x = 1")
+	e, cleanup := createSingleObjectTestEngine(t, source)
+	defer cleanup()
+	if _, err := e.Aggregate(); err != nil {
+		t.Fatalf("Unable to aggregate: %v", err)
+	}
+
+	e2, cleanup2 := createSingleObjectTestEngine(t, codegenTestLuaQuery(t, "cursor.event.ts = 1", "results.x = 1"))
+	defer cleanup2()
+	if _, err := e2.Aggregate(); err == nil || !strings.Contains(err.Error(), "Lua steps can't modify the cursor") {
+		t.Fatalf("Expected read-only error: %v", err)
+	}
+}
+
+// Generates the source for a query with a single Lua step.
+func codegenTestLuaQuery(t *testing.T, aggregate string, merge string) string {
+	query := NewQuery(nil, nil)
+	err := query.Deserialize(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"type": "lua", "aggregate": aggregate, "merge": merge},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to deserialize query: %v", err)
+	}
+	source, err := query.Codegen()
+	if err != nil {
+		t.Fatalf("Unable to codegen query: %v", err)
+	}
+	return source
+}
+
+// Creates an engine that iterates over a servlet with a single object.
+func createSingleObjectTestEngine(t *testing.T, source string) (*ExecutionEngine, func()) {
+	return createTestEngine(t, source, []string{"bob"})
+}
+
+// Creates an engine that iterates over a servlet with one event for each
+// object.
+func createTestEngine(t *testing.T, source string, objectIds []string) (*ExecutionEngine, func()) {
+	table := createTempTable(t)
+	table.Open()
+	path, _ := ioutil.TempDir("", "")
+	servlet := NewServlet(path, nil)
+	if err := servlet.Open(); err != nil {
+		t.Fatalf("Unable to open servlet: %v", err)
+	}
+	for _, objectId := range objectIds {
+		if err := servlet.PutEvent(table, objectId, NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{}), true); err != nil {
+			t.Fatalf("Unable to add event: %v", err)
+		}
+	}
+
+	e, err := NewExecutionEngine(table, source)
+	if err != nil {
+		t.Fatalf("Unable to create execution engine: %v", err)
+	}
+	ro := levigo.NewReadOptions()
+	e.SetIterator(servlet.db.NewIterator(ro))
+
+	return e, func() {
+		e.Destroy()
+		ro.Close()
+		servlet.Close()
+		table.Close()
+		os.RemoveAll(path)
+	}
+}
+
+// Ensure that names used in generated code must be valid identifiers.
+func TestIsValidIdentifier(t *testing.T) {
+	for _, name := range []string{"foo", "_foo", "foo_bar2"} {
+		if !isValidIdentifier(name) {
+			t.Fatalf("Expected valid identifier: %v", name)
+		}
+	}
+	for _, name := range []string{"", "2foo", "foo-bar", "foo bar", "foo\"]", "end", "nil"} {
+		if isValidIdentifier(name) {
+			t.Fatalf("Expected invalid identifier: %v", name)
+		}
+	}
+}
+
+// Ensure that engines for a purged table are not returned to the pool.
+func TestExecutionEnginePoolPurgeTable(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	pool := NewExecutionEnginePool(4)
+	e, err := pool.Get(table, "x = 1")
+	if err != nil {
+		t.Fatalf("Unable to create execution engine: %v", err)
+	}
+	pool.PurgeTable(table.Name)
+	pool.Put(e)
+	if stats := pool.Stats(); stats["size"] != 0 {
+		t.Fatalf("Unexpected engine pool stats: %v", stats)
+	}
+
+	// A table with the same name never shares a schema version.
+	other := createTempTable(t)
+	other.Open()
+	defer other.Close()
+	if table.SchemaVersion() == other.SchemaVersion() {
+		t.Fatalf("Expected different schema versions: %v", table.SchemaVersion())
+	}
+	e, err = pool.Get(other, "x = 1")
+	if err != nil {
+		t.Fatalf("Unable to create execution engine: %v", err)
+	}
+	pool.Put(e)
+	if stats := pool.Stats(); stats["size"] != 1 {
+		t.Fatalf("Unexpected engine pool stats: %v", stats)
+	}
+}
@@ -0,0 +1,108 @@
+package skyd
+
+import (
+	"container/list"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A factorCache is a bounded, bidirectional lookup of factor values and ids
+// for a single property. The least recently used entries are evicted first.
+type factorCache struct {
+	mutex    sync.Mutex
+	size     int
+	lru      *list.List
+	valueMap map[string]*list.Element
+	idMap    map[uint64]*list.Element
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// newFactorCache returns a new cache that holds up to size entries.
+func newFactorCache(size int) *factorCache {
+	return &factorCache{
+		size:     size,
+		lru:      list.New(),
+		valueMap: make(map[string]*list.Element),
+		idMap:    make(map[uint64]*list.Element),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the id for a value.
+func (c *factorCache) getId(value string) (uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem := c.valueMap[value]; elem != nil {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*Factor).Id, true
+	}
+	return 0, false
+}
+
+// Retrieves the value for an id.
+func (c *factorCache) getValue(id uint64) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem := c.idMap[id]; elem != nil {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*Factor).Value, true
+	}
+	return "", false
+}
+
+// Adds a value and id to the cache, evicting old entries if necessary.
+func (c *factorCache) add(value string, id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem := c.valueMap[value]; elem != nil {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	elem := c.lru.PushFront(&Factor{Id: id, Value: value})
+	c.valueMap[value] = elem
+	c.idMap[id] = elem
+
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Removes a value and id from the cache.
+func (c *factorCache) remove(value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem := c.valueMap[value]; elem != nil {
+		c.removeElement(elem)
+	}
+}
+
+// Removes an entry from the list and both lookups.
+func (c *factorCache) removeElement(elem *list.Element) {
+	factor := elem.Value.(*Factor)
+	c.lru.Remove(elem)
+	delete(c.valueMap, factor.Value)
+	delete(c.idMap, factor.Id)
+}
+
+// The number of entries in the cache.
+func (c *factorCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
@@ -1,13 +1,38 @@
 package skyd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/jmhodges/levigo"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of factors returned from a listing when no limit is given.
+const DefaultFactorLimit = 100
+
+// The number of values cached for each property by default.
+const DefaultFactorCacheSize = 10000
+
+// The number of new factors that are buffered before they are written.
+const DefaultFactorFlushSize = 1000
+
+// How often buffered factors are written to the database.
+const DefaultFactorFlushInterval = 1 * time.Second
+
+// The number of sequence ids that are reserved in the database at a time.
+const FactorSequenceBlockSize = 1000
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -15,12 +40,45 @@ import (
 //------------------------------------------------------------------------------
 
 // A Factors object manages the factorization and defactorization of values.
+// New factors are buffered in memory and written to the database in batches
+// once the buffer is full, on an interval, when the database is closed and
+// whenever Flush() is called. Callers must flush before storing new factor
+// ids elsewhere so the values are never lost. Sequence ids are reserved in
+// blocks that are saved before the ids are used so an id is never issued
+// twice, even after a crash. Lookups that miss the cache are performed under
+// the factors mutex so that a deleted factor can't be added back to the
+// cache.
 type Factors struct {
-	db    *levigo.DB
-	ro    *levigo.ReadOptions
-	wo    *levigo.WriteOptions
-	path  string
-	mutex sync.Mutex
+	hits          uint64
+	misses        uint64
+	db            *levigo.DB
+	ro            *levigo.ReadOptions
+	wo            *levigo.WriteOptions
+	path          string
+	mutex         sync.Mutex
+	cacheMutex    sync.RWMutex
+	caches        map[string]*factorCache
+	sequences     map[string]uint64
+	reserved      map[string]uint64
+	pending       map[string]*pendingFactor
+	pendingIds    map[string]*pendingFactor
+	closing       chan bool
+	CacheSize     int
+	FlushSize     int
+	FlushInterval time.Duration
+}
+
+// A pendingFactor is a new factor that hasn't been written to the database.
+type pendingFactor struct {
+	namespace string
+	id        string
+	Factor
+}
+
+// A Factor is a single value and its sequence id within a factor namespace.
+type Factor struct {
+	Id    uint64 `json:"id"`
+	Value string `json:"value"`
 }
 
 //------------------------------------------------------------------------------
@@ -53,7 +111,17 @@ func (e *FactorNotFound) Error() string {
 
 // NewFactors returns a new Factors object.
 func NewFactors(path string) *Factors {
-	return &Factors{path: path}
+	return &Factors{
+		path:          path,
+		caches:        make(map[string]*factorCache),
+		sequences:     make(map[string]uint64),
+		reserved:      make(map[string]uint64),
+		pending:       make(map[string]*pendingFactor),
+		pendingIds:    make(map[string]*pendingFactor),
+		CacheSize:     DefaultFactorCacheSize,
+		FlushSize:     DefaultFactorFlushSize,
+		FlushInterval: DefaultFactorFlushInterval,
+	}
 }
 
 //------------------------------------------------------------------------------
@@ -97,13 +165,31 @@ func (f *Factors) Open() error {
 	f.ro = levigo.NewReadOptions()
 	f.wo = levigo.NewWriteOptions()
 
+	// Write new factors in the background.
+	f.closing = make(chan bool)
+	go f.flushLoop(f.closing)
+
 	return nil
 }
 
-// Closes the factors database.
+// Closes the factors database. Buffered factors are written first and the
+// unused part of each reserved sequence block is released.
 func (f *Factors) Close() {
+	if f.closing != nil {
+		close(f.closing)
+		f.closing = nil
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	if f.db != nil {
+		if err := f.flush(); err != nil {
+			fmt.Printf("skyd.Factors: Unable to flush factors: %v\n", err)
+		} else if err := f.release(); err != nil {
+			fmt.Printf("skyd.Factors: Unable to release sequences: %v\n", err)
+		}
 		f.db.Close()
+		f.db = nil
 	}
 	if f.ro != nil {
 		f.ro.Close()
@@ -137,6 +223,11 @@ func (f *Factors) seqkey(namespace string, id string) string {
 	return fmt.Sprintf("%s>%s!", namespace, id)
 }
 
+// The count key for a given namespace/id.
+func (f *Factors) cntkey(namespace string, id string) string {
+	return fmt.Sprintf("%s>%s#", namespace, id)
+}
+
 //--------------------------------------
 // Factorization
 //--------------------------------------
@@ -148,14 +239,37 @@ func (f *Factors) Factorize(namespace string, id string, value string, createIfM
 		return 0, nil
 	}
 
+	// Check the cache first.
+	cache := f.cache(namespace, id)
+	if sequence, ok := cache.getId(value); ok {
+		atomic.AddUint64(&f.hits, 1)
+		return sequence, nil
+	}
+	atomic.AddUint64(&f.misses, 1)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Check new factors that haven't been written yet.
+	key := f.key(namespace, id, value)
+	if factor := f.pending[key]; factor != nil {
+		cache.add(value, factor.Id)
+		return factor.Id, nil
+	}
+
 	// Otherwise find it in the LevelDB database.
-	data, err := f.db.Get(f.ro, []byte(f.key(namespace, id, value)))
+	data, err := f.db.Get(f.ro, []byte(key))
 	if err != nil {
 		return 0, err
 	}
-	// If key does exist then parse and return it.
+	// If key does exist then parse, cache and return it.
 	if data != nil {
-		return strconv.ParseUint(string(data), 10, 64)
+		sequence, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		cache.add(value, sequence)
+		return sequence, nil
 	}
 
 	// Create a new factor if requested.
@@ -163,38 +277,30 @@ func (f *Factors) Factorize(namespace string, id string, value string, createIfM
 		return f.add(namespace, id, value)
 	}
 
-	err = NewFactorNotFound(fmt.Sprintf("skyd.Factors: Factor not found: %v", f.key(namespace, id, value)))
+	err = NewFactorNotFound(fmt.Sprintf("skyd.Factors: Factor not found: %v", key))
 	return 0, err
 }
 
-// Adds a new factor to the database if it doesn't exist.
+// Adds a new factor to the write buffer. This must be called while holding
+// the factors mutex.
 func (f *Factors) add(namespace string, id string, value string) (uint64, error) {
-	// Lock while adding a new value.
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
-	// Retry factorize within the context of the lock.
-	sequence, err := f.Factorize(namespace, id, value, false)
-	if err == nil {
-		return sequence, nil
-	} else if _, ok := err.(*FactorNotFound); !ok {
-		return 0, err
-	}
-
 	// Retrieve next id in sequence.
-	sequence, err = f.inc(namespace, id)
+	sequence, err := f.next(namespace, id)
 	if err != nil {
 		return 0, err
 	}
 
-	// Save lookup and reverse lookup.
-	err = f.db.Put(f.wo, []byte(f.key(namespace, id, value)), []byte(strconv.FormatUint(sequence, 10)))
-	if err != nil {
-		return 0, err
-	}
-	err = f.db.Put(f.wo, []byte(f.revkey(namespace, id, sequence)), []byte(value))
-	if err != nil {
-		return 0, err
+	// Buffer the factor until the next flush.
+	factor := &pendingFactor{namespace: namespace, id: id, Factor: Factor{Id: sequence, Value: value}}
+	f.pending[f.key(namespace, id, value)] = factor
+	f.pendingIds[f.revkey(namespace, id, sequence)] = factor
+	f.sequences[f.seqkey(namespace, id)] = sequence
+	f.cache(namespace, id).add(value, sequence)
+
+	if len(f.pending) >= f.FlushSize {
+		if err = f.flush(); err != nil {
+			return 0, err
+		}
 	}
 
 	return sequence, nil
@@ -207,44 +313,409 @@ func (f *Factors) Defactorize(namespace string, id string, value uint64) (string
 		return "", nil
 	}
 
+	// Check the cache first.
+	cache := f.cache(namespace, id)
+	if str, ok := cache.getValue(value); ok {
+		atomic.AddUint64(&f.hits, 1)
+		return str, nil
+	}
+	atomic.AddUint64(&f.misses, 1)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Check new factors that haven't been written yet.
+	revkey := f.revkey(namespace, id, value)
+	if factor := f.pendingIds[revkey]; factor != nil {
+		cache.add(factor.Value, value)
+		return factor.Value, nil
+	}
+
 	// Find it in LevelDB.
-	data, err := f.db.Get(f.ro, []byte(f.revkey(namespace, id, value)))
+	data, err := f.db.Get(f.ro, []byte(revkey))
 	if err != nil {
 		return "", err
 	}
 	if data == nil {
-		return "", fmt.Errorf("skyd.Factors: Value does not exist: %v", f.revkey(namespace, id, value))
+		return "", fmt.Errorf("skyd.Factors: Value does not exist: %v", revkey)
 	}
+	cache.add(string(data), value)
 	return string(data), nil
 }
 
 // Retrieves the next available sequence number within a namespace for an id.
-func (f *Factors) inc(namespace string, id string) (uint64, error) {
-	data, err := f.db.Get(f.ro, []byte(f.seqkey(namespace, id)))
+// The database stores the end of the reserved block so a new block is saved
+// before its first id is returned. This must be called while holding the
+// factors mutex.
+func (f *Factors) next(namespace string, id string) (uint64, error) {
+	key := f.seqkey(namespace, id)
+	sequence, ok := f.sequences[key]
+	if !ok {
+		data, err := f.db.Get(f.ro, []byte(key))
+		if err != nil {
+			return 0, err
+		}
+
+		// Start the sequence if it doesn't exist. Otherwise continue after
+		// the last reserved id.
+		if data != nil {
+			if sequence, err = strconv.ParseUint(string(data), 10, 64); err != nil {
+				return 0, fmt.Errorf("skyd.Factors: Unable to parse sequence: %v", data)
+			}
+		}
+		f.reserved[key] = sequence
+	}
+	sequence++
+
+	// Reserve the next block of ids.
+	if sequence > f.reserved[key] {
+		reserved := sequence + FactorSequenceBlockSize - 1
+		if err := f.db.Put(f.wo, []byte(key), []byte(strconv.FormatUint(reserved, 10))); err != nil {
+			return 0, err
+		}
+		f.reserved[key] = reserved
+	}
+	return sequence, nil
+}
+
+// Saves the last issued id of each sequence so that the rest of the reserved
+// blocks can be used again. This must be called while holding the factors
+// mutex after the buffered factors have been written.
+func (f *Factors) release() error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	for key, sequence := range f.sequences {
+		wb.Put([]byte(key), []byte(strconv.FormatUint(sequence, 10)))
+		f.reserved[key] = sequence
+	}
+	return f.db.Write(f.wo, wb)
+}
+
+//--------------------------------------
+// Flushing
+//--------------------------------------
+
+// Writes any buffered factors to the database.
+func (f *Factors) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.flush()
+}
+
+// Writes the buffered factors along with their lookups and the updated
+// counts in a single batch. Their sequences were already saved when they
+// were reserved. This must be called while holding the factors mutex.
+func (f *Factors) flush() error {
+	if len(f.pending) == 0 || f.db == nil {
+		return nil
+	}
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	counts := make(map[string]uint64)
+	for key, factor := range f.pending {
+		wb.Put([]byte(key), []byte(strconv.FormatUint(factor.Id, 10)))
+		wb.Put([]byte(f.revkey(factor.namespace, factor.id, factor.Id)), []byte(factor.Value))
+
+		cntkey := f.cntkey(factor.namespace, factor.id)
+		if _, ok := counts[cntkey]; !ok {
+			count, err := f.count(factor.namespace, factor.id)
+			if err != nil {
+				return err
+			}
+			counts[cntkey] = count
+		}
+		counts[cntkey]++
+	}
+	for cntkey, count := range counts {
+		wb.Put([]byte(cntkey), []byte(strconv.FormatUint(count, 10)))
+	}
+	if err := f.db.Write(f.wo, wb); err != nil {
+		return err
+	}
+
+	f.pending = make(map[string]*pendingFactor)
+	f.pendingIds = make(map[string]*pendingFactor)
+	return nil
+}
+
+// Flushes buffered factors on an interval until the channel is closed.
+func (f *Factors) flushLoop(closing chan bool) {
+	ticker := time.NewTicker(f.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Flush(); err != nil {
+				fmt.Printf("skyd.Factors: Unable to flush factors: %v\n", err)
+			}
+		case <-closing:
+			return
+		}
+	}
+}
+
+//--------------------------------------
+// Cache
+//--------------------------------------
+
+// Retrieves the cache for an id within a namespace, creating it if needed.
+func (f *Factors) cache(namespace string, id string) *factorCache {
+	key := f.key(namespace, id, "")
+	f.cacheMutex.RLock()
+	cache := f.caches[key]
+	f.cacheMutex.RUnlock()
+	if cache != nil {
+		return cache
+	}
+
+	f.cacheMutex.Lock()
+	defer f.cacheMutex.Unlock()
+	if cache = f.caches[key]; cache == nil {
+		cache = newFactorCache(f.CacheSize)
+		f.caches[key] = cache
+	}
+	return cache
+}
+
+// Removes cached values, sequences and buffered factors for keys beginning
+// with a prefix. This must be called while holding the factors mutex.
+func (f *Factors) purgeCaches(prefix string) {
+	for key, factor := range f.pending {
+		if strings.HasPrefix(key, prefix) {
+			delete(f.pending, key)
+			delete(f.pendingIds, f.revkey(factor.namespace, factor.id, factor.Id))
+		}
+	}
+
+	f.cacheMutex.Lock()
+	defer f.cacheMutex.Unlock()
+	for key := range f.caches {
+		if strings.HasPrefix(key, prefix) {
+			delete(f.caches, key)
+		}
+	}
+	for key := range f.sequences {
+		if strings.HasPrefix(key, prefix) {
+			delete(f.sequences, key)
+		}
+	}
+	for key := range f.reserved {
+		if strings.HasPrefix(key, prefix) {
+			delete(f.reserved, key)
+		}
+	}
+}
+
+// Retrieves statistics about the factor cache.
+func (f *Factors) Stats() map[string]interface{} {
+	f.mutex.Lock()
+	pending := len(f.pending)
+	f.mutex.Unlock()
+
+	f.cacheMutex.RLock()
+	defer f.cacheMutex.RUnlock()
+	size := 0
+	for _, cache := range f.caches {
+		size += cache.len()
+	}
+	return map[string]interface{}{
+		"hits":    atomic.LoadUint64(&f.hits),
+		"misses":  atomic.LoadUint64(&f.misses),
+		"caches":  len(f.caches),
+		"size":    size,
+		"pending": pending,
+	}
+}
+
+//--------------------------------------
+// Deletion
+//--------------------------------------
+
+// Removes all factors and sequences within a namespace.
+func (f *Factors) DeleteNamespace(namespace string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.purgeCaches(namespace + ">")
+	return f.deletePrefix([]byte(namespace + ">"))
+}
+
+// Removes all factors and the sequence for an id within a namespace.
+func (f *Factors) DeleteId(namespace string, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.purgeCaches(f.key(namespace, id, ""))
+	f.purgeCaches(f.seqkey(namespace, id))
+	if err := f.deletePrefix([]byte(f.key(namespace, id, ""))); err != nil {
+		return err
+	}
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	wb.Delete([]byte(f.seqkey(namespace, id)))
+	wb.Delete([]byte(f.cntkey(namespace, id)))
+	return f.db.Write(f.wo, wb)
+}
+
+// Removes a single factor and its reverse lookup. The sequence is not reused.
+func (f *Factors) Delete(namespace string, id string, factor *Factor) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.cache(namespace, id).remove(factor.Value)
+	delete(f.pending, f.key(namespace, id, factor.Value))
+	delete(f.pendingIds, f.revkey(namespace, id, factor.Id))
+
+	// Only stored factors are counted.
+	key := f.key(namespace, id, factor.Value)
+	data, err := f.db.Get(f.ro, []byte(key))
 	if err != nil {
-		return 0, err
+		return err
 	}
+	stored := data != nil && string(data) == strconv.FormatUint(factor.Id, 10)
 
-	// Initialize key if it doesn't exist. Otherwise increment it.
-	if data == nil {
-		err := f.db.Put(f.wo, []byte(f.seqkey(namespace, id)), []byte("1"))
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	if stored {
+		count, err := f.count(namespace, id)
 		if err != nil {
-			return 0, err
+			return err
+		}
+		if count > 0 {
+			count--
+		}
+		wb.Put([]byte(f.cntkey(namespace, id)), []byte(strconv.FormatUint(count, 10)))
+	}
+	wb.Delete([]byte(key))
+	wb.Delete([]byte(f.revkey(namespace, id, factor.Id)))
+	return f.db.Write(f.wo, wb)
+}
+
+// Removes every key that begins with a given prefix.
+func (f *Factors) deletePrefix(prefix []byte) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	iterator := f.db.NewIterator(f.ro)
+	defer iterator.Close()
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
 		}
-		return 1, nil
+		wb.Delete(key)
 	}
+	if err := iterator.GetError(); err != nil {
+		return err
+	}
+
+	return f.db.Write(f.wo, wb)
+}
+
+//--------------------------------------
+// Listing
+//--------------------------------------
 
-	// Parse existing sequence.
-	sequence, err := strconv.ParseUint(string(data), 10, 64)
+// Retrieves the number of values that are currently stored for an id in a
+// namespace. Deleted values are not counted.
+func (f *Factors) Cardinality(namespace string, id string) (uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	return f.count(namespace, id)
+}
+
+// Retrieves the stored count of values for an id in a namespace. Databases
+// written before counts were kept are counted once and the count is saved.
+// This must be called while holding the factors mutex.
+func (f *Factors) count(namespace string, id string) (uint64, error) {
+	key := f.cntkey(namespace, id)
+	data, err := f.db.Get(f.ro, []byte(key))
 	if err != nil {
-		return 0, fmt.Errorf("skyd.Factors: Unable to parse sequence: %v", data)
+		return 0, err
+	}
+	if data != nil {
+		count, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("skyd.Factors: Unable to parse count: %v", data)
+		}
+		return count, nil
 	}
 
-	// Increment and save the new value.
-	sequence += 1
-	err = f.db.Put(f.wo, []byte(f.seqkey(namespace, id)), []byte(strconv.FormatUint(sequence, 10)))
+	// Nothing has been stored if there is no sequence.
+	if data, err = f.db.Get(f.ro, []byte(f.seqkey(namespace, id))); err != nil || data == nil {
+		return 0, err
+	}
+
+	var count uint64
+	err = f.scan(namespace, id, "", func(factor *Factor) {
+		count++
+	})
 	if err != nil {
 		return 0, err
 	}
-	return sequence, nil
+	if err = f.db.Put(f.wo, []byte(key), []byte(strconv.FormatUint(count, 10))); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Finds the factors for an id in a namespace whose values begin with a given
+// prefix. Factors are returned in value order starting from an offset. A limit
+// of zero returns all remaining factors. The total number of matching factors
+// is also returned.
+func (f *Factors) Find(namespace string, id string, prefix string, offset int, limit int) ([]*Factor, int, error) {
+	factors := make([]*Factor, 0)
+	count := 0
+	err := f.each(namespace, id, prefix, func(factor *Factor) {
+		if count >= offset && (limit == 0 || len(factors) < limit) {
+			factors = append(factors, factor)
+		}
+		count++
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return factors, count, nil
+}
+
+// Iterates over the factors for an id in a namespace whose values begin with
+// a given prefix in value order. Buffered factors are written first.
+func (f *Factors) each(namespace string, id string, prefix string, fn func(factor *Factor)) error {
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	return f.scan(namespace, id, prefix, fn)
+}
+
+// Iterates over the stored factors for an id in a namespace whose values
+// begin with a given prefix in value order.
+func (f *Factors) scan(namespace string, id string, prefix string, fn func(factor *Factor)) error {
+	iterator := f.db.NewIterator(f.ro)
+	defer iterator.Close()
+
+	// Forward and reverse lookups share the same key space so only keep
+	// entries that have a matching reverse lookup.
+	base := []byte(f.key(namespace, id, ""))
+	start := []byte(f.key(namespace, id, prefix))
+	for iterator.Seek(start); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if !bytes.HasPrefix(key, start) {
+			break
+		}
+		value := string(key[len(base):])
+		sequence, err := strconv.ParseUint(string(iterator.Value()), 10, 64)
+		if err != nil || sequence == 0 {
+			continue
+		}
+		data, err := f.db.Get(f.ro, []byte(f.revkey(namespace, id, sequence)))
+		if err != nil {
+			return err
+		}
+		if string(data) != value {
+			continue
+		}
+		fn(&Factor{Id: sequence, Value: value})
+	}
+	return iterator.GetError()
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 // Ensure that we can create a new table.
@@ -38,3 +39,188 @@ func TestFactorization(t *testing.T) {
 		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "/about.html", str, err)
 	}
 }
+
+// Ensure that factors are cached and evicted when the cache is full.
+func TestFactorCache(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	factors.CacheSize = 2
+	defer factors.Close()
+	err = factors.Open()
+	if err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+
+	factors.Factorize("foo", "bar", "a", true)
+	factors.Factorize("foo", "bar", "b", true)
+	factors.Factorize("foo", "bar", "c", true)
+	if stats := factors.Stats(); stats["size"] != 2 {
+		t.Fatalf("Wrong cache size: exp: %v, got: %v", 2, stats["size"])
+	}
+
+	// "a" was evicted so it must be read from the database.
+	str, err := factors.Defactorize("foo", "bar", 1)
+	if err != nil || str != "a" {
+		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "a", str, err)
+	}
+	num, err := factors.Factorize("foo", "bar", "c", false)
+	if err != nil || num != 3 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 3, num, err)
+	}
+
+	// New values continue the cached sequence.
+	num, err = factors.Factorize("foo", "bar", "d", true)
+	if err != nil || num != 4 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 4, num, err)
+	}
+
+	// Deleting an id resets its sequence.
+	if err = factors.DeleteId("foo", "bar"); err != nil {
+		t.Fatalf("Unable to delete factors: %v", err)
+	}
+	num, err = factors.Factorize("foo", "bar", "d", true)
+	if err != nil || num != 1 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 1, num, err)
+	}
+}
+
+// Ensure that new factors are buffered until they are flushed or closed.
+func TestFactorWriteBehind(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	factors.FlushSize = 3
+	factors.FlushInterval = time.Hour
+	err = factors.Open()
+	if err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+
+	// Buffered factors can be read before they are written.
+	factors.Factorize("foo", "bar", "a", true)
+	factors.Factorize("foo", "bar", "b", true)
+	if data, _ := factors.db.Get(factors.ro, []byte(factors.key("foo", "bar", "a"))); data != nil {
+		t.Fatalf("Unexpected write: %v", string(data))
+	}
+	if stats := factors.Stats(); stats["pending"] != 2 {
+		t.Fatalf("Wrong pending count: exp: %v, got: %v", 2, stats["pending"])
+	}
+	num, err := factors.Factorize("foo", "bar", "b", false)
+	if err != nil || num != 2 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 2, num, err)
+	}
+
+	// The buffer is written once it is full.
+	factors.Factorize("foo", "bar", "c", true)
+	if stats := factors.Stats(); stats["pending"] != 0 {
+		t.Fatalf("Wrong pending count: exp: %v, got: %v", 0, stats["pending"])
+	}
+
+	// Closing writes the rest of the buffer.
+	factors.Factorize("foo", "bar", "d", true)
+	factors.Close()
+	factors = NewFactors(path)
+	defer factors.Close()
+	if err = factors.Open(); err != nil {
+		t.Fatalf("Unable to open factors: %v", err)
+	}
+	str, err := factors.Defactorize("foo", "bar", 4)
+	if err != nil || str != "d" {
+		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "d", str, err)
+	}
+	num, err = factors.Factorize("foo", "bar", "e", true)
+	if err != nil || num != 5 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 5, num, err)
+	}
+}
+
+// Ensure that flushed factors survive a crash and that ids are never issued
+// twice after one.
+func TestFactorCrash(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	factors.FlushInterval = time.Hour
+	if err = factors.Open(); err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+	factors.Factorize("foo", "bar", "a", true)
+	if err = factors.Flush(); err != nil {
+		t.Fatalf("Unable to flush factors: %v", err)
+	}
+	factors.Factorize("foo", "bar", "b", true)
+
+	// Close the database without calling Close() so nothing else is written.
+	close(factors.closing)
+	factors.db.Close()
+
+	factors = NewFactors(path)
+	defer factors.Close()
+	if err = factors.Open(); err != nil {
+		t.Fatalf("Unable to open factors: %v", err)
+	}
+	str, err := factors.Defactorize("foo", "bar", 1)
+	if err != nil || str != "a" {
+		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "a", str, err)
+	}
+	if _, err = factors.Defactorize("foo", "bar", 2); err == nil {
+		t.Fatalf("Expected unflushed factor to be lost")
+	}
+	num, err := factors.Factorize("foo", "bar", "c", true)
+	if err != nil || num <= 2 {
+		t.Fatalf("Reused factor id: %v (%v)", num, err)
+	}
+}
+
+// Ensure that the number of stored values is tracked as factors are added
+// and deleted.
+func TestFactorCardinality(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	factors.FlushInterval = time.Hour
+	if err = factors.Open(); err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+	factors.Factorize("foo", "bar", "a", true)
+	factors.Factorize("foo", "bar", "b", true)
+	factors.Factorize("foo", "bar", "c", true)
+	if count, err := factors.Cardinality("foo", "bar"); err != nil || count != 3 {
+		t.Fatalf("Wrong cardinality: exp: %v, got: %v (%v)", 3, count, err)
+	}
+
+	// Only stored factors are removed from the count.
+	factors.Delete("foo", "bar", &Factor{Id: 2, Value: "b"})
+	num, _ := factors.Factorize("foo", "bar", "d", true)
+	factors.Delete("foo", "bar", &Factor{Id: num, Value: "d"})
+	if count, err := factors.Cardinality("foo", "bar"); err != nil || count != 2 {
+		t.Fatalf("Wrong cardinality: exp: %v, got: %v (%v)", 2, count, err)
+	}
+
+	// The count is kept after reopening and recounted if it is missing.
+	factors.Close()
+	factors = NewFactors(path)
+	defer factors.Close()
+	if err = factors.Open(); err != nil {
+		t.Fatalf("Unable to open factors: %v", err)
+	}
+	if count, err := factors.Cardinality("foo", "bar"); err != nil || count != 2 {
+		t.Fatalf("Wrong cardinality: exp: %v, got: %v (%v)", 2, count, err)
+	}
+	factors.db.Delete(factors.wo, []byte(factors.cntkey("foo", "bar")))
+	if count, err := factors.Cardinality("foo", "bar"); err != nil || count != 2 {
+		t.Fatalf("Wrong cardinality: exp: %v, got: %v (%v)", 2, count, err)
+	}
+	if count, err := factors.Cardinality("foo", "baz"); err != nil || count != 0 {
+		t.Fatalf("Wrong cardinality: exp: %v, got: %v (%v)", 0, count, err)
+	}
+}
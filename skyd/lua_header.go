@@ -2,7 +2,8 @@ package skyd
 
 const LuaHeader = `
 -- SKY GENERATED CODE BEGIN --
-local ffi = require('ffi')
+local ffi = ffi
+local env, sky_chunk
 ffi.cdef([[
 typedef struct sky_string_t { int32_t length; char *data; } sky_string_t;
 typedef struct {
@@ -25,6 +26,8 @@ bool sky_cursor_eos(sky_cursor_t *);
 bool sky_lua_cursor_next_event(sky_cursor_t *);
 bool sky_lua_cursor_next_session(sky_cursor_t *);
 bool sky_cursor_set_session_idle(sky_cursor_t *, uint32_t);
+void sky_cursor_mark(sky_cursor_t *);
+void sky_cursor_restore(sky_cursor_t *);
 ]])
 ffi.metatype('sky_cursor_t', {
   __index = {
@@ -38,20 +41,120 @@ ffi.metatype('sky_cursor_t', {
     nextObject = function(cursor) return ffi.C.sky_cursor_next_object(cursor) end,
     eof = function(cursor) return ffi.C.sky_cursor_eof(cursor) end,
     eos = function(cursor) return ffi.C.sky_cursor_eos(cursor) end,
-    next = function(cursor) return ffi.C.sky_lua_cursor_next_event(cursor) end,
+    next = function(cursor)
+      local ret = ffi.C.sky_lua_cursor_next_event(cursor)
+      if ret and env.sky_session_next ~= nil then env.sky_session_next(cursor) end
+      return ret
+    end,
     next_session = function(cursor) return ffi.C.sky_lua_cursor_next_session(cursor) end,
+    -- Reading ahead from a mark doesn't update the session values.
+    next_event = function(cursor) return ffi.C.sky_lua_cursor_next_event(cursor) end,
+    mark = function(cursor) ffi.C.sky_cursor_mark(cursor) end,
+    restore = function(cursor) ffi.C.sky_cursor_restore(cursor) end,
     set_session_idle = function(cursor, seconds) return ffi.C.sky_cursor_set_session_idle(cursor, seconds) end,
   }
 })
-ffi.metatype('sky_lua_event_t', {
-  __index = {
+local sky_event_accessors = {
   {{range .}}{{metatypedef .}}
   {{end}}
-  }
+}
+local sky_event_index = {}
+ffi.metatype('sky_lua_event_t', {
+  __index = sky_event_index
 })
 
+-- Query code runs in a sandbox that only exposes what it needs. A new
+-- sandbox is created each time the engine is reset so that nothing carries
+-- over between queries.
+local function sky_copy(t)
+  local copy = {}
+  for k,v in pairs(t) do copy[k] = v end
+  return copy
+end
+
+local function sky_sandbox()
+  local sandbox = {
+    assert = assert, error = error, ipairs = ipairs, next = next, pairs = pairs,
+    select = select, tonumber = tonumber, tostring = tostring, type = type, unpack = unpack,
+    bit = sky_copy(bit), math = sky_copy(math), string = sky_copy(string), table = sky_copy(table),
+  }
+  sandbox.string.dump = nil
+  return sandbox
+end
+
+-- The event accessors are restored on every reset. The query adds accessors
+-- for computed properties to them but changes never carry over to the next
+-- query that uses the engine.
+local function sky_reset_event_index()
+  for k,_ in pairs(sky_event_index) do sky_event_index[k] = nil end
+  for k,v in pairs(sky_event_accessors) do sky_event_index[k] = v end
+end
+
+-- Snippets never see the cursor itself since its pointers could be used to
+-- read and write any memory. They get a proxy instead whose event only has
+-- read-only accessors for the properties of the current event.
+local sky_snippet_cursor_cdata
+
+local function sky_readonly()
+  error("Lua steps can't modify the cursor", 2)
+end
+
+local function sky_snippet_cursor()
+  local accessors = {
+    timestamp = function() return tonumber(sky_snippet_cursor_cdata.event.timestamp) end,
+  }
+  for name,fn in pairs(sky_event_index) do
+    accessors[name] = function() return fn(sky_snippet_cursor_cdata.event) end
+  end
+  local event = setmetatable({}, {__index = accessors, __newindex = sky_readonly, __metatable = false})
+  return setmetatable({}, {__index = {event = event}, __newindex = sky_readonly, __metatable = false})
+end
+
+-- User-supplied snippets are registered by the query in "sky_snippets" and
+-- compiled here as separate chunks so they can't close the function they
+-- are called from. Each snippet gets its own sandbox and can't change the
+-- generated functions. Snippets are interpreted so that the instruction and
+-- memory limits can be checked while they run.
+local function sky_load_snippets()
+  local cursor = sky_snippet_cursor()
+  for name,snippet in pairs(env.sky_snippets) do
+    if string.byte(snippet.source, 1) == 27 then
+      error("Invalid Lua step: " .. snippet.name .. ": binary chunks are not allowed", 0)
+    end
+    local fn, err = loadstring("local " .. snippet.args .. " = ...; " .. snippet.source, "=" .. snippet.name)
+    if fn == nil then
+      error("Invalid Lua step: " .. err, 0)
+    end
+    jit.off(fn, true)
+    setfenv(fn, sky_sandbox())
+    if snippet.cursor then
+      env.sky_snippets[name] = function(_cursor, ...)
+        sky_snippet_cursor_cdata = _cursor
+        return sky_call_limited(fn, cursor, ...)
+      end
+    else
+      env.sky_snippets[name] = function(...) return sky_call_limited(fn, ...) end
+    end
+  end
+end
+
+function sky_reset()
+  sky_reset_event_index()
+  env = sky_sandbox()
+  env.sky_event_index = sky_event_index
+  env.sky_snippets = {}
+  setfenv(sky_chunk, env)
+  sky_chunk()
+  sky_load_snippets()
+end
+
+function sky_init(chunk)
+  sky_chunk = chunk
+  sky_reset()
+end
+
 function sky_init_cursor(_cursor)
-  cursor = ffi.cast('sky_cursor_t*', _cursor)
+  local cursor = ffi.cast('sky_cursor_t*', _cursor)
   {{range .}}{{initdescriptor .}}
   {{end}}
   cursor:set_timestamp_offset(ffi.offsetof('sky_lua_event_t', 'timestamp'))
@@ -60,10 +163,11 @@ function sky_init_cursor(_cursor)
 end
 
 function sky_aggregate(_cursor)
-  cursor = ffi.cast('sky_cursor_t*', _cursor)
-  data = {}
+  local cursor = ffi.cast('sky_cursor_t*', _cursor)
+  local data = {}
   while cursor:nextObject() do
-    aggregate(cursor, data)
+    env.aggregate(cursor, data)
+    sky_check_memory()
   end
   return data
 end
@@ -71,7 +175,8 @@ end
 -- The wrapper for the merge.
 function sky_merge(results, data)
   if data ~= nil then
-    merge(results, data)
+    env.merge(results, data)
+    sky_check_memory()
   end
   return results
 end
@@ -2,14 +2,23 @@ package skyd
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"time"
 )
 
 // A Property is a loose schema column on a Table.
 type Property struct {
-	Id        int64  `json:"id"`
-	Name      string `json:"name"`
-	Transient bool   `json:"transient"`
-	DataType  string `json:"dataType"`
+	Id         int64         `json:"id"`
+	Name       string        `json:"name"`
+	Transient  bool          `json:"transient"`
+	DataType   string        `json:"dataType"`
+	Required   bool          `json:"required,omitempty"`
+	Default    interface{}   `json:"default,omitempty"`
+	Enum       []interface{} `json:"enum,omitempty"`
+	Min        *float64      `json:"min,omitempty"`
+	Max        *float64      `json:"max,omitempty"`
+	Expression string        `json:"expression,omitempty"`
 }
 
 // NewProperty returns a new Property.
@@ -28,3 +37,202 @@ func NewProperty(id int64, name string, transient bool, dataType string) (*Prope
 		DataType:  dataType,
 	}, nil
 }
+
+// Returns whether the property is computed from an expression instead of
+// being stored on events.
+func (p *Property) IsComputed() bool {
+	return p.Expression != ""
+}
+
+// Validates a value against the property's data type and converts it to the
+// representation that is stored. Integers are stored as int64 and floats as
+// float64 so that the cursor decodes them correctly.
+func (p *Property) NormalizeValue(value interface{}) (interface{}, error) {
+	v := normalize(value)
+	switch p.DataType {
+	case FactorDataType, StringDataType:
+		if _, ok := v.(string); ok {
+			return v, nil
+		}
+	case IntegerDataType:
+		switch v := v.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if v == math.Trunc(v) {
+				return int64(v), nil
+			}
+		}
+	case FloatDataType:
+		switch v := v.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+	case BooleanDataType:
+		if _, ok := v.(bool); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid %v value for property '%v': %#v", p.DataType, p.Name, value)
+}
+
+// Checks a normalized value against the enumeration and range constraints
+// on the property.
+func (p *Property) ValidateValue(value interface{}) error {
+	if len(p.Enum) > 0 {
+		found := false
+		for _, item := range p.Enum {
+			if v, err := p.NormalizeValue(item); err == nil && v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Value for property '%v' must be one of %v: %#v", p.Name, p.Enum, value)
+		}
+	}
+
+	var f float64
+	switch v := value.(type) {
+	case int64:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return nil
+	}
+	if p.Min != nil && f < *p.Min {
+		return fmt.Errorf("Value for property '%v' must be at least %v: %v", p.Name, *p.Min, value)
+	}
+	if p.Max != nil && f > *p.Max {
+		return fmt.Errorf("Value for property '%v' must be at most %v: %v", p.Name, *p.Max, value)
+	}
+	return nil
+}
+
+// Attempts to convert a value to the property's data type. Numeric strings
+// are converted to numbers and ISO 8601 timestamps are converted to Unix time
+// for numeric properties. Values that cannot be converted are returned as-is
+// so that validation can report them.
+func (p *Property) CoerceValue(value interface{}) interface{} {
+	switch v := normalize(value).(type) {
+	case string:
+		switch p.DataType {
+		case IntegerDataType:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i
+			} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return t.Unix()
+			}
+		case FloatDataType:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return float64(t.UnixNano()) / float64(time.Second)
+			}
+		case BooleanDataType:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		}
+	case int64:
+		switch p.DataType {
+		case FactorDataType, StringDataType:
+			return strconv.FormatInt(v, 10)
+		}
+	case float64:
+		switch p.DataType {
+		case FactorDataType, StringDataType:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	case bool:
+		switch p.DataType {
+		case FactorDataType, StringDataType:
+			return strconv.FormatBool(v)
+		}
+	}
+	return value
+}
+
+// Decodes the constraints on the property from an untyped map. Only the
+// constraints that exist in the map are changed and a nil value removes the
+// constraint.
+func (p *Property) DeserializeConstraints(obj map[string]interface{}) error {
+	// Deserialize "required".
+	if v, ok := obj["required"]; ok {
+		if required, ok := v.(bool); ok || v == nil {
+			p.Required = required
+		} else {
+			return fmt.Errorf("Invalid 'required': %v", v)
+		}
+	}
+
+	// Deserialize "enum".
+	if v, ok := obj["enum"]; ok {
+		if list, ok := v.([]interface{}); ok {
+			p.Enum = make([]interface{}, 0)
+			for _, item := range list {
+				value, err := p.NormalizeValue(item)
+				if err != nil {
+					return fmt.Errorf("Invalid 'enum' value: %v", err)
+				}
+				p.Enum = append(p.Enum, value)
+			}
+		} else if v == nil {
+			p.Enum = nil
+		} else {
+			return fmt.Errorf("Invalid 'enum': %v", v)
+		}
+	}
+
+	// Deserialize "min" and "max".
+	for _, key := range []string{"min", "max"} {
+		v, ok := obj[key]
+		if !ok {
+			continue
+		}
+		var limit *float64
+		if f, ok := v.(float64); ok {
+			if p.DataType != IntegerDataType && p.DataType != FloatDataType {
+				return fmt.Errorf("Invalid '%v': Ranges are only allowed on integer and float properties", key)
+			}
+			limit = &f
+		} else if v != nil {
+			return fmt.Errorf("Invalid '%v': %v", key, v)
+		}
+		if key == "min" {
+			p.Min = limit
+		} else {
+			p.Max = limit
+		}
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("Invalid range: %v..%v", *p.Min, *p.Max)
+	}
+
+	// Deserialize "default".
+	if v, ok := obj["default"]; ok {
+		if v == nil {
+			p.Default = nil
+		} else {
+			value, err := p.NormalizeValue(v)
+			if err != nil {
+				return fmt.Errorf("Invalid 'default': %v", err)
+			}
+			p.Default = value
+		}
+	}
+
+	// Make sure the default still satisfies the other constraints.
+	if p.Default != nil {
+		if err := p.ValidateValue(p.Default); err != nil {
+			return fmt.Errorf("Invalid 'default': %v", err)
+		}
+	}
+
+	return nil
+}
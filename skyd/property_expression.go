@@ -0,0 +1,294 @@
+package skyd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	expressionTokenIdentifier = iota
+	expressionTokenNumber
+	expressionTokenString
+	expressionTokenOperator
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A token read from a property expression.
+type expressionToken struct {
+	tokenType int
+	value     string
+	pos       int
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Lexing
+//--------------------------------------
+
+// Splits an expression into identifiers, numbers, strings and operators.
+func tokenizeExpression(expression string) ([]*expressionToken, error) {
+	operators := []string{"==", "!=", "<=", ">=", "&&", "||", "..", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", "!"}
+	tokens := make([]*expressionToken, 0)
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		ch := runes[i]
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+
+		case ch == '_' || unicode.IsLetter(ch):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, &expressionToken{expressionTokenIdentifier, string(runes[start:i]), start})
+
+		case unicode.IsDigit(ch):
+			start := i
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			// Only consume a decimal point if it is followed by a digit.
+			if i+1 < len(runes) && runes[i] == '.' && unicode.IsDigit(runes[i+1]) {
+				i++
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, &expressionToken{expressionTokenNumber, string(runes[start:i]), start})
+
+		case ch == '"' || ch == '\'':
+			start := i
+			value := new(bytes.Buffer)
+			for i++; i < len(runes) && runes[i] != ch; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("Unterminated string at position %d: %v", start, expression)
+			}
+			i++
+			tokens = append(tokens, &expressionToken{expressionTokenString, value.String(), start})
+
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, &expressionToken{expressionTokenOperator, op, i})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("Unexpected character at position %d: %q", i, ch)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Converts the expression on a computed property into a Lua expression that
+// reads from the event. String literals that are compared to factor
+// properties are factorized. Values that have never been seen are converted
+// to an identifier that cannot match any event.
+func codegenPropertyExpression(property *Property, propertyFile *PropertyFile, tableName string, factors *Factors) (string, error) {
+	tokens, err := tokenizeExpression(property.Expression)
+	if err != nil {
+		return "", fmt.Errorf("skyd.Property: Invalid expression for '%v': %v", property.Name, err)
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("skyd.Property: Expression required for '%v'", property.Name)
+	}
+
+	// Converts a string literal into Lua, factorizing it if needed.
+	literal := func(operand *Property, value string) (string, error) {
+		if operand == nil || operand.DataType != FactorDataType {
+			return luaQuote(value), nil
+		}
+		if factors == nil {
+			return "-1", nil
+		}
+		sequence, err := factors.Factorize(tableName, operand.Name, value, false)
+		if _, ok := err.(*FactorNotFound); ok {
+			return "-1", nil
+		} else if err != nil {
+			return "", err
+		}
+		return strconv.FormatUint(sequence, 10), nil
+	}
+
+	var operand *Property
+	var lastOperand string
+	output := make([]string, 0)
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch token.tokenType {
+		case expressionTokenIdentifier:
+			switch token.value {
+			case "and", "or", "not", "true", "false", "nil":
+				output = append(output, token.value)
+				operand, lastOperand = nil, ""
+
+			case "in":
+				// Rewrite "x in [a, b]" as "(x == a or x == b)".
+				if lastOperand == "" || len(output) == 0 || output[len(output)-1] != lastOperand {
+					return "", fmt.Errorf("skyd.Property: 'in' must follow a property name at position %d: %v", token.pos, property.Expression)
+				}
+				if i+1 >= len(tokens) || tokens[i+1].value != "[" {
+					return "", fmt.Errorf("skyd.Property: Expected '[' at position %d: %v", token.pos, property.Expression)
+				}
+				items := make([]string, 0)
+				for i += 2; i < len(tokens) && tokens[i].value != "]"; i++ {
+					item := tokens[i]
+					switch item.tokenType {
+					case expressionTokenString:
+						value, err := literal(operand, item.value)
+						if err != nil {
+							return "", err
+						}
+						items = append(items, fmt.Sprintf("%s == %s", lastOperand, value))
+					case expressionTokenNumber:
+						items = append(items, fmt.Sprintf("%s == %s", lastOperand, item.value))
+					case expressionTokenIdentifier:
+						if item.value != "true" && item.value != "false" {
+							return "", fmt.Errorf("skyd.Property: Invalid list value at position %d: %v", item.pos, property.Expression)
+						}
+						items = append(items, fmt.Sprintf("%s == %s", lastOperand, item.value))
+					default:
+						return "", fmt.Errorf("skyd.Property: Invalid list value at position %d: %v", item.pos, property.Expression)
+					}
+					if i+1 < len(tokens) && tokens[i+1].value == "," {
+						i++
+					}
+				}
+				if i >= len(tokens) || len(items) == 0 {
+					return "", fmt.Errorf("skyd.Property: Invalid list: %v", property.Expression)
+				}
+				output[len(output)-1] = "(" + strings.Join(items, " or ") + ")"
+				operand, lastOperand = nil, ""
+
+			default:
+				ref := propertyFile.GetPropertyByName(token.value)
+				if ref == nil {
+					return "", fmt.Errorf("skyd.Property: Property not found: %v", token.value)
+				}
+				lastOperand = fmt.Sprintf("event:%s()", ref.Name)
+				output = append(output, lastOperand)
+				operand = ref
+			}
+
+		case expressionTokenString:
+			value, err := literal(operand, token.value)
+			if err != nil {
+				return "", err
+			}
+			output = append(output, value)
+			operand, lastOperand = nil, ""
+
+		case expressionTokenNumber:
+			output = append(output, token.value)
+			operand, lastOperand = nil, ""
+
+		case expressionTokenOperator:
+			switch token.value {
+			case "==", "<", "<=", ">", ">=":
+				output = append(output, token.value)
+			case "!=":
+				output = append(output, "~=")
+			case "&&":
+				output = append(output, "and")
+				operand = nil
+			case "||":
+				output = append(output, "or")
+				operand = nil
+			case "!":
+				output = append(output, "not")
+				operand = nil
+			case "+", "-", "*", "/", "%", "(", ")":
+				output = append(output, token.value)
+				operand = nil
+			default:
+				return "", fmt.Errorf("skyd.Property: Unexpected '%v' at position %d: %v", token.value, token.pos, property.Expression)
+			}
+			lastOperand = ""
+		}
+	}
+
+	return strings.Join(output, " "), nil
+}
+
+// Returns a list of all properties that a computed property depends on,
+// including the dependencies of other computed properties.
+func computedPropertyReferences(property *Property, propertyFile *PropertyFile) ([]*Property, error) {
+	refs := make([]*Property, 0)
+	lookup := map[string]bool{}
+	var visit func(p *Property, path []string) error
+	visit = func(p *Property, path []string) error {
+		tokens, err := tokenizeExpression(p.Expression)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if token.tokenType != expressionTokenIdentifier {
+				continue
+			}
+			ref := propertyFile.GetPropertyByName(token.value)
+			if ref == nil {
+				continue
+			}
+			for _, name := range path {
+				if name == ref.Name {
+					return fmt.Errorf("skyd.Property: Circular reference: %v -> %v", strings.Join(path, " -> "), ref.Name)
+				}
+			}
+			if !lookup[ref.Name] {
+				lookup[ref.Name] = true
+				refs = append(refs, ref)
+			}
+			if ref.Expression != "" {
+				if err := visit(ref, append(path, ref.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := visit(property, []string{property.Name}); err != nil {
+		return nil, err
+	}
+	sort.Sort(PropertyList(refs))
+	return refs, nil
+}
+
+// Quotes a string as a Lua string literal.
+func luaQuote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\x00", `\000`)
+	return `"` + replacer.Replace(value) + `"`
+}
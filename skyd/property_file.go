@@ -8,8 +8,22 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+//------------------------------------------------------------------------------
+//
+// Globals
+//
+//------------------------------------------------------------------------------
+
+// The last schema version that was assigned to a property file. Versions
+// are shared by all property files so that a table that is deleted and
+// created again never reuses a version.
+var schemaVersion uint64
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -17,11 +31,49 @@ import (
 //------------------------------------------------------------------------------
 
 // A PropertyFile manages the serialization of Property objects for a table.
+// Properties are never changed in place once they are added. Updates replace
+// the property so readers can keep using the one they retrieved.
 type PropertyFile struct {
+	mutex            sync.RWMutex
 	opened           bool
 	path             string
 	properties       map[int64]*Property
 	propertiesByName map[string]*Property
+	version          uint64
+}
+
+//------------------------------------------------------------------------------
+//
+// Errors
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Validation Error
+//--------------------------------------
+
+// A ValidationError reports every problem found while validating a set of
+// values instead of just the first one.
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Errors, "; ")
+}
+
+// Adds a message to the list of errors.
+func (e *ValidationError) Add(err error) {
+	e.Errors = append(e.Errors, err.Error())
+}
+
+// Returns the error if any messages have been added. Otherwise returns nil.
+func (e *ValidationError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	sort.Strings(e.Errors)
+	return e
 }
 
 //------------------------------------------------------------------------------
@@ -58,6 +110,13 @@ func (p *PropertyFile) DbPath() string {
 	return ""
 }
 
+// Retrieves the schema version. A new version is assigned every time a
+// property is added, changed or removed. Versions are unique across all
+// property files in the process.
+func (p *PropertyFile) Version() uint64 {
+	return atomic.LoadUint64(&p.version)
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -70,32 +129,95 @@ func (p *PropertyFile) DbPath() string {
 
 // Adds a new property to the property file and generate an identifier for it.
 func (p *PropertyFile) CreateProperty(name string, transient bool, dataType string) (*Property, error) {
-	// Don't allow duplicate names.
-	if p.propertiesByName[name] != nil {
-		return nil, errors.New("Property already exists.")
+	property, err := NewProperty(0, name, transient, dataType)
+	if err != nil {
+		return nil, err
 	}
 
-	property, err := NewProperty(0, name, transient, dataType)
+	err = p.AddProperty(property)
 	if err != nil {
 		return nil, err
 	}
 
+	return property, nil
+}
+
+// Adds an existing property to the property file and generates an
+// identifier for it.
+func (p *PropertyFile) AddProperty(property *Property) error {
+	// Names are used as identifiers in generated code.
+	if !isValidIdentifier(property.Name) {
+		return fmt.Errorf("Invalid property name: %v", property.Name)
+	}
+
+	// Computed properties are never stored so they always use transient
+	// identifiers. Their expressions must compile and cannot be circular.
+	if property.IsComputed() {
+		if property.DataType == FactorDataType {
+			return errors.New("Computed properties cannot be factors.")
+		}
+		if _, err := codegenPropertyExpression(property, p, "", nil); err != nil {
+			return err
+		}
+		if _, err := computedPropertyReferences(property, p); err != nil {
+			return err
+		}
+		property.Transient = true
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Don't allow duplicate names.
+	if p.propertiesByName[property.Name] != nil {
+		return errors.New("Property already exists.")
+	}
+
 	// Find the next object/action identifier.
 	if property.Transient {
-		_, property.Id = p.NextIdentifiers()
+		_, property.Id = p.nextIdentifiers()
 	} else {
-		property.Id, _ = p.NextIdentifiers()
+		property.Id, _ = p.nextIdentifiers()
 	}
 
 	// Add to the list.
 	p.properties[property.Id] = property
 	p.propertiesByName[property.Name] = property
+	atomic.StoreUint64(&p.version, nextSchemaVersion())
 
-	return property, nil
+	return nil
+}
+
+// Replaces a property with an updated copy of it. The identifier cannot be
+// changed but the name can as long as it isn't used by another property.
+func (p *PropertyFile) UpdateProperty(property *Property, update *Property) error {
+	if !isValidIdentifier(update.Name) {
+		return fmt.Errorf("Invalid property name: %v", update.Name)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.properties[property.Id] != property {
+		return errors.New("Property does not exist.")
+	}
+	if other := p.propertiesByName[update.Name]; other != nil && other != property {
+		return errors.New("Property already exists.")
+	}
+
+	update.Id = property.Id
+	delete(p.propertiesByName, property.Name)
+	p.properties[update.Id] = update
+	p.propertiesByName[update.Name] = update
+	atomic.StoreUint64(&p.version, nextSchemaVersion())
+
+	return nil
 }
 
 // Retrieves a list of undeleted properties sorted by id.
 func (p *PropertyFile) GetProperties() []*Property {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	list := make([]*Property, 0)
 	for _, property := range p.propertiesByName {
 		list = append(list, property)
@@ -106,6 +228,8 @@ func (p *PropertyFile) GetProperties() []*Property {
 
 // Retrieves a list of all properties sorted by id.
 func (p *PropertyFile) GetAllProperties() []*Property {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	list := make([]*Property, 0)
 	for _, property := range p.properties {
 		list = append(list, property)
@@ -116,26 +240,41 @@ func (p *PropertyFile) GetAllProperties() []*Property {
 
 // Retrieves a single property by id.
 func (p *PropertyFile) GetProperty(id int64) *Property {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	return p.properties[id]
 }
 
 // Retrieves a single property by name.
 func (p *PropertyFile) GetPropertyByName(name string) *Property {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	return p.propertiesByName[name]
 }
 
 // Deletes a property.
 func (p *PropertyFile) DeleteProperty(property *Property) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	if property != nil && property.Name != "" {
 		delete(p.properties, property.Id)
 		delete(p.propertiesByName, property.Name)
+		atomic.StoreUint64(&p.version, nextSchemaVersion())
 	}
 }
 
 // Clears out the property file.
 func (p *PropertyFile) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reset()
+}
+
+// Clears out the property file without locking.
+func (p *PropertyFile) reset() {
 	p.properties = make(map[int64]*Property)
 	p.propertiesByName = make(map[string]*Property)
+	atomic.StoreUint64(&p.version, nextSchemaVersion())
 }
 
 //--------------------------------------
@@ -163,7 +302,9 @@ func (p *PropertyFile) Decode(reader io.Reader) error {
 	}
 
 	// Create lookups for the properties.
-	p.Reset()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reset()
 	for _, property := range list {
 		p.properties[property.Id] = property
 		if property.Name != "" {
@@ -222,8 +363,11 @@ func (p *PropertyFile) IsOpen() bool {
 // Persistence
 //--------------------------------------
 
-// Saves the property file to disk.
+// Saves the property file to disk. A new schema version is assigned here as
+// well.
 func (p *PropertyFile) Save() error {
+	atomic.StoreUint64(&p.version, nextSchemaVersion())
+
 	// Open the file for writing.
 	file, err := os.Create(p.path)
 	if err != nil {
@@ -248,21 +392,92 @@ func (p *PropertyFile) Save() error {
 // Normalization
 //--------------------------------------
 
-// Converts a map with string keys to use property identifier keys.
+// Converts a map with string keys to use property identifier keys. Values
+// are validated against the data type of their property.
 func (p *PropertyFile) NormalizeMap(m map[string]interface{}) (map[int64]interface{}, error) {
+	verr := &ValidationError{}
 	clone := make(map[int64]interface{})
 	for k, v := range m {
 		// Look up the property by name and convert it to the ID.
 		property := p.GetPropertyByName(string(k))
-		if property != nil {
-			clone[property.Id] = v
-		} else {
-			return nil, fmt.Errorf("Property not found: %v", k)
+		if property == nil {
+			verr.Add(fmt.Errorf("Property not found: %v", k))
+			continue
+		} else if property.IsComputed() {
+			verr.Add(fmt.Errorf("Property is computed: %v", k))
+			continue
 		}
+
+		value, err := property.NormalizeValue(v)
+		if err == nil {
+			err = property.ValidateValue(value)
+		}
+		if err != nil {
+			verr.Add(err)
+			continue
+		}
+		clone[property.Id] = value
+	}
+	if err := verr.Err(); err != nil {
+		return nil, err
 	}
 	return clone, nil
 }
 
+// Returns whether any property has a default value or is required. Objects
+// don't need to be read to apply constraints if there are none.
+func (p *PropertyFile) HasConstraints() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, property := range p.propertiesByName {
+		if (property.Default != nil || property.Required) && !property.IsComputed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Fills in default values and checks for required properties that are
+// missing from a normalized map. Permanent properties that already have a
+// value in the object's state are not considered missing.
+func (p *PropertyFile) ApplyConstraints(m map[int64]interface{}, state map[int64]interface{}) error {
+	verr := &ValidationError{}
+	for _, property := range p.GetProperties() {
+		if _, ok := m[property.Id]; ok || property.IsComputed() {
+			continue
+		}
+		if _, ok := state[property.Id]; ok && !property.Transient {
+			continue
+		}
+
+		if property.Default != nil {
+			value, err := property.NormalizeValue(property.Default)
+			if err != nil {
+				verr.Add(err)
+				continue
+			}
+			m[property.Id] = value
+		} else if property.Required {
+			verr.Add(fmt.Errorf("Property required: %v", property.Name))
+		}
+	}
+	return verr.Err()
+}
+
+// Converts the values in a map with string keys to the data types of their
+// properties where possible. Unknown keys are left alone.
+func (p *PropertyFile) CoerceMap(m map[string]interface{}) map[string]interface{} {
+	clone := make(map[string]interface{})
+	for k, v := range m {
+		if property := p.GetPropertyByName(k); property != nil {
+			clone[k] = property.CoerceValue(v)
+		} else {
+			clone[k] = v
+		}
+	}
+	return clone
+}
+
 // Converts a map with property identifier keys to use string keys.
 func (p *PropertyFile) DenormalizeMap(m map[int64]interface{}) (map[string]interface{}, error) {
 	clone := make(map[string]interface{})
@@ -295,8 +510,20 @@ func (p *PropertyFile) Factorize(property *Property, value interface{}) (interfa
 // Utilities
 //--------------------------------------
 
+// Generates a new process-wide schema version.
+func nextSchemaVersion() uint64 {
+	return atomic.AddUint64(&schemaVersion, 1)
+}
+
 // Finds the next available action and object property identifiers.
 func (p *PropertyFile) NextIdentifiers() (int64, int64) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.nextIdentifiers()
+}
+
+// Finds the next available identifiers without locking.
+func (p *PropertyFile) nextIdentifiers() (int64, int64) {
 	var nextPermanentId, nextTransientId int64 = 1, -1
 	for _, property := range p.properties {
 		if property.Transient && property.Id <= nextTransientId {
@@ -56,14 +56,61 @@ func TestPropertyFileNormalizeMap(t *testing.T) {
 	if ret[1] != "bob" {
 		t.Fatalf("ret[1]: Expected %q, got %q", "bob", ret[1])
 	}
-	if ret[2] != 100 {
+	if ret[2] != float64(100) {
 		t.Fatalf("ret[2]: Expected %q, got %q", 100, ret[2])
 	}
-	if ret[-1] != 12 {
+	if ret[-1] != int64(12) {
 		t.Fatalf("ret[-1]: Expected %q, got %q", 12, ret[-1])
 	}
 }
 
+// Ensure that values are validated against their property's data type.
+func TestPropertyFileNormalizeMapInvalidValues(t *testing.T) {
+	p := NewPropertyFile("")
+	p.CreateProperty("name", false, "string")
+	p.CreateProperty("state", false, "factor")
+	p.CreateProperty("purchaseAmount", true, "integer")
+	p.CreateProperty("isMember", true, "boolean")
+
+	m := map[string]interface{}{"name": "bob", "state": 12, "purchaseAmount": "12", "isMember": 1.5, "foo": "bar"}
+	_, err := p.NormalizeMap(m)
+	expected := `Invalid boolean value for property 'isMember': 1.5; Invalid factor value for property 'state': 12; Invalid integer value for property 'purchaseAmount': "12"; Property not found: foo`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Unexpected error:\nexp: %v\ngot: %v", expected, err)
+	}
+}
+
+// Ensure that values can be coerced into their property's data type.
+func TestPropertyFileCoerceMap(t *testing.T) {
+	p := NewPropertyFile("")
+	p.CreateProperty("state", false, "factor")
+	p.CreateProperty("salary", false, "float")
+	p.CreateProperty("purchaseAmount", true, "integer")
+	p.CreateProperty("purchasedAt", true, "integer")
+	p.CreateProperty("isMember", true, "boolean")
+
+	m := map[string]interface{}{"state": 12, "salary": "100.5", "purchaseAmount": "12", "purchasedAt": "1970-01-01T00:01:00Z", "isMember": "true"}
+	ret, err := p.NormalizeMap(p.CoerceMap(m))
+	if err != nil {
+		t.Fatalf("Unable to normalize map: %v", err)
+	}
+	if ret[1] != "12" {
+		t.Fatalf("ret[1]: Expected %v, got %v", "12", ret[1])
+	}
+	if ret[2] != float64(100.5) {
+		t.Fatalf("ret[2]: Expected %v, got %v", 100.5, ret[2])
+	}
+	if ret[-1] != int64(12) {
+		t.Fatalf("ret[-1]: Expected %v, got %v", 12, ret[-1])
+	}
+	if ret[-2] != int64(60) {
+		t.Fatalf("ret[-2]: Expected %v, got %v", 60, ret[-2])
+	}
+	if ret[-3] != true {
+		t.Fatalf("ret[-3]: Expected %v, got %v", true, ret[-3])
+	}
+}
+
 // Convert a map of string keys into property id keys.
 func TestPropertyFileDenormalizeMap(t *testing.T) {
 	p := NewPropertyFile("")
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"sort"
+	"time"
 )
 
 //------------------------------------------------------------------------------
@@ -18,8 +21,13 @@ type Query struct {
 	table           *Table
 	factors         *Factors
 	sequence        int
+	literals        []*queryFactorLiteral
 	Steps           QueryStepList
 	SessionIdleTime int
+	Start           time.Time
+	End             time.Time
+	Filter          string
+	Sample          float64
 }
 
 //------------------------------------------------------------------------------
@@ -34,6 +42,7 @@ func NewQuery(table *Table, factors *Factors) *Query {
 		table:   table,
 		factors: factors,
 		Steps:   make(QueryStepList, 0),
+		Sample:  1,
 	}
 }
 
@@ -53,6 +62,19 @@ func (q *Query) Factors() *Factors {
 	return q.factors
 }
 
+// Returns whether only a sample of objects is included in the query.
+func (q *Query) IsSampled() bool {
+	return q.Sample < 1
+}
+
+// Parses the object filter. Returns nil if the query has no filter.
+func (q *Query) ObjectFilter() (*QueryFilter, error) {
+	if q.Filter == "" {
+		return nil, nil
+	}
+	return NewQueryFilter(q, q.Filter)
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -69,6 +91,18 @@ func (q *Query) Serialize() map[string]interface{} {
 		"sessionIdleTime": q.SessionIdleTime,
 		"steps":           q.Steps.Serialize(),
 	}
+	if !q.Start.IsZero() {
+		obj["start"] = q.Start.UTC().Format(time.RFC3339)
+	}
+	if !q.End.IsZero() {
+		obj["end"] = q.End.UTC().Format(time.RFC3339)
+	}
+	if q.Filter != "" {
+		obj["filter"] = q.Filter
+	}
+	if q.IsSampled() {
+		obj["sample"] = q.Sample
+	}
 	return obj
 }
 
@@ -83,6 +117,33 @@ func (q *Query) Deserialize(obj map[string]interface{}) error {
 		return fmt.Errorf("Invalid 'sessionIdleTime': %v", obj["sessionIdleTime"])
 	}
 
+	// Deserialize "start" and "end".
+	if q.Start, err = deserializeQueryTime(obj["start"]); err != nil {
+		return fmt.Errorf("Invalid 'start': %v", obj["start"])
+	}
+	if q.End, err = deserializeQueryTime(obj["end"]); err != nil {
+		return fmt.Errorf("Invalid 'end': %v", obj["end"])
+	}
+	if !q.Start.IsZero() && !q.End.IsZero() && !q.Start.Before(q.End) {
+		return fmt.Errorf("Invalid range: %v..%v", obj["start"], obj["end"])
+	}
+
+	// Deserialize "filter".
+	if filter, ok := obj["filter"].(string); ok || obj["filter"] == nil {
+		q.Filter = filter
+	} else {
+		return fmt.Errorf("Invalid 'filter': %v", obj["filter"])
+	}
+
+	// Deserialize "sample".
+	if sample, ok := obj["sample"].(float64); ok && sample > 0 && sample <= 1 {
+		q.Sample = sample
+	} else if obj["sample"] == nil {
+		q.Sample = 1
+	} else {
+		return fmt.Errorf("Invalid 'sample': %v", obj["sample"])
+	}
+
 	q.Steps, err = DeserializeQueryStepList(obj["steps"], q)
 	if err != nil {
 		return err
@@ -115,6 +176,71 @@ func (q *Query) Decode(reader io.Reader) error {
 	return q.Deserialize(obj)
 }
 
+// Parses an optional RFC3339 time. A nil value returns the zero time.
+func deserializeQueryTime(value interface{}) (time.Time, error) {
+	if value == nil {
+		return time.Time{}, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("skyd.Query: Invalid time: %v", value)
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+//--------------------------------------
+// Formatting
+//--------------------------------------
+
+// Retrieves the column names used by the rows of every selection. Sampled
+// queries end with a "sampleRate" column.
+func (q *Query) Columns() []string {
+	columns := []string{}
+	lookup := make(map[string]bool)
+	for _, selection := range q.Steps.Selections() {
+		for _, column := range selection.Columns() {
+			if !lookup[column] {
+				columns = append(columns, column)
+				lookup[column] = true
+			}
+		}
+	}
+	if q.IsSampled() {
+		columns = append(columns, "sampleRate")
+	}
+	return columns
+}
+
+// Flattens the results of every selection into a list of rows.
+func (q *Query) Rows(data interface{}) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0)
+	for _, selection := range q.Steps.Selections() {
+		rows = append(rows, selection.Rows(data)...)
+	}
+	if q.IsSampled() {
+		for _, row := range rows {
+			row["sampleRate"] = q.Sample
+		}
+	}
+	return rows
+}
+
+//--------------------------------------
+// Sampling
+//--------------------------------------
+
+// Scales a count or sum from a sampled query to estimate the value for all
+// objects. Integers are rounded to the nearest whole number.
+func (q *Query) ScaleSampledValue(value interface{}) interface{} {
+	switch v := normalize(value).(type) {
+	case int64:
+		return int64(math.Floor(float64(v)/q.Sample + 0.5))
+	case float64:
+		return v / q.Sample
+	}
+	return value
+}
+
 //--------------------------------------
 // Code Generation
 //--------------------------------------
@@ -129,6 +255,7 @@ func (q *Query) Codegen() (string, error) {
 		return "", err
 	}
 	buffer.WriteString(str)
+	buffer.WriteString(q.CodegenSessionFunction())
 	buffer.WriteString(q.CodegenAggregateFunction())
 
 	// Generate merge functions.
@@ -139,6 +266,46 @@ func (q *Query) Codegen() (string, error) {
 	buffer.WriteString(str)
 	buffer.WriteString(q.CodegenMergeFunction())
 
+	// Prepend accessors for any computed properties that are referenced.
+	accessors, err := q.CodegenComputedProperties(buffer.String())
+	if err != nil {
+		return "", err
+	}
+
+	return accessors + buffer.String(), nil
+}
+
+// Generates event accessors for the computed properties referenced in a
+// source string. Properties referenced by other computed properties are
+// generated as well.
+func (q *Query) CodegenComputedProperties(source string) (string, error) {
+	if q.table == nil {
+		return "", nil
+	}
+	propertyFile := q.table.propertyFile
+
+	// Find all computed properties that are referenced, including the ones
+	// that other computed properties depend on.
+	properties, err := extractPropertyReferences(propertyFile, source)
+	if err != nil {
+		return "", err
+	}
+
+	buffer := new(bytes.Buffer)
+	for _, property := range properties {
+		if !property.IsComputed() {
+			continue
+		}
+		expression, err := codegenPropertyExpression(property, propertyFile, q.table.Name, q.factors)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buffer, "sky_event_index.%s = function(event) return %s end\n", property.Name, expression)
+	}
+	if buffer.Len() > 0 {
+		fmt.Fprintln(buffer, "")
+	}
+
 	return buffer.String(), nil
 }
 
@@ -154,8 +321,21 @@ func (q *Query) CodegenAggregateFunction() string {
 		fmt.Fprintf(buffer, "  cursor:set_session_idle(%d)\n", q.SessionIdleTime)
 	}
 
+	// Notify object steps that a new object is starting.
+	objectSteps := q.Steps.ObjectSteps()
+	for _, step := range objectSteps {
+		fmt.Fprintf(buffer, "  %s(cursor, data)\n", step.ObjectBeginFunctionName())
+	}
+
 	// Begin cursor loop.
+	sessionSteps := q.Steps.SessionSteps()
 	fmt.Fprintln(buffer, "  while cursor:next_session() do")
+	if len(sessionSteps) > 0 {
+		fmt.Fprintln(buffer, "    sky_session = {events = 0, first_values = {}, last_values = {}}")
+	}
+	for _, step := range sessionSteps {
+		fmt.Fprintf(buffer, "    %s(cursor, data)\n", step.SessionBeginFunctionName())
+	}
 	fmt.Fprintln(buffer, "    while cursor:next() do")
 
 	// Call each step function.
@@ -165,14 +345,63 @@ func (q *Query) CodegenAggregateFunction() string {
 
 	// End cursor loop.
 	fmt.Fprintln(buffer, "    end")
+	for _, step := range sessionSteps {
+		fmt.Fprintf(buffer, "    %s(cursor, data)\n", step.SessionEndFunctionName())
+	}
 	fmt.Fprintln(buffer, "  end")
 
+	// Notify object steps that the object is finished.
+	for _, step := range objectSteps {
+		fmt.Fprintf(buffer, "  %s(cursor, data)\n", step.ObjectEndFunctionName())
+	}
+
 	// End function.
 	fmt.Fprintln(buffer, "end\n")
 
 	return buffer.String()
 }
 
+// Generates the 'sky_session_next()' function which tracks the timestamps,
+// event count and property values of the current session. The cursor calls
+// it for every event when it is defined.
+func (q *Query) CodegenSessionFunction() string {
+	sessionSteps := q.Steps.SessionSteps()
+	if len(sessionSteps) == 0 {
+		return ""
+	}
+
+	// Find the properties that need to be tracked.
+	properties := make([]string, 0)
+	lookup := map[string]bool{}
+	for _, step := range sessionSteps {
+		for _, property := range step.SessionProperties() {
+			if !lookup[property] {
+				properties = append(properties, property)
+				lookup[property] = true
+			}
+		}
+	}
+	sort.Strings(properties)
+
+	buffer := new(bytes.Buffer)
+	fmt.Fprintln(buffer, "function sky_session_next(cursor)")
+	fmt.Fprintln(buffer, "  local timestamp = tonumber(cursor.event.timestamp)")
+	fmt.Fprintln(buffer, "  if sky_session.first == nil then")
+	fmt.Fprintln(buffer, "    sky_session.first = timestamp")
+	for _, property := range properties {
+		fmt.Fprintf(buffer, "    sky_session.first_values.%s = cursor.event:%s()\n", property, property)
+	}
+	fmt.Fprintln(buffer, "  end")
+	fmt.Fprintln(buffer, "  sky_session.last = timestamp")
+	fmt.Fprintln(buffer, "  sky_session.events = sky_session.events + 1")
+	for _, property := range properties {
+		fmt.Fprintf(buffer, "  sky_session.last_values.%s = cursor.event:%s()\n", property, property)
+	}
+	fmt.Fprintln(buffer, "end\n")
+
+	return buffer.String()
+}
+
 // Generates the 'merge()' function.
 func (q *Query) CodegenMergeFunction() string {
 	buffer := new(bytes.Buffer)
@@ -204,3 +433,22 @@ func (q *Query) NextIdentifier() int {
 func (q *Query) Defactorize(data interface{}) error {
 	return q.Steps.Defactorize(data)
 }
+
+// Converts a string literal for a factor property into its identifier. Each
+// literal is recorded so that it can be reported in the query plan.
+func (q *Query) factorize(property *Property, value string) (uint64, error) {
+	sequence, err := q.factors.Factorize(q.table.Name, property.Name, value, false)
+	if _, ok := err.(*FactorNotFound); ok || err == nil {
+		q.literals = append(q.literals, &queryFactorLiteral{property: property.Name, value: value, id: sequence, found: (err == nil)})
+	}
+	return sequence, err
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Reshapes the merged results into their final form.
+func (q *Query) Finalize(data interface{}) error {
+	return q.Steps.Finalize(data)
+}
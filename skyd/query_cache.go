@@ -0,0 +1,144 @@
+package skyd
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of query results cached by default.
+const DefaultQueryCacheSize = 100
+
+// How long query results are cached by default.
+const DefaultQueryCacheTTL = 5 * time.Minute
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A QueryCache is a bounded cache of finalized query results. Keys include
+// the table's data version so results are never returned after the table
+// has been written to. The least recently used entries are evicted first and
+// entries expire once they are older than the TTL.
+type QueryCache struct {
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+	Size    int
+	TTL     time.Duration
+}
+
+// A single cached result.
+type queryCacheEntry struct {
+	key       string
+	tableName string
+	value     interface{}
+	expires   time.Time
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// NewQueryCache returns a new cache that holds up to size results for a
+// given duration.
+func NewQueryCache(size int, ttl time.Duration) *QueryCache {
+	return &QueryCache{
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		Size:    size,
+		TTL:     ttl,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Retrieves a cached result. Expired results are removed.
+func (c *QueryCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem := c.entries[key]; elem != nil {
+		entry := elem.Value.(*queryCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.value, true
+		}
+		c.removeElement(elem)
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+// Adds a result to the cache, evicting old entries if necessary. Cached
+// results are shared between requests so they must not be modified.
+func (c *QueryCache) Put(tableName string, key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.Size <= 0 {
+		return
+	}
+	if elem := c.entries[key]; elem != nil {
+		c.removeElement(elem)
+	}
+
+	entry := &queryCacheEntry{key: key, tableName: tableName, value: value, expires: time.Now().Add(c.TTL)}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.Size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Removes all cached results for a table.
+func (c *QueryCache) PurgeTable(tableName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, elem := range c.entries {
+		if elem.Value.(*queryCacheEntry).tableName == tableName {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// Removes all cached results.
+func (c *QueryCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Removes an entry from the list and the lookup.
+func (c *QueryCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*queryCacheEntry).key)
+}
+
+// Retrieves statistics about the query cache.
+func (c *QueryCache) Stats() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return map[string]interface{}{
+		"hits":   atomic.LoadUint64(&c.hits),
+		"misses": atomic.LoadUint64(&c.misses),
+		"size":   c.lru.Len(),
+	}
+}
@@ -0,0 +1,349 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	DefaultCohortPeriod  = 7 * 24 * 60 * 60
+	DefaultCohortPeriods = 12
+)
+
+// Periods are aligned to Monday, January 5th, 1970 UTC when there is no
+// anchor or query start time so that weeks begin on Mondays.
+const DefaultCohortAnchor = 4 * 24 * 60 * 60
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A cohort step groups objects by the period of their first matching event
+// and counts how many objects return in each following period. Periods begin
+// at the anchor time, the query start time or DefaultCohortAnchor, in that
+// order of preference.
+type QueryCohort struct {
+	query             *Query
+	functionName      string
+	mergeFunctionName string
+	Name              string
+	Expression        string
+	ReturnExpression  string
+	Period            int
+	Periods           int
+	Anchor            time.Time
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new cohort.
+func NewQueryCohort(query *Query) *QueryCohort {
+	id := query.NextIdentifier()
+	return &QueryCohort{
+		query:             query,
+		functionName:      fmt.Sprintf("a%d", id),
+		mergeFunctionName: fmt.Sprintf("m%d", id),
+		Name:              "cohort",
+		ReturnExpression:  "true",
+		Period:            DefaultCohortPeriod,
+		Periods:           DefaultCohortPeriods,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this cohort is associated with.
+func (c *QueryCohort) Query() *Query {
+	return c.query
+}
+
+// Retrieves the function name used during codegen.
+func (c *QueryCohort) FunctionName() string {
+	return c.functionName
+}
+
+// Retrieves the merge function name used during codegen.
+func (c *QueryCohort) MergeFunctionName() string {
+	return c.mergeFunctionName
+}
+
+// Retrieves the function name called before each object.
+func (c *QueryCohort) ObjectBeginFunctionName() string {
+	return c.functionName + "_begin"
+}
+
+// Retrieves the function name called after each object.
+func (c *QueryCohort) ObjectEndFunctionName() string {
+	return c.functionName + "_end"
+}
+
+// Retrieves the Unix time that periods are aligned to.
+func (c *QueryCohort) AnchorTime() int64 {
+	if !c.Anchor.IsZero() {
+		return c.Anchor.Unix()
+	} else if c.query != nil && !c.query.Start.IsZero() {
+		return c.query.Start.Unix()
+	}
+	return DefaultCohortAnchor
+}
+
+// Retrieves the child steps.
+func (c *QueryCohort) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a cohort into an untyped map.
+func (c *QueryCohort) Serialize() map[string]interface{} {
+	obj := map[string]interface{}{
+		"type":             QueryStepTypeCohort,
+		"name":             c.Name,
+		"expression":       c.Expression,
+		"returnExpression": c.ReturnExpression,
+		"period":           c.Period,
+		"periods":          c.Periods,
+	}
+	if !c.Anchor.IsZero() {
+		obj["anchor"] = c.Anchor.UTC().Format(time.RFC3339)
+	}
+	return obj
+}
+
+// Decodes a cohort from an untyped map.
+func (c *QueryCohort) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryCohort: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypeCohort {
+		return fmt.Errorf("skyd.QueryCohort: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && isValidIdentifier(name) {
+		c.Name = name
+	} else if obj["name"] != nil {
+		return fmt.Errorf("skyd.QueryCohort: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "expression".
+	if expression, ok := obj["expression"].(string); ok && expression != "" {
+		c.Expression = expression
+	} else {
+		return fmt.Errorf("skyd.QueryCohort: Invalid expression: %v", obj["expression"])
+	}
+
+	// Deserialize "return expression".
+	if expression, ok := obj["returnExpression"].(string); ok && expression != "" {
+		c.ReturnExpression = expression
+	} else if obj["returnExpression"] != nil {
+		return fmt.Errorf("skyd.QueryCohort: Invalid return expression: %v", obj["returnExpression"])
+	}
+
+	// Deserialize "period".
+	if period, ok := obj["period"].(float64); ok && period >= 1 {
+		c.Period = int(period)
+	} else if obj["period"] != nil {
+		return fmt.Errorf("skyd.QueryCohort: Invalid period: %v", obj["period"])
+	}
+
+	// Deserialize "periods".
+	if periods, ok := obj["periods"].(float64); ok && periods >= 1 {
+		c.Periods = int(periods)
+	} else if obj["periods"] != nil {
+		return fmt.Errorf("skyd.QueryCohort: Invalid periods: %v", obj["periods"])
+	}
+
+	// Deserialize "anchor".
+	if str, ok := obj["anchor"].(string); ok {
+		anchor, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return fmt.Errorf("skyd.QueryCohort: Invalid anchor: %v", obj["anchor"])
+		}
+		c.Anchor = anchor
+	} else if obj["anchor"] != nil {
+		return fmt.Errorf("skyd.QueryCohort: Invalid anchor: %v", obj["anchor"])
+	}
+
+	return nil
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code for the cohort aggregation. The cohort start and the
+// periods the object returned in are tracked while iterating over the events
+// and are added to the results once the object is finished. Lua's modulo is
+// floored so events before the anchor are aligned correctly as well.
+func (c *QueryCohort) CodegenAggregateFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	expression, err := c.codegenExpression(c.Expression)
+	if err != nil {
+		return "", err
+	}
+	returnExpression, err := c.codegenExpression(c.ReturnExpression)
+	if err != nil {
+		return "", err
+	}
+	start := c.functionName + "_start"
+	returns := c.functionName + "_returns"
+
+	// Reset the object state.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.ObjectBeginFunctionName())
+	fmt.Fprintf(buffer, "  %s = nil\n", start)
+	fmt.Fprintf(buffer, "  %s = {}\n", returns)
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	// Find the cohort and then mark each period the object returns in.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.FunctionName())
+	fmt.Fprintf(buffer, "  local timestamp = tonumber(cursor.event.timestamp)\n")
+	fmt.Fprintf(buffer, "  if %s == nil then\n", start)
+	fmt.Fprintf(buffer, "    if %s then\n", expression)
+	fmt.Fprintf(buffer, "      %s = timestamp - ((timestamp - %d) %% %d)\n", start, c.AnchorTime(), c.Period)
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "  elseif %s then\n", returnExpression)
+	fmt.Fprintf(buffer, "    local period = math.floor((timestamp - %s) / %d)\n", start, c.Period)
+	fmt.Fprintf(buffer, "    if period < %d then %s[tostring(period)] = true end\n", c.Periods, returns)
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	// Add the object to its cohort.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.ObjectEndFunctionName())
+	fmt.Fprintf(buffer, "  if %s == nil then return end\n", start)
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then data[\"%s\"] = {} end\n", c.Name, c.Name)
+	fmt.Fprintf(buffer, "  data = data[\"%s\"]\n", c.Name)
+	fmt.Fprintf(buffer, "  if data[%s] == nil then data[%s] = {objects = 0, periods = {}} end\n", start, start)
+	fmt.Fprintf(buffer, "  data = data[%s]\n", start)
+	fmt.Fprintf(buffer, "  data.objects = data.objects + 1\n")
+	fmt.Fprintf(buffer, "  for period,_ in pairs(%s) do\n", returns)
+	fmt.Fprintf(buffer, "    data.periods[period] = (data.periods[period] or 0) + 1\n")
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code for the cohort merge.
+func (c *QueryCohort) CodegenMergeFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "function %s(result, data)\n", c.MergeFunctionName())
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then return end\n", c.Name)
+	fmt.Fprintf(buffer, "  if result[\"%s\"] == nil then result[\"%s\"] = {} end\n", c.Name, c.Name)
+	fmt.Fprintf(buffer, "  result = result[\"%s\"]\n", c.Name)
+	fmt.Fprintf(buffer, "  for cohort,v in pairs(data[\"%s\"]) do\n", c.Name)
+	fmt.Fprintf(buffer, "    if result[cohort] == nil then result[cohort] = {objects = 0, periods = {}} end\n")
+	fmt.Fprintf(buffer, "    result[cohort].objects = result[cohort].objects + v.objects\n")
+	fmt.Fprintf(buffer, "    for period,count in pairs(v.periods) do\n")
+	fmt.Fprintf(buffer, "      result[cohort].periods[period] = (result[cohort].periods[period] or 0) + count\n")
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintln(buffer, "end")
+	return buffer.String(), nil
+}
+
+// Generates the Lua code for a condition expression.
+func (c *QueryCohort) codegenExpression(expression string) (string, error) {
+	condition := NewQueryCondition(c.query)
+	condition.Expression = expression
+	return condition.CodegenExpression()
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Cohorts do not group by any factorized values.
+func (c *QueryCohort) Defactorize(data interface{}) error {
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts each cohort into a list of periods with counts and retention
+// rates. Cohorts are keyed by the start of their period.
+func (c *QueryCohort) Finalize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	cohorts, ok := m[c.Name].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	output := make(map[interface{}]interface{})
+	for k, v := range cohorts {
+		start, ok := normalize(k).(int64)
+		if !ok {
+			return fmt.Errorf("skyd.QueryCohort: Invalid cohort: %v", k)
+		}
+		cohort, _ := v.(map[interface{}]interface{})
+		objects := toInt64(cohort["objects"])
+
+		// Periods are keyed by strings so they are always encoded as a map.
+		counts := make([]int64, c.Periods)
+		if periods, ok := cohort["periods"].(map[interface{}]interface{}); ok {
+			for pk, pv := range periods {
+				index, err := strconv.Atoi(fmt.Sprintf("%v", pk))
+				if err == nil && index >= 0 && index < c.Periods {
+					counts[index] = toInt64(pv)
+				}
+			}
+		}
+
+		// Rates are calculated before counts are scaled for a sample.
+		periods := make([]interface{}, 0, c.Periods)
+		for _, count := range counts {
+			rate := 0.0
+			if objects > 0 {
+				rate = float64(count) / float64(objects)
+			}
+			if c.query.IsSampled() {
+				count = toInt64(c.query.ScaleSampledValue(count))
+			}
+			periods = append(periods, map[string]interface{}{"count": count, "rate": rate})
+		}
+		if c.query.IsSampled() {
+			objects = toInt64(c.query.ScaleSampledValue(objects))
+		}
+
+		key := time.Unix(start, 0).UTC().Format(time.RFC3339)
+		output[key] = map[string]interface{}{"objects": objects, "periods": periods}
+	}
+	m[c.Name] = output
+
+	return nil
+}
@@ -26,7 +26,8 @@ const (
 //
 //------------------------------------------------------------------------------
 
-// A condition step made within a query.
+// A condition step made within a query. Absent conditions match when no
+// event within the range matches the expression.
 type QueryCondition struct {
 	query            *Query
 	functionName     string
@@ -34,6 +35,7 @@ type QueryCondition struct {
 	WithinRangeStart int
 	WithinRangeEnd   int
 	WithinUnits      string
+	Absent           bool
 	Steps            QueryStepList
 }
 
@@ -93,13 +95,17 @@ func (c *QueryCondition) GetSteps() QueryStepList {
 
 // Encodes a query condition into an untyped map.
 func (c *QueryCondition) Serialize() map[string]interface{} {
-	return map[string]interface{}{
+	obj := map[string]interface{}{
 		"type":        QueryStepTypeCondition,
 		"expression":  c.Expression,
 		"within":      []int{c.WithinRangeStart, c.WithinRangeEnd},
 		"withinUnits": c.WithinUnits,
 		"steps":       c.Steps.Serialize(),
 	}
+	if c.Absent {
+		obj["absent"] = true
+	}
+	return obj
 }
 
 // Decodes a query condition from an untyped map.
@@ -159,6 +165,13 @@ func (c *QueryCondition) Deserialize(obj map[string]interface{}) error {
 		}
 	}
 
+	// Deserialize "absent".
+	if absent, ok := obj["absent"].(bool); ok {
+		c.Absent = absent
+	} else if obj["absent"] != nil {
+		return fmt.Errorf("skyd.QueryCondition: Invalid 'absent': %v", obj["absent"])
+	}
+
 	// Deserialize steps.
 	var err error
 	c.Steps, err = DeserializeQueryStepList(obj["steps"], c.query)
@@ -189,6 +202,16 @@ func (c *QueryCondition) CodegenAggregateFunction() (string, error) {
 	}
 	buffer.WriteString(str)
 
+	// Absent conditions scan the whole range before calling their steps.
+	if c.Absent {
+		str, err := c.codegenAbsentFunction()
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString(str)
+		return buffer.String(), nil
+	}
+
 	// Generate main function.
 	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.FunctionName())
 	if c.WithinRangeStart > 0 {
@@ -230,6 +253,64 @@ func (c *QueryCondition) CodegenAggregateFunction() (string, error) {
 	return buffer.String(), nil
 }
 
+// Generates the main function for an absent condition. The cursor reads
+// ahead through each event in the range and the condition fails as soon as
+// one matches. The cursor is then moved back so that the steps are called
+// from the current event and the events in the range are left for the steps
+// that follow.
+func (c *QueryCondition) codegenAbsentFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	expressionCode, err := c.CodegenExpression()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.FunctionName())
+	fmt.Fprintf(buffer, "  local matched = false\n")
+	fmt.Fprintf(buffer, "  cursor:mark()\n")
+	switch c.WithinUnits {
+	case QueryConditionUnitSteps:
+		fmt.Fprintf(buffer, "  local index = 0\n")
+		fmt.Fprintf(buffer, "  repeat\n")
+		fmt.Fprintf(buffer, "    if index >= %d and %s then matched = true break end\n", c.WithinRangeStart, expressionCode)
+		fmt.Fprintf(buffer, "    if index >= %d then break end\n", c.WithinRangeEnd)
+		fmt.Fprintf(buffer, "    index = index + 1\n")
+		fmt.Fprintf(buffer, "  until not cursor:next_event()\n")
+
+	case QueryConditionUnitSeconds:
+		fmt.Fprintf(buffer, "  local start = tonumber(cursor.event.timestamp)\n")
+		fmt.Fprintf(buffer, "  repeat\n")
+		fmt.Fprintf(buffer, "    local elapsed = tonumber(cursor.event.timestamp) - start\n")
+		fmt.Fprintf(buffer, "    if elapsed > %d then break end\n", c.WithinRangeEnd)
+		fmt.Fprintf(buffer, "    if elapsed >= %d and %s then matched = true break end\n", c.WithinRangeStart, expressionCode)
+		fmt.Fprintf(buffer, "  until not cursor:next_event()\n")
+
+	case QueryConditionUnitSessions:
+		// The current session is zero. The cursor stops at the end of each
+		// session so it is moved into the next one until the range ends.
+		fmt.Fprintf(buffer, "  local session = 0\n")
+		fmt.Fprintf(buffer, "  while true do\n")
+		fmt.Fprintf(buffer, "    if session >= %d and %s then matched = true break end\n", c.WithinRangeStart, expressionCode)
+		fmt.Fprintf(buffer, "    if not cursor:next_event() then\n")
+		fmt.Fprintf(buffer, "      session = session + 1\n")
+		fmt.Fprintf(buffer, "      if session > %d or not cursor:next_session() or not cursor:next_event() then break end\n", c.WithinRangeEnd)
+		fmt.Fprintf(buffer, "    end\n")
+		fmt.Fprintf(buffer, "  end\n")
+	}
+	fmt.Fprintf(buffer, "  cursor:restore()\n")
+	fmt.Fprintf(buffer, "  if matched then return false end\n")
+
+	// Call each step function.
+	for _, step := range c.Steps {
+		fmt.Fprintf(buffer, "  %s(cursor, data)\n", step.FunctionName())
+	}
+	fmt.Fprintf(buffer, "  return true\n")
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
 // Generates Lua code for the query.
 func (c *QueryCondition) CodegenMergeFunction() (string, error) {
 	buffer := new(bytes.Buffer)
@@ -252,7 +333,7 @@ func (c *QueryCondition) CodegenExpression() (string, error) {
 	}
 
 	// Full expressions should be prepended with cursor's event reference.
-	r, _ := regexp.Compile(`^ *(\w+) *(==) *(?:"([^"]*)"|'([^']*)'|(\d+(?:\.\d+)?)|(true|false)) *$`)
+	r, _ := regexp.Compile(`^ *(\w+) *(==) *(?:` + stringLiteralPattern + `|(\d+(?:\.\d+)?)|(true|false)) *$`)
 	m := r.FindSubmatch([]byte(c.Expression))
 	if m == nil {
 		return "", fmt.Errorf("skyd.QueryCondition: Invalid expression: %v", c.Expression)
@@ -271,23 +352,23 @@ func (c *QueryCondition) CodegenExpression() (string, error) {
 		// Validate string value.
 		var stringValue string
 		if m[3] != nil {
-			stringValue = string(m[3])
+			stringValue = unescapeStringLiteral(string(m[3]))
 		} else if m[4] != nil {
-			stringValue = string(m[4])
+			stringValue = unescapeStringLiteral(string(m[4]))
 		} else {
 			return "", fmt.Errorf("skyd.QueryCondition: Expression value must be a string literal for string and factor properties: %v", c.Expression)
 		}
 
 		// Convert factors.
 		if property.DataType == FactorDataType {
-			sequence, err := c.query.factors.Factorize(c.query.table.Name, property.Name, stringValue, false)
+			sequence, err := c.query.factorize(property, stringValue)
 			if err != nil {
 				return "", err
 			} else {
 				value = strconv.FormatUint(sequence, 10)
 			}
 		} else {
-			value = fmt.Sprintf(`"%s"`, stringValue)
+			value = luaQuote(stringValue)
 		}
 
 	case IntegerDataType, FloatDataType:
@@ -314,3 +395,12 @@ func (c *QueryCondition) CodegenExpression() (string, error) {
 func (c *QueryCondition) Defactorize(data interface{}) error {
 	return c.Steps.Defactorize(data)
 }
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Finalizes the results of the child steps.
+func (c *QueryCondition) Finalize(data interface{}) error {
+	return c.Steps.Finalize(data)
+}
@@ -0,0 +1,189 @@
+package skyd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A query filter is used to skip objects based on the current value of their
+// permanent properties. Each clause must match for an object to be included.
+type QueryFilter struct {
+	clauses []*queryFilterClause
+}
+
+// A single comparison of a property against a value.
+type queryFilterClause struct {
+	property *Property
+	operator string
+	value    interface{}
+	missing  bool
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Parses a filter expression. Clauses are comparisons of a permanent property
+// against a literal and are joined with "&&".
+func NewQueryFilter(query *Query, expression string) (*QueryFilter, error) {
+	r, _ := regexp.Compile(`^ *(\w+) *(==|!=|<=|>=|<|>) *(?:` + stringLiteralPattern + `|(-?\d+(?:\.\d+)?)|(true|false)) *$`)
+
+	filter := &QueryFilter{}
+	for _, str := range splitExpression(expression, "&&") {
+		m := r.FindSubmatch([]byte(str))
+		if m == nil {
+			return nil, fmt.Errorf("skyd.QueryFilter: Invalid expression: %v", expression)
+		}
+
+		// Find the property.
+		property := query.table.propertyFile.GetPropertyByName(string(m[1]))
+		if property == nil {
+			return nil, fmt.Errorf("skyd.QueryFilter: Property not found: %s", m[1])
+		} else if property.Transient || property.IsComputed() {
+			return nil, fmt.Errorf("skyd.QueryFilter: Property must be permanent: %s", m[1])
+		}
+		clause := &queryFilterClause{property: property, operator: string(m[2])}
+
+		// Convert the value to the type stored in the object state.
+		switch property.DataType {
+		case FactorDataType, StringDataType:
+			var stringValue string
+			if m[3] != nil {
+				stringValue = unescapeStringLiteral(string(m[3]))
+			} else if m[4] != nil {
+				stringValue = unescapeStringLiteral(string(m[4]))
+			} else {
+				return nil, fmt.Errorf("skyd.QueryFilter: Value must be a string literal for string and factor properties: %v", str)
+			}
+
+			if property.DataType == FactorDataType {
+				if clause.operator != "==" && clause.operator != "!=" {
+					return nil, fmt.Errorf("skyd.QueryFilter: Factor properties can only be compared with == or !=: %v", str)
+				}
+				sequence, err := query.factorize(property, stringValue)
+				if _, ok := err.(*FactorNotFound); ok {
+					clause.missing = true
+				} else if err != nil {
+					return nil, err
+				}
+				clause.value = int64(sequence)
+			} else {
+				clause.value = stringValue
+			}
+
+		case IntegerDataType, FloatDataType:
+			if m[5] == nil {
+				return nil, fmt.Errorf("skyd.QueryFilter: Value must be a numeric literal for integer and float properties: %v", str)
+			}
+			clause.value, _ = strconv.ParseFloat(string(m[5]), 64)
+
+		case BooleanDataType:
+			if m[6] == nil {
+				return nil, fmt.Errorf("skyd.QueryFilter: Value must be a boolean literal for boolean properties: %v", str)
+			} else if clause.operator != "==" && clause.operator != "!=" {
+				return nil, fmt.Errorf("skyd.QueryFilter: Boolean properties can only be compared with == or !=: %v", str)
+			}
+			clause.value = (string(m[6]) == "true")
+		}
+
+		filter.clauses = append(filter.clauses, clause)
+	}
+
+	return filter, nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Checks if an object's state matches every clause of the filter.
+func (f *QueryFilter) Match(state *Event) bool {
+	for _, clause := range f.clauses {
+		if !clause.match(state) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if an object's state matches a single clause. Properties that are
+// not set on the state are compared using their zero value.
+func (c *queryFilterClause) match(state *Event) bool {
+	// Factors that don't exist are never equal to anything.
+	if c.missing {
+		return c.operator == "!="
+	}
+
+	var value interface{}
+	if state != nil {
+		value = normalize(state.Data[c.property.Id])
+	}
+
+	var cmp int
+	switch expected := c.value.(type) {
+	case int64:
+		actual := toInt64(value)
+		cmp = compareFloat64(float64(actual), float64(expected))
+	case float64:
+		var actual float64
+		switch v := value.(type) {
+		case int64:
+			actual = float64(v)
+		case float64:
+			actual = v
+		}
+		cmp = compareFloat64(actual, expected)
+	case string:
+		actual, ok := value.(string)
+		if b, isBytes := value.([]byte); !ok && isBytes {
+			actual = string(b)
+		}
+		if actual < expected {
+			cmp = -1
+		} else if actual > expected {
+			cmp = 1
+		}
+	case bool:
+		actual, _ := value.(bool)
+		if actual != expected {
+			cmp = 1
+		}
+	}
+
+	switch c.operator {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// Compares two floats and returns -1, 0 or 1.
+func compareFloat64(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
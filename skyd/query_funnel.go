@@ -0,0 +1,429 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A funnel step counts how many objects reach each stage of a sequence of
+// conditions. Each stage after the first must occur within a range of steps
+// after the previous stage. An object is counted at most once per stage for
+// each group of dimension values.
+type QueryFunnel struct {
+	query            *Query
+	root             *QueryCondition
+	selection        *QuerySelection
+	Name             string
+	Steps            []string
+	WithinRangeStart int
+	WithinRangeEnd   int
+	WithinUnits      string
+	Dimensions       []string
+}
+
+// A funnel stage increments the count for a single stage of a funnel.
+type queryFunnelStage struct {
+	funnel       *QueryFunnel
+	functionName string
+	index        int
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new funnel.
+func NewQueryFunnel(query *Query) *QueryFunnel {
+	return &QueryFunnel{
+		query:            query,
+		Name:             "funnel",
+		WithinRangeStart: 1,
+		WithinRangeEnd:   1,
+		WithinUnits:      QueryConditionUnitSteps,
+		Dimensions:       []string{},
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this funnel is associated with.
+func (f *QueryFunnel) Query() *Query {
+	return f.query
+}
+
+// Retrieves the function name used during codegen.
+func (f *QueryFunnel) FunctionName() string {
+	if f.root == nil {
+		return ""
+	}
+	return f.root.FunctionName()
+}
+
+// Retrieves the merge function name used during codegen.
+func (f *QueryFunnel) MergeFunctionName() string {
+	if f.selection == nil {
+		return ""
+	}
+	return f.selection.MergeFunctionName()
+}
+
+// Retrieves the child steps. The generated conditions are internal so they
+// are not returned.
+func (f *QueryFunnel) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+// Retrieves the function name called before each object.
+func (f *QueryFunnel) ObjectBeginFunctionName() string {
+	return f.FunctionName() + "_begin"
+}
+
+// Retrieves the function name called after each object.
+func (f *QueryFunnel) ObjectEndFunctionName() string {
+	return f.FunctionName() + "_end"
+}
+
+// The field name used to store the count of a stage.
+func (f *QueryFunnel) stageFieldName(index int) string {
+	return fmt.Sprintf("stage%d", index)
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a funnel into an untyped map.
+func (f *QueryFunnel) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        QueryStepTypeFunnel,
+		"name":        f.Name,
+		"steps":       f.Steps,
+		"within":      []int{f.WithinRangeStart, f.WithinRangeEnd},
+		"withinUnits": f.WithinUnits,
+		"dimensions":  f.Dimensions,
+	}
+}
+
+// Decodes a funnel from an untyped map.
+func (f *QueryFunnel) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryFunnel: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypeFunnel {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && isValidIdentifier(name) {
+		f.Name = name
+	} else if obj["name"] != nil {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "steps".
+	if steps, ok := obj["steps"].([]interface{}); ok {
+		f.Steps = []string{}
+		for _, step := range steps {
+			if str, ok := step.(string); ok && str != "" {
+				f.Steps = append(f.Steps, str)
+			} else {
+				return fmt.Errorf("skyd.QueryFunnel: Invalid step: %v", step)
+			}
+		}
+	} else {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid steps: %v", obj["steps"])
+	}
+	if len(f.Steps) < 2 {
+		return errors.New("skyd.QueryFunnel: At least two steps are required.")
+	}
+
+	// Deserialize "within" range.
+	if withinRange, ok := obj["within"].([]interface{}); ok && len(withinRange) == 2 {
+		if withinRangeStart, ok := withinRange[0].(float64); ok {
+			f.WithinRangeStart = int(withinRangeStart)
+		} else {
+			return fmt.Errorf("skyd.QueryFunnel: Invalid 'within' range start: %v", withinRange[0])
+		}
+		if withinRangeEnd, ok := withinRange[1].(float64); ok {
+			f.WithinRangeEnd = int(withinRangeEnd)
+		} else {
+			return fmt.Errorf("skyd.QueryFunnel: Invalid 'within' range end: %v", withinRange[1])
+		}
+	} else if obj["within"] != nil {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid 'within' range: %v", obj["within"])
+	}
+
+	// Deserialize "within units". Only steps are supported since the stages
+	// are matched by conditions.
+	if withinUnits, ok := obj["withinUnits"].(string); ok {
+		switch withinUnits {
+		case QueryConditionUnitSteps:
+			f.WithinUnits = withinUnits
+		default:
+			return fmt.Errorf("skyd.QueryFunnel: Invalid 'within units': %v", withinUnits)
+		}
+	} else if obj["withinUnits"] != nil {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid 'within units': %v", obj["withinUnits"])
+	}
+
+	// Deserialize "dimensions".
+	if dimensions, ok := obj["dimensions"].([]interface{}); ok {
+		f.Dimensions = []string{}
+		for _, dimension := range dimensions {
+			if str, ok := dimension.(string); ok && isValidIdentifier(str) {
+				f.Dimensions = append(f.Dimensions, str)
+			} else {
+				return fmt.Errorf("skyd.QueryFunnel: Invalid dimension: %v", dimension)
+			}
+		}
+	} else if obj["dimensions"] != nil {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid dimensions: %v", obj["dimensions"])
+	}
+
+	return f.build()
+}
+
+// Generates the nested conditions and the selection used for merging.
+func (f *QueryFunnel) build() error {
+	// The selection is never called during aggregation. It is only used to
+	// merge and defactorize the stage counts.
+	f.selection = NewQuerySelection(f.query)
+	f.selection.Name = f.Name
+	f.selection.Dimensions = f.Dimensions
+	f.selection.Fields = []*QuerySelectionField{}
+	for index := range f.Steps {
+		f.selection.Fields = append(f.selection.Fields, NewQuerySelectionField(f.stageFieldName(index), "count()"))
+	}
+
+	// Nest a condition for each stage inside the previous stage.
+	var parent *QueryCondition
+	for index, expression := range f.Steps {
+		condition := NewQueryCondition(f.query)
+		condition.Expression = expression
+		if parent != nil {
+			condition.WithinRangeStart = f.WithinRangeStart
+			condition.WithinRangeEnd = f.WithinRangeEnd
+			condition.WithinUnits = f.WithinUnits
+			parent.Steps = append(parent.Steps, condition)
+		} else {
+			f.root = condition
+		}
+		stage := &queryFunnelStage{
+			funnel:       f,
+			functionName: fmt.Sprintf("a%d", f.query.NextIdentifier()),
+			index:        index,
+		}
+		condition.Steps = QueryStepList{stage}
+		parent = condition
+	}
+
+	return nil
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code for the funnel aggregation. The dimensions of the
+// current match and the stages each object has reached are kept in locals
+// that are shared by the stage functions.
+func (f *QueryFunnel) CodegenAggregateFunction() (string, error) {
+	if f.root == nil {
+		return "", errors.New("skyd.QueryFunnel: Funnel has not been built.")
+	}
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "local %s_dims, %s_seen\n", f.FunctionName(), f.FunctionName())
+
+	// Reset the stages reached at the beginning of each object.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", f.ObjectBeginFunctionName())
+	fmt.Fprintf(buffer, "  %s_seen = {}\n", f.FunctionName())
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", f.ObjectEndFunctionName())
+	fmt.Fprintf(buffer, "  %s_seen = nil\n", f.FunctionName())
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	str, err := f.root.CodegenAggregateFunction()
+	if err != nil {
+		return "", err
+	}
+	buffer.WriteString(str)
+	return buffer.String(), nil
+}
+
+// Generates Lua code for the funnel merge.
+func (f *QueryFunnel) CodegenMergeFunction() (string, error) {
+	if f.selection == nil {
+		return "", errors.New("skyd.QueryFunnel: Funnel has not been built.")
+	}
+	return f.selection.CodegenMergeFunction()
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Converts factorized dimensions back to their original strings.
+func (f *QueryFunnel) Defactorize(data interface{}) error {
+	if f.selection == nil {
+		return nil
+	}
+	return f.selection.Defactorize(data)
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts the stage counts into a list of stages with conversion rates.
+func (f *QueryFunnel) Finalize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	if m2, ok := m[f.Name].(map[interface{}]interface{}); ok {
+		f.finalize(m2, 0)
+	}
+	return nil
+}
+
+// Recursively finds the stage counts below the dimensions.
+func (f *QueryFunnel) finalize(data map[interface{}]interface{}, index int) {
+	if index < len(f.Dimensions) {
+		if inner, ok := data[f.Dimensions[index]].(map[interface{}]interface{}); ok {
+			for _, v := range inner {
+				if m, ok := v.(map[interface{}]interface{}); ok {
+					f.finalize(m, index+1)
+				}
+			}
+		}
+		return
+	}
+
+	stages := make([]interface{}, 0)
+	var first float64
+	for i, expression := range f.Steps {
+		name := f.stageFieldName(i)
+		count := toInt64(data[name])
+		delete(data, name)
+		if f.query.IsSampled() {
+			count = toInt64(f.query.ScaleSampledValue(count))
+		}
+
+		if i == 0 {
+			first = float64(count)
+		}
+		conversionRate := 0.0
+		if first > 0 {
+			conversionRate = float64(count) / first
+		}
+		stages = append(stages, map[string]interface{}{
+			"expression":     expression,
+			"count":          count,
+			"conversionRate": conversionRate,
+		})
+	}
+	data["stages"] = stages
+}
+
+//------------------------------------------------------------------------------
+//
+// Funnel Stage
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the function name used during codegen.
+func (s *queryFunnelStage) FunctionName() string {
+	return s.functionName
+}
+
+// Stages are merged by the funnel.
+func (s *queryFunnelStage) MergeFunctionName() string {
+	return ""
+}
+
+// Stages have no child steps.
+func (s *queryFunnelStage) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+// Stages are serialized by the funnel.
+func (s *queryFunnelStage) Serialize() map[string]interface{} {
+	return nil
+}
+
+// Stages are deserialized by the funnel.
+func (s *queryFunnelStage) Deserialize(obj map[string]interface{}) error {
+	return errors.New("skyd.QueryFunnel: Stages cannot be deserialized.")
+}
+
+// Generates Lua code to count a stage. The dimensions are captured on the
+// first stage so that every stage is grouped by the same values. Objects that
+// already reached the stage with the same dimensions aren't counted again.
+func (s *queryFunnelStage) CodegenAggregateFunction() (string, error) {
+	f := s.funnel
+	dims := fmt.Sprintf("%s_dims", f.FunctionName())
+	seen := fmt.Sprintf("%s_seen", f.FunctionName())
+	buffer := new(bytes.Buffer)
+
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.FunctionName())
+	if s.index == 0 {
+		fmt.Fprintf(buffer, "  %s = {}\n", dims)
+		for i, dimension := range f.Dimensions {
+			fmt.Fprintf(buffer, "  %s[%d] = cursor.event:%s()\n", dims, i+1, dimension)
+		}
+	}
+	fmt.Fprintf(buffer, "  local key = \"%d\"\n", s.index)
+	for i := range f.Dimensions {
+		fmt.Fprintf(buffer, "  key = key .. \"\\0\" .. tostring(%s[%d])\n", dims, i+1)
+	}
+	fmt.Fprintf(buffer, "  if %s[key] then return end\n", seen)
+	fmt.Fprintf(buffer, "  %s[key] = true\n", seen)
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then data[\"%s\"] = {} end\n", f.Name, f.Name)
+	fmt.Fprintf(buffer, "  data = data[\"%s\"]\n", f.Name)
+	for i, dimension := range f.Dimensions {
+		fmt.Fprintf(buffer, "  local dimension = %s[%d]\n", dims, i+1)
+		fmt.Fprintf(buffer, "  if data.%s == nil then data.%s = {} end\n", dimension, dimension)
+		fmt.Fprintf(buffer, "  if data.%s[dimension] == nil then data.%s[dimension] = {} end\n", dimension, dimension)
+		fmt.Fprintf(buffer, "  data = data.%s[dimension]\n", dimension)
+	}
+	name := f.stageFieldName(s.index)
+	fmt.Fprintf(buffer, "  data.%s = (data.%s or 0) + 1\n", name, name)
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Stages are merged by the funnel.
+func (s *queryFunnelStage) CodegenMergeFunction() (string, error) {
+	return "", nil
+}
+
+// Stages are defactorized by the funnel.
+func (s *queryFunnelStage) Defactorize(data interface{}) error {
+	return nil
+}
+
+// Stages are finalized by the funnel.
+func (s *queryFunnelStage) Finalize(data interface{}) error {
+	return nil
+}
@@ -0,0 +1,184 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A Lua step runs user-supplied Lua code for each event. The aggregate code
+// is run with the "cursor" and "data" variables and the merge code is run
+// with the "results" and "data" variables. Both operate on the table stored
+// under the step's name and are compiled as separate chunks with their own
+// globals so they can't interfere with other steps.
+type QueryLua struct {
+	query             *Query
+	functionName      string
+	mergeFunctionName string
+	Name              string
+	Aggregate         string
+	Merge             string
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new Lua step.
+func NewQueryLua(query *Query) *QueryLua {
+	id := query.NextIdentifier()
+	return &QueryLua{
+		query:             query,
+		functionName:      fmt.Sprintf("a%d", id),
+		mergeFunctionName: fmt.Sprintf("m%d", id),
+		Name:              "lua",
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this step is associated with.
+func (l *QueryLua) Query() *Query {
+	return l.query
+}
+
+// Retrieves the function name used during codegen.
+func (l *QueryLua) FunctionName() string {
+	return l.functionName
+}
+
+// Retrieves the merge function name used during codegen.
+func (l *QueryLua) MergeFunctionName() string {
+	return l.mergeFunctionName
+}
+
+// Retrieves the child steps.
+func (l *QueryLua) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a Lua step into an untyped map.
+func (l *QueryLua) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"type":      QueryStepTypeLua,
+		"name":      l.Name,
+		"aggregate": l.Aggregate,
+		"merge":     l.Merge,
+	}
+}
+
+// Decodes a Lua step from an untyped map.
+func (l *QueryLua) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryLua: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypeLua {
+		return fmt.Errorf("skyd.QueryLua: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && isValidIdentifier(name) {
+		l.Name = name
+	} else if obj["name"] != nil {
+		return fmt.Errorf("skyd.QueryLua: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "aggregate".
+	if aggregate, ok := obj["aggregate"].(string); ok && aggregate != "" {
+		l.Aggregate = aggregate
+	} else {
+		return fmt.Errorf("skyd.QueryLua: Invalid aggregate: %v", obj["aggregate"])
+	}
+
+	// Deserialize "merge".
+	if merge, ok := obj["merge"].(string); ok && merge != "" {
+		l.Merge = merge
+	} else {
+		return fmt.Errorf("skyd.QueryLua: Invalid merge: %v", obj["merge"])
+	}
+
+	return nil
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code that runs the aggregate code for each event. Event
+// properties are read with "cursor.event:name()" so that they are found when
+// the event struct is generated. The code is registered as a snippet and
+// compiled separately by the engine, which passes it a read-only proxy of the
+// cursor.
+func (l *QueryLua) CodegenAggregateFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	// Check property references up front for a clearer error.
+	if l.query.table != nil {
+		if _, err := extractPropertyReferences(l.query.table.propertyFile, l.Aggregate); err != nil {
+			return "", fmt.Errorf("skyd.QueryLua: %v", err)
+		}
+	}
+
+	fmt.Fprintf(buffer, "sky_snippets.%s = {name=%s, args=\"cursor, data\", cursor=true, source=%s}\n", l.FunctionName(), luaQuote(l.Name+".aggregate"), luaQuote(l.Aggregate))
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", l.FunctionName())
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then data[\"%s\"] = {} end\n", l.Name, l.Name)
+	fmt.Fprintf(buffer, "  sky_snippets.%s(cursor, data[\"%s\"])\n", l.FunctionName(), l.Name)
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code that runs the merge code.
+func (l *QueryLua) CodegenMergeFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	fmt.Fprintf(buffer, "sky_snippets.%s = {name=%s, args=\"results, data\", source=%s}\n", l.MergeFunctionName(), luaQuote(l.Name+".merge"), luaQuote(l.Merge))
+	fmt.Fprintf(buffer, "function %s(results, data)\n", l.MergeFunctionName())
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then return end\n", l.Name)
+	fmt.Fprintf(buffer, "  if results[\"%s\"] == nil then results[\"%s\"] = {} end\n", l.Name, l.Name)
+	fmt.Fprintf(buffer, "  sky_snippets.%s(results[\"%s\"], data[\"%s\"])\n", l.MergeFunctionName(), l.Name, l.Name)
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Lua steps can store factors anywhere in their results so factor
+// identifiers are returned as-is.
+func (l *QueryLua) Defactorize(data interface{}) error {
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Lua steps return their results unchanged.
+func (l *QueryLua) Finalize(data interface{}) error {
+	return nil
+}
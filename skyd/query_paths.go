@@ -0,0 +1,382 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	DefaultPathsDepth = 3
+	DefaultPathsLimit = 10
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A paths step records the values of a property on the events that follow an
+// event matching a start condition. The paths are aggregated into a tree of
+// transition counts.
+type QueryPaths struct {
+	query             *Query
+	functionName      string
+	mergeFunctionName string
+	Name              string
+	Expression        string
+	Property          string
+	Depth             int
+	Limit             int
+	MinCount          int
+}
+
+// A child node of the paths tree used for sorting.
+type queryPathsChild struct {
+	key   interface{}
+	count int64
+	node  map[interface{}]interface{}
+}
+
+// A list of child nodes sorted by count and then by key.
+type queryPathsChildList []*queryPathsChild
+
+func (l queryPathsChildList) Len() int      { return len(l) }
+func (l queryPathsChildList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l queryPathsChildList) Less(i, j int) bool {
+	if l[i].count != l[j].count {
+		return l[i].count > l[j].count
+	}
+	return fmt.Sprintf("%v", l[i].key) < fmt.Sprintf("%v", l[j].key)
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new paths step.
+func NewQueryPaths(query *Query) *QueryPaths {
+	id := query.NextIdentifier()
+	return &QueryPaths{
+		query:             query,
+		functionName:      fmt.Sprintf("a%d", id),
+		mergeFunctionName: fmt.Sprintf("m%d", id),
+		Name:              "paths",
+		Depth:             DefaultPathsDepth,
+		Limit:             DefaultPathsLimit,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this step is associated with.
+func (p *QueryPaths) Query() *Query {
+	return p.query
+}
+
+// Retrieves the function name used during codegen.
+func (p *QueryPaths) FunctionName() string {
+	return p.functionName
+}
+
+// Retrieves the merge function name used during codegen.
+func (p *QueryPaths) MergeFunctionName() string {
+	return p.mergeFunctionName
+}
+
+// Retrieves the function name called before each object.
+func (p *QueryPaths) ObjectBeginFunctionName() string {
+	return p.functionName + "_begin"
+}
+
+// Retrieves the function name called after each object.
+func (p *QueryPaths) ObjectEndFunctionName() string {
+	return p.functionName + "_end"
+}
+
+// Retrieves the child steps.
+func (p *QueryPaths) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a paths step into an untyped map.
+func (p *QueryPaths) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"type":       QueryStepTypePaths,
+		"name":       p.Name,
+		"expression": p.Expression,
+		"property":   p.Property,
+		"depth":      p.Depth,
+		"limit":      p.Limit,
+		"minCount":   p.MinCount,
+	}
+}
+
+// Decodes a paths step from an untyped map.
+func (p *QueryPaths) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryPaths: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypePaths {
+		return fmt.Errorf("skyd.QueryPaths: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && isValidIdentifier(name) {
+		p.Name = name
+	} else if obj["name"] != nil {
+		return fmt.Errorf("skyd.QueryPaths: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "expression".
+	if expression, ok := obj["expression"].(string); ok && expression != "" {
+		p.Expression = expression
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid expression: %v", obj["expression"])
+	}
+
+	// Deserialize "property".
+	if property, ok := obj["property"].(string); ok && isValidIdentifier(property) {
+		p.Property = property
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid property: %v", obj["property"])
+	}
+
+	// Deserialize "depth".
+	if depth, ok := obj["depth"].(float64); ok && depth >= 1 {
+		p.Depth = int(depth)
+	} else if obj["depth"] != nil {
+		return fmt.Errorf("skyd.QueryPaths: Invalid depth: %v", obj["depth"])
+	}
+
+	// Deserialize "limit".
+	if limit, ok := obj["limit"].(float64); ok && limit >= 0 {
+		p.Limit = int(limit)
+	} else if obj["limit"] != nil {
+		return fmt.Errorf("skyd.QueryPaths: Invalid limit: %v", obj["limit"])
+	}
+
+	// Deserialize "min count".
+	if minCount, ok := obj["minCount"].(float64); ok && minCount >= 0 {
+		p.MinCount = int(minCount)
+	} else if obj["minCount"] != nil {
+		return fmt.Errorf("skyd.QueryPaths: Invalid min count: %v", obj["minCount"])
+	}
+
+	return nil
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code for the paths aggregation. Each path that is still open
+// moves down the tree by the value of the current event until it reaches the
+// maximum depth. Paths do not continue past the end of an object.
+func (p *QueryPaths) CodegenAggregateFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	if p.query.table.propertyFile.GetPropertyByName(p.Property) == nil {
+		return "", fmt.Errorf("skyd.QueryPaths: Property not found: %v", p.Property)
+	}
+	condition := NewQueryCondition(p.query)
+	condition.Expression = p.Expression
+	expression, err := condition.CodegenExpression()
+	if err != nil {
+		return "", err
+	}
+	paths := p.functionName + "_paths"
+
+	// Reset the open paths for each object.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", p.ObjectBeginFunctionName())
+	fmt.Fprintf(buffer, "  %s = {}\n", paths)
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	// Open paths are closed at the end of the object.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", p.ObjectEndFunctionName())
+	fmt.Fprintf(buffer, "  %s = {}\n", paths)
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	// Advance open paths and then start a new path if the event matches.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", p.FunctionName())
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then data[\"%s\"] = {count = 0, next = {}} end\n", p.Name, p.Name)
+	fmt.Fprintf(buffer, "  local root = data[\"%s\"]\n", p.Name)
+	fmt.Fprintf(buffer, "  local value = cursor.event:%s()\n", p.Property)
+	fmt.Fprintf(buffer, "  local open = {}\n")
+	fmt.Fprintf(buffer, "  for _,path in ipairs(%s) do\n", paths)
+	fmt.Fprintf(buffer, "    local node = path.node.next[value]\n")
+	fmt.Fprintf(buffer, "    if node == nil then\n")
+	fmt.Fprintf(buffer, "      node = {count = 0, next = {}}\n")
+	fmt.Fprintf(buffer, "      path.node.next[value] = node\n")
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "    node.count = node.count + 1\n")
+	fmt.Fprintf(buffer, "    path.node = node\n")
+	fmt.Fprintf(buffer, "    path.depth = path.depth + 1\n")
+	fmt.Fprintf(buffer, "    if path.depth < %d then table.insert(open, path) end\n", p.Depth)
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintf(buffer, "  %s = open\n", paths)
+	fmt.Fprintf(buffer, "  if %s then\n", expression)
+	fmt.Fprintf(buffer, "    root.count = root.count + 1\n")
+	fmt.Fprintf(buffer, "    table.insert(%s, {node = root, depth = 0})\n", paths)
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code for the paths merge.
+func (p *QueryPaths) CodegenMergeFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	// Recursively merge each node.
+	fmt.Fprintf(buffer, "function %s_node(result, data)\n", p.MergeFunctionName())
+	fmt.Fprintf(buffer, "  result.count = (result.count or 0) + (data.count or 0)\n")
+	fmt.Fprintf(buffer, "  if result.next == nil then result.next = {} end\n")
+	fmt.Fprintf(buffer, "  if data.next ~= nil then\n")
+	fmt.Fprintf(buffer, "    for k,v in pairs(data.next) do\n")
+	fmt.Fprintf(buffer, "      if result.next[k] == nil then result.next[k] = {} end\n")
+	fmt.Fprintf(buffer, "      %s_node(result.next[k], v)\n", p.MergeFunctionName())
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	fmt.Fprintf(buffer, "function %s(result, data)\n", p.MergeFunctionName())
+	fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then return end\n", p.Name)
+	fmt.Fprintf(buffer, "  if result[\"%s\"] == nil then result[\"%s\"] = {} end\n", p.Name, p.Name)
+	fmt.Fprintf(buffer, "  %s_node(result[\"%s\"], data[\"%s\"])\n", p.MergeFunctionName(), p.Name, p.Name)
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Converts factorized values in the tree back to their original strings.
+func (p *QueryPaths) Defactorize(data interface{}) error {
+	property := p.query.table.propertyFile.GetPropertyByName(p.Property)
+	if property == nil {
+		return fmt.Errorf("skyd.QueryPaths: Property not found: %v", p.Property)
+	}
+	if property.DataType != FactorDataType {
+		return nil
+	}
+	if m, ok := data.(map[interface{}]interface{}); ok {
+		if root, ok := m[p.Name].(map[interface{}]interface{}); ok {
+			return p.defactorize(root)
+		}
+	}
+	return nil
+}
+
+// Recursively defactorizes the keys of a node's children.
+func (p *QueryPaths) defactorize(node map[interface{}]interface{}) error {
+	next, ok := node["next"].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	copy := map[interface{}]interface{}{}
+	for k, v := range next {
+		sequence, ok := normalize(k).(int64)
+		if !ok {
+			return fmt.Errorf("Invalid factor sequence: %v", k)
+		}
+		stringValue, err := p.query.factors.Defactorize(p.query.table.Name, p.Property, uint64(sequence))
+		if err != nil {
+			return err
+		}
+		if child, ok := v.(map[interface{}]interface{}); ok {
+			if err := p.defactorize(child); err != nil {
+				return err
+			}
+		}
+		copy[stringValue] = v
+	}
+	node["next"] = copy
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Folds rare branches of the tree into an "other" count on their parent.
+// Branches are kept if they have at least the minimum count and are within
+// the limit of the most common branches.
+func (p *QueryPaths) Finalize(data interface{}) error {
+	if m, ok := data.(map[interface{}]interface{}); ok {
+		if root, ok := m[p.Name].(map[interface{}]interface{}); ok {
+			p.finalize(root)
+		}
+	}
+	return nil
+}
+
+// Recursively prunes a node's children. Counts are scaled before pruning
+// when the query is sampled so the minimum count applies to the estimates.
+func (p *QueryPaths) finalize(node map[interface{}]interface{}) {
+	node["count"] = p.count(node)
+	next, _ := node["next"].(map[interface{}]interface{})
+
+	// Sort children by count, then by key for a stable result.
+	children := make(queryPathsChildList, 0, len(next))
+	for k, v := range next {
+		child, _ := v.(map[interface{}]interface{})
+		children = append(children, &queryPathsChild{key: k, count: p.count(child), node: child})
+	}
+	sort.Sort(children)
+
+	var other int64
+	pruned := map[interface{}]interface{}{}
+	for i, child := range children {
+		if (p.Limit > 0 && i >= p.Limit) || child.count < int64(p.MinCount) {
+			other += child.count
+			continue
+		}
+		if child.node != nil {
+			p.finalize(child.node)
+		}
+		pruned[child.key] = child.node
+	}
+	node["next"] = pruned
+	if other > 0 {
+		node["other"] = other
+	}
+}
+
+// Retrieves the count of a node that has not been finalized yet.
+func (p *QueryPaths) count(node map[interface{}]interface{}) int64 {
+	count := toInt64(node["count"])
+	if p.query.IsSampled() {
+		count = toInt64(p.query.ScaleSampledValue(count))
+	}
+	return count
+}
@@ -0,0 +1,101 @@
+package skyd
+
+import (
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A string literal that was converted to a factor identifier during codegen.
+type queryFactorLiteral struct {
+	property string
+	value    string
+	id       uint64
+	found    bool
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Validation
+//--------------------------------------
+
+// Decodes a query from an untyped map like Deserialize() but continues past
+// invalid steps so that every error is returned. Each valid step is also
+// generated to find invalid expressions and missing properties.
+func (q *Query) Validate(obj map[string]interface{}) []error {
+	errs := make([]error, 0)
+
+	// Deserialize everything except the steps.
+	options := make(map[string]interface{})
+	for k, v := range obj {
+		if k != "steps" {
+			options[k] = v
+		}
+	}
+	if err := q.Deserialize(options); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Deserialize and generate each step on its own.
+	steps, ok := obj["steps"].([]interface{})
+	if !ok && obj["steps"] != nil {
+		errs = append(errs, fmt.Errorf("Invalid steps: %v", obj["steps"]))
+	}
+	for index, s := range steps {
+		l, err := DeserializeQueryStepList([]interface{}{s}, q)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Step %d: %v", index, err))
+			continue
+		}
+		if _, err = l.CodegenAggregateFunctions(); err != nil {
+			errs = append(errs, fmt.Errorf("Step %d: %v", index, err))
+			continue
+		}
+		q.Steps = append(q.Steps, l...)
+	}
+
+	// Parse the object filter.
+	if _, err := q.ObjectFilter(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+//--------------------------------------
+// Planning
+//--------------------------------------
+
+// Retrieves the factor literals used by the query. Literals that have never
+// been seen have a nil identifier and cannot match any object.
+func (q *Query) FactorLiterals() []interface{} {
+	output := make([]interface{}, 0)
+	lookup := make(map[string]bool)
+	for _, literal := range q.literals {
+		key := fmt.Sprintf("%s\x00%s", literal.property, literal.value)
+		if lookup[key] {
+			continue
+		}
+		lookup[key] = true
+
+		var id interface{}
+		if literal.found {
+			id = literal.id
+		}
+		output = append(output, map[string]interface{}{
+			"property": literal.property,
+			"value":    literal.value,
+			"id":       id,
+		})
+	}
+	return output
+}
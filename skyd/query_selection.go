@@ -4,8 +4,29 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	QuerySelectionScopeEvent  = "event"
+	QuerySelectionScopeObject = "object"
+)
+
+const (
+	QuerySelectionOrderAsc  = "asc"
+	QuerySelectionOrderDesc = "desc"
+)
+
+// The percentiles calculated for object scoped selections by default.
+var DefaultQuerySelectionPercentiles = []float64{50, 90, 99}
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -20,6 +41,12 @@ type QuerySelection struct {
 	Name              string
 	Dimensions        []string
 	Fields            []*QuerySelectionField
+	Scope             string
+	Percentiles       []float64
+	Sort              string
+	Order             string
+	Limit             int
+	Other             bool
 }
 
 //------------------------------------------------------------------------------
@@ -35,6 +62,9 @@ func NewQuerySelection(query *Query) *QuerySelection {
 		query:             query,
 		functionName:      fmt.Sprintf("a%d", id),
 		mergeFunctionName: fmt.Sprintf("m%d", id),
+		Scope:             QuerySelectionScopeEvent,
+		Percentiles:       DefaultQuerySelectionPercentiles,
+		Order:             QuerySelectionOrderDesc,
 	}
 }
 
@@ -64,6 +94,64 @@ func (s *QuerySelection) GetSteps() QueryStepList {
 	return []QueryStep{}
 }
 
+// Retrieves the function name called before each object. This is blank
+// unless the selection is object scoped.
+func (s *QuerySelection) ObjectBeginFunctionName() string {
+	if s.Scope != QuerySelectionScopeObject {
+		return ""
+	}
+	return s.functionName + "_begin"
+}
+
+// Retrieves the function name called after each object. This is blank
+// unless the selection is object scoped.
+func (s *QuerySelection) ObjectEndFunctionName() string {
+	if s.Scope != QuerySelectionScopeObject {
+		return ""
+	}
+	return s.functionName + "_end"
+}
+
+// Retrieves the function name called before each session. This is blank if
+// the selection has no session fields.
+func (s *QuerySelection) SessionBeginFunctionName() string {
+	if !s.hasSessionFields() {
+		return ""
+	}
+	return s.functionName + "_session_begin"
+}
+
+// Retrieves the function name called after each session. This is blank if
+// the selection has no session fields.
+func (s *QuerySelection) SessionEndFunctionName() string {
+	if !s.hasSessionFields() {
+		return ""
+	}
+	return s.functionName + "_session_end"
+}
+
+// Retrieves the properties whose first and last values are needed for each
+// session.
+func (s *QuerySelection) SessionProperties() []string {
+	properties := []string{}
+	for _, field := range s.Fields {
+		if property := field.SessionProperty(); property != "" {
+			properties = append(properties, property)
+		}
+	}
+	return properties
+}
+
+// Returns whether any of the fields are aggregated per session.
+func (s *QuerySelection) hasSessionFields() bool {
+	for _, field := range s.Fields {
+		if field.IsSessionField() {
+			return true
+		}
+	}
+	return false
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -87,6 +175,16 @@ func (s *QuerySelection) Serialize() map[string]interface{} {
 		"dimensions": s.Dimensions,
 		"fields":     fields,
 	}
+	if s.Scope == QuerySelectionScopeObject {
+		obj["scope"] = s.Scope
+		obj["percentiles"] = s.Percentiles
+	}
+	if s.Sort != "" {
+		obj["sort"] = s.Sort
+		obj["order"] = s.Order
+		obj["limit"] = s.Limit
+		obj["other"] = s.Other
+	}
 	return obj
 }
 
@@ -100,7 +198,7 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 	}
 
 	// Deserialize "name".
-	if name, ok := obj["name"].(string); ok {
+	if name, ok := obj["name"].(string); ok && (name == "" || isValidIdentifier(name)) {
 		s.Name = name
 	} else if obj["name"] == nil {
 		s.Name = ""
@@ -112,7 +210,7 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 	if dimensions, ok := obj["dimensions"].([]interface{}); ok {
 		s.Dimensions = []string{}
 		for _, dimension := range dimensions {
-			if str, ok := dimension.(string); ok {
+			if str, ok := dimension.(string); ok && isValidIdentifier(str) {
 				s.Dimensions = append(s.Dimensions, str)
 			} else {
 				return fmt.Errorf("skyd.QuerySelection: Invalid dimension: %v", dimension)
@@ -126,13 +224,45 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 		}
 	}
 
+	// Deserialize "scope".
+	if scope, ok := obj["scope"].(string); ok {
+		switch scope {
+		case QuerySelectionScopeEvent, QuerySelectionScopeObject:
+			s.Scope = scope
+		default:
+			return fmt.Errorf("skyd.QuerySelection: Invalid scope: %v", scope)
+		}
+	} else if obj["scope"] == nil {
+		s.Scope = QuerySelectionScopeEvent
+	} else {
+		return fmt.Errorf("skyd.QuerySelection: Invalid scope: %v", obj["scope"])
+	}
+
+	// Deserialize "percentiles".
+	if percentiles, ok := obj["percentiles"].([]interface{}); ok {
+		s.Percentiles = []float64{}
+		for _, percentile := range percentiles {
+			if value, ok := percentile.(float64); ok && value >= 0 && value <= 100 {
+				s.Percentiles = append(s.Percentiles, value)
+			} else {
+				return fmt.Errorf("skyd.QuerySelection: Invalid percentile: %v", percentile)
+			}
+		}
+	} else if obj["percentiles"] == nil {
+		s.Percentiles = DefaultQuerySelectionPercentiles
+	} else {
+		return fmt.Errorf("skyd.QuerySelection: Invalid percentiles: %v", obj["percentiles"])
+	}
+
 	// Deserialize "fields".
 	if fields, ok := obj["fields"].([]interface{}); ok {
 		s.Fields = []*QuerySelectionField{}
 		for _, field := range fields {
 			if fieldMap, ok := field.(map[string]interface{}); ok {
 				f := NewQuerySelectionField("", "")
-				f.Deserialize(fieldMap)
+				if err := f.Deserialize(fieldMap); err != nil {
+					return err
+				}
 				s.Fields = append(s.Fields, f)
 			} else {
 				return fmt.Errorf("skyd.QuerySelection: Invalid field: %v", field)
@@ -146,6 +276,68 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 		}
 	}
 
+	// Deserialize "sort".
+	if sortField, ok := obj["sort"].(string); ok && s.field(sortField) != nil {
+		s.Sort = sortField
+	} else if obj["sort"] == nil {
+		s.Sort = ""
+	} else {
+		return fmt.Errorf("skyd.QuerySelection: Invalid sort: %v", obj["sort"])
+	}
+	if s.Sort != "" && s.Scope == QuerySelectionScopeObject {
+		return errors.New("skyd.QuerySelection: Object scoped selections cannot be sorted.")
+	}
+	if s.Sort != "" && s.field(s.Sort).IsValueCount() {
+		return fmt.Errorf("skyd.QuerySelection: Invalid sort: %v", s.Sort)
+	}
+	if s.Scope == QuerySelectionScopeObject {
+		for _, field := range s.Fields {
+			if field.IsValueCount() {
+				return fmt.Errorf("skyd.QuerySelection: Object scoped selections cannot use %v", field.Expression)
+			}
+		}
+	}
+
+	// Deserialize "order".
+	if order, ok := obj["order"].(string); ok && (order == QuerySelectionOrderAsc || order == QuerySelectionOrderDesc) {
+		s.Order = order
+	} else if obj["order"] == nil {
+		s.Order = QuerySelectionOrderDesc
+	} else {
+		return fmt.Errorf("skyd.QuerySelection: Invalid order: %v", obj["order"])
+	}
+
+	// Deserialize "limit".
+	if limit, ok := obj["limit"].(float64); ok && limit >= 0 {
+		s.Limit = int(limit)
+	} else if obj["limit"] == nil {
+		s.Limit = 0
+	} else {
+		return fmt.Errorf("skyd.QuerySelection: Invalid limit: %v", obj["limit"])
+	}
+	if s.Limit > 0 && s.Sort == "" {
+		return errors.New("skyd.QuerySelection: A sort field is required when using a limit.")
+	}
+
+	// Deserialize "other".
+	if other, ok := obj["other"].(bool); ok {
+		s.Other = other
+	} else if obj["other"] == nil {
+		s.Other = false
+	} else {
+		return fmt.Errorf("skyd.QuerySelection: Invalid other: %v", obj["other"])
+	}
+
+	return nil
+}
+
+// Retrieves a field by name.
+func (s *QuerySelection) field(name string) *QuerySelectionField {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
 	return nil
 }
 
@@ -160,8 +352,11 @@ func (s *QuerySelection) CodegenAggregateFunction() (string, error) {
 	// Generate main function.
 	fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.FunctionName())
 
-	// Add selection name.
-	if s.Name != "" {
+	// Object scoped selections aggregate into a temporary table for the
+	// current object. Otherwise add the selection name.
+	if s.Scope == QuerySelectionScopeObject {
+		fmt.Fprintf(buffer, "  data = %s_object\n\n", s.FunctionName())
+	} else if s.Name != "" {
 		fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then data[\"%s\"] = {} end\n", s.Name, s.Name)
 		fmt.Fprintf(buffer, "  data = data[\"%s\"]\n\n", s.Name)
 	}
@@ -180,12 +375,97 @@ func (s *QuerySelection) CodegenAggregateFunction() (string, error) {
 		if err != nil {
 			return "", err
 		}
-		fmt.Fprintln(buffer, "  "+exp)
+		if exp != "" {
+			fmt.Fprintln(buffer, "  "+exp)
+		}
+	}
+
+	// Remember the group so session fields can be added at the end of the session.
+	if s.hasSessionFields() {
+		fmt.Fprintf(buffer, "  %s_sessions[data] = true\n", s.FunctionName())
 	}
 
 	// End function definition.
 	fmt.Fprintln(buffer, "end")
 
+	// Generate object functions.
+	if s.Scope == QuerySelectionScopeObject {
+		code, err := s.codegenObjectFunctions()
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString(code)
+	}
+
+	// Generate session functions.
+	if s.hasSessionFields() {
+		fmt.Fprintln(buffer, "")
+		fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.SessionBeginFunctionName())
+		fmt.Fprintf(buffer, "  %s_sessions = {}\n", s.FunctionName())
+		fmt.Fprintln(buffer, "end")
+		fmt.Fprintln(buffer, "")
+		fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.SessionEndFunctionName())
+		fmt.Fprintf(buffer, "  for data,_ in pairs(%s_sessions) do\n", s.FunctionName())
+		for _, field := range s.Fields {
+			if field.IsSessionField() {
+				exp, err := field.CodegenSessionExpression()
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintln(buffer, "    "+exp)
+			}
+		}
+		fmt.Fprintln(buffer, "  end")
+		fmt.Fprintln(buffer, "end")
+	}
+
+	return buffer.String(), nil
+}
+
+// Generates the functions that reset the per-object values and then add
+// them to a histogram for each field once the object is finished.
+func (s *QuerySelection) codegenObjectFunctions() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	fmt.Fprintln(buffer, "")
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.ObjectBeginFunctionName())
+	fmt.Fprintf(buffer, "  %s_object = {}\n", s.FunctionName())
+	fmt.Fprintln(buffer, "end")
+	fmt.Fprintln(buffer, "")
+
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.ObjectEndFunctionName())
+	if s.Name != "" {
+		fmt.Fprintf(buffer, "  if data[\"%s\"] == nil then data[\"%s\"] = {} end\n", s.Name, s.Name)
+		fmt.Fprintf(buffer, "  data = data[\"%s\"]\n", s.Name)
+	}
+	fmt.Fprintf(buffer, "  local o0 = %s_object\n", s.FunctionName())
+	fmt.Fprintf(buffer, "  local d0 = data\n")
+
+	// Walk each dimension of the object's values.
+	indent := "  "
+	for index, dimension := range s.Dimensions {
+		fmt.Fprintf(buffer, "%sfor k%d,o%d in pairs(o%d.%s or {}) do\n", indent, index, index+1, index, dimension)
+		fmt.Fprintf(buffer, "%s  if d%d.%s == nil then d%d.%s = {} end\n", indent, index, dimension, index, dimension)
+		fmt.Fprintf(buffer, "%s  if d%d.%s[k%d] == nil then d%d.%s[k%d] = {} end\n", indent, index, dimension, index, index, dimension, index)
+		fmt.Fprintf(buffer, "%s  local d%d = d%d.%s[k%d]\n", indent, index+1, index, dimension, index)
+		indent += "  "
+	}
+
+	// Count the object in the histogram for each field.
+	leaf := len(s.Dimensions)
+	for _, field := range s.Fields {
+		fmt.Fprintf(buffer, "%sif o%d.%s ~= nil then\n", indent, leaf, field.Name)
+		fmt.Fprintf(buffer, "%s  if d%d.%s == nil then d%d.%s = {} end\n", indent, leaf, field.Name, leaf, field.Name)
+		fmt.Fprintf(buffer, "%s  d%d.%s[o%d.%s] = (d%d.%s[o%d.%s] or 0) + 1\n", indent, leaf, field.Name, leaf, field.Name, leaf, field.Name, leaf, field.Name)
+		fmt.Fprintf(buffer, "%send\n", indent)
+	}
+
+	for range s.Dimensions {
+		indent = indent[2:]
+		fmt.Fprintf(buffer, "%send\n", indent)
+	}
+	fmt.Fprintln(buffer, "end")
+
 	return buffer.String(), nil
 }
 
@@ -238,6 +518,14 @@ func (s *QuerySelection) CodegenInnerMergeFunction(index int) (string, error) {
 		fmt.Fprintf(buffer, "      %sn%d(result.%s[k], v)\n", s.MergeFunctionName(), (index + 1), dimension)
 		fmt.Fprintf(buffer, "    end\n")
 		fmt.Fprintf(buffer, "  end\n")
+	} else if s.Scope == QuerySelectionScopeObject {
+		// Merge field histograms.
+		for _, field := range s.Fields {
+			fmt.Fprintf(buffer, "  if data.%s ~= nil then\n", field.Name)
+			fmt.Fprintf(buffer, "    if result.%s == nil then result.%s = {} end\n", field.Name, field.Name)
+			fmt.Fprintf(buffer, "    for k,v in pairs(data.%s) do result.%s[k] = (result.%s[k] or 0) + v end\n", field.Name, field.Name, field.Name)
+			fmt.Fprintf(buffer, "  end\n")
+		}
 	} else {
 		// Merge fields.
 		for _, field := range s.Fields {
@@ -279,7 +567,7 @@ func (s *QuerySelection) Defactorize(data interface{}) error {
 // Recursively defactorizes dimensions.
 func (s *QuerySelection) defactorize(data interface{}, index int) error {
 	if index >= len(s.Dimensions) {
-		return nil
+		return s.defactorizeFields(data)
 	}
 	// Ignore any values that are nil or not maps.
 	inner, ok := data.(map[interface{}]interface{})
@@ -320,3 +608,397 @@ func (s *QuerySelection) defactorize(data interface{}, index int) error {
 
 	return nil
 }
+
+// Defactorizes the values counted by session fields of factor properties.
+func (s *QuerySelection) defactorizeFields(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	for _, field := range s.Fields {
+		name := field.SessionProperty()
+		if name == "" {
+			continue
+		}
+		property := s.query.table.propertyFile.GetPropertyByName(name)
+		if property == nil || property.DataType != FactorDataType {
+			continue
+		}
+		if histogram, ok := m[field.Name].(map[interface{}]interface{}); ok {
+			copy := map[interface{}]interface{}{}
+			for k, v := range histogram {
+				sequence, ok := normalize(k).(int64)
+				if !ok {
+					return fmt.Errorf("Invalid factor sequence: %v", k)
+				}
+				stringValue, err := s.query.factors.Defactorize(s.query.table.Name, name, uint64(sequence))
+				if err != nil {
+					return err
+				}
+				copy[stringValue] = v
+			}
+			m[field.Name] = copy
+		}
+	}
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts the histograms of object scoped selections into summaries and
+// scales counts and sums when the query is sampled.
+func (s *QuerySelection) Finalize(data interface{}) error {
+	if s.Scope != QuerySelectionScopeObject && !s.query.IsSampled() && s.Sort == "" {
+		return nil
+	}
+	if m, ok := data.(map[interface{}]interface{}); ok {
+		if s.Name != "" {
+			if m2, ok := m[s.Name].(map[interface{}]interface{}); ok {
+				m = m2
+			} else {
+				return nil
+			}
+		}
+		s.finalize(m, 0)
+		if s.Sort != "" {
+			s.sortDimensions(m, 0)
+		}
+	}
+	return nil
+}
+
+// Recursively finds the field histograms below the dimensions.
+func (s *QuerySelection) finalize(data map[interface{}]interface{}, index int) {
+	if index < len(s.Dimensions) {
+		if inner, ok := data[s.Dimensions[index]].(map[interface{}]interface{}); ok {
+			for _, v := range inner {
+				if m, ok := v.(map[interface{}]interface{}); ok {
+					s.finalize(m, index+1)
+				}
+			}
+		}
+		return
+	}
+
+	for _, field := range s.Fields {
+		if s.Scope == QuerySelectionScopeObject {
+			if histogram, ok := data[field.Name].(map[interface{}]interface{}); ok {
+				data[field.Name] = summarizeHistogram(histogram, s.Percentiles)
+			}
+		} else if field.IsSampleScaled() && data[field.Name] != nil {
+			data[field.Name] = s.query.ScaleSampledValue(data[field.Name])
+		} else if histogram, ok := data[field.Name].(map[interface{}]interface{}); ok && field.IsValueCount() {
+			for k, v := range histogram {
+				histogram[k] = s.query.ScaleSampledValue(v)
+			}
+		}
+	}
+}
+
+// A group within a dimension and the totals of its fields.
+type querySelectionGroup struct {
+	key    interface{}
+	data   map[interface{}]interface{}
+	totals map[string]interface{}
+}
+
+type querySelectionGroupList struct {
+	groups []*querySelectionGroup
+	sort   string
+	desc   bool
+}
+
+func (l *querySelectionGroupList) Len() int      { return len(l.groups) }
+func (l *querySelectionGroupList) Swap(i, j int) { l.groups[i], l.groups[j] = l.groups[j], l.groups[i] }
+func (l *querySelectionGroupList) Less(i, j int) bool {
+	a, b := l.groups[i].totals[l.sort], l.groups[j].totals[l.sort]
+
+	// Groups without a value are always last and ties are ordered by key.
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return fmt.Sprintf("%v", l.groups[i].key) < fmt.Sprintf("%v", l.groups[j].key)
+		}
+		return b == nil
+	}
+	if cmp := compareFloat64(toFloat64(a), toFloat64(b)); cmp != 0 {
+		return (cmp < 0) != l.desc
+	}
+	return fmt.Sprintf("%v", l.groups[i].key) < fmt.Sprintf("%v", l.groups[j].key)
+}
+
+// Converts each dimension into a list of groups ordered by the sort field.
+// Each group includes its dimension value and groups beyond the limit are
+// removed or combined into a single "other" group. Returns the totals of
+// the fields so that the parent dimension can be ordered too.
+func (s *QuerySelection) sortDimensions(data map[interface{}]interface{}, index int) map[string]interface{} {
+	if index == len(s.Dimensions) {
+		totals := map[string]interface{}{}
+		for _, field := range s.Fields {
+			totals[field.Name] = data[field.Name]
+		}
+		return totals
+	}
+
+	// Order the groups using their totals.
+	dimension := s.Dimensions[index]
+	inner, _ := data[dimension].(map[interface{}]interface{})
+	list := &querySelectionGroupList{sort: s.Sort, desc: (s.Order == QuerySelectionOrderDesc)}
+	for k, v := range inner {
+		if m, ok := v.(map[interface{}]interface{}); ok {
+			list.groups = append(list.groups, &querySelectionGroup{key: k, data: m, totals: s.sortDimensions(m, index+1)})
+		}
+	}
+	sort.Sort(list)
+
+	// Combine the totals of all groups and then limit the groups.
+	totals := map[string]interface{}{}
+	for _, group := range list.groups {
+		s.addTotals(totals, group.totals)
+	}
+	groups := list.groups
+	var other []*querySelectionGroup
+	if s.Limit > 0 && len(groups) > s.Limit {
+		groups, other = groups[:s.Limit], groups[s.Limit:]
+	}
+
+	output := make([]interface{}, 0, len(groups)+1)
+	for _, group := range groups {
+		group.data[dimension] = group.key
+		output = append(output, group.data)
+	}
+	if s.Other && len(other) > 0 {
+		m := map[interface{}]interface{}{"other": true}
+		otherTotals := map[string]interface{}{}
+		for _, group := range other {
+			s.addTotals(otherTotals, group.totals)
+		}
+		for k, v := range otherTotals {
+			if v != nil {
+				m[k] = v
+			}
+		}
+		output = append(output, m)
+	}
+	data[dimension] = output
+
+	return totals
+}
+
+// Adds the field values of a group to a set of totals. Counts and sums are
+// added together while minimums and maximums are compared. Other fields
+// cannot be combined so they are left out.
+func (s *QuerySelection) addTotals(totals map[string]interface{}, values map[string]interface{}) {
+	for _, field := range s.Fields {
+		value := values[field.Name]
+		if value == nil {
+			continue
+		}
+		current := totals[field.Name]
+		switch field.Rollup() {
+		case "sum":
+			if current == nil {
+				totals[field.Name] = normalize(value)
+			} else if a, ok := normalize(current).(int64); ok {
+				if b, ok := normalize(value).(int64); ok {
+					totals[field.Name] = a + b
+				} else {
+					totals[field.Name] = toFloat64(current) + toFloat64(value)
+				}
+			} else {
+				totals[field.Name] = toFloat64(current) + toFloat64(value)
+			}
+		case "min":
+			if current == nil || toFloat64(value) < toFloat64(current) {
+				totals[field.Name] = value
+			}
+		case "max":
+			if current == nil || toFloat64(value) > toFloat64(current) {
+				totals[field.Name] = value
+			}
+		}
+	}
+}
+
+// A value in a histogram and the number of objects with that value.
+type histogramBucket struct {
+	value float64
+	count int64
+}
+
+type histogramBucketList []*histogramBucket
+
+func (l histogramBucketList) Len() int           { return len(l) }
+func (l histogramBucketList) Less(i, j int) bool { return l[i].value < l[j].value }
+func (l histogramBucketList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Calculates the number of objects, the average, min, max and percentiles of
+// a histogram of per-object values.
+func summarizeHistogram(histogram map[interface{}]interface{}, percentiles []float64) map[string]interface{} {
+	buckets := make(histogramBucketList, 0, len(histogram))
+	output := map[string]interface{}{}
+	var objects int64
+	var total float64
+	for k, v := range histogram {
+		var value float64
+		switch k := normalize(k).(type) {
+		case int64:
+			value = float64(k)
+		case float64:
+			value = k
+		case bool:
+			if k {
+				value = 1
+			}
+		default:
+			continue
+		}
+		count := toInt64(v)
+		buckets = append(buckets, &histogramBucket{value, count})
+		output[strconv.FormatFloat(value, 'f', -1, 64)] = count
+		objects += count
+		total += value * float64(count)
+	}
+	sort.Sort(buckets)
+
+	summary := map[string]interface{}{"objects": objects, "histogram": output}
+	if objects == 0 {
+		return summary
+	}
+	summary["avg"] = total / float64(objects)
+	summary["min"] = buckets[0].value
+	summary["max"] = buckets[len(buckets)-1].value
+
+	// Use the nearest rank for each percentile.
+	values := map[string]interface{}{}
+	for _, percentile := range percentiles {
+		rank := int64(percentile / 100 * float64(objects))
+		if float64(rank) < percentile/100*float64(objects) {
+			rank++
+		}
+		if rank < 1 {
+			rank = 1
+		}
+		var seen int64
+		for _, bucket := range buckets {
+			seen += bucket.count
+			if seen >= rank {
+				values[strconv.FormatFloat(percentile, 'f', -1, 64)] = bucket.value
+				break
+			}
+		}
+	}
+	summary["percentiles"] = values
+
+	return summary
+}
+
+//--------------------------------------
+// Formatting
+//--------------------------------------
+
+// Retrieves the column names used by the rows of the selection.
+func (s *QuerySelection) Columns() []string {
+	columns := []string{}
+	if s.Name != "" {
+		columns = append(columns, "selection")
+	}
+	columns = append(columns, s.Dimensions...)
+	if s.Other {
+		columns = append(columns, "other")
+	}
+	for _, field := range s.Fields {
+		columns = append(columns, field.Name)
+	}
+	return columns
+}
+
+// Flattens the results of the selection into one row for each group. Rows
+// include the value of each dimension and field with their original types.
+// Selections that combine the remaining groups also mark each row with
+// whether it is the "other" group.
+func (s *QuerySelection) Rows(data interface{}) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0)
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return rows
+	}
+	if s.Name != "" {
+		if m, ok = m[s.Name].(map[interface{}]interface{}); !ok {
+			return rows
+		}
+	}
+	return s.rows(m, []interface{}{}, rows)
+}
+
+// Recursively walks the dimensions and adds a row for each group.
+func (s *QuerySelection) rows(data map[interface{}]interface{}, values []interface{}, rows []map[string]interface{}) []map[string]interface{} {
+	index := len(values)
+	if index == len(s.Dimensions) || data["other"] == true {
+		return s.appendRow(data, values, rows)
+	}
+
+	// Dimensions are either maps of groups or lists of sorted groups.
+	dimension := s.Dimensions[index]
+	switch inner := data[dimension].(type) {
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(inner))
+		lookup := make(map[string]interface{})
+		for k := range inner {
+			str := fmt.Sprintf("%v", k)
+			keys = append(keys, str)
+			lookup[str] = k
+		}
+		sort.Strings(keys)
+		for _, str := range keys {
+			if m, ok := inner[lookup[str]].(map[interface{}]interface{}); ok {
+				rows = s.rows(m, s.appendValue(values, lookup[str]), rows)
+			}
+		}
+	case []interface{}:
+		for _, v := range inner {
+			if m, ok := v.(map[interface{}]interface{}); ok {
+				rows = s.rows(m, s.appendValue(values, m[dimension]), rows)
+			}
+		}
+	}
+	return rows
+}
+
+// Copies the dimension values and adds another value to the end.
+func (s *QuerySelection) appendValue(values []interface{}, value interface{}) []interface{} {
+	ret := make([]interface{}, len(values)+1)
+	copy(ret, values)
+	ret[len(values)] = value
+	return ret
+}
+
+// Adds a row for a group unless none of its fields are set.
+func (s *QuerySelection) appendRow(data map[interface{}]interface{}, values []interface{}, rows []map[string]interface{}) []map[string]interface{} {
+	row := make(map[string]interface{})
+	found := false
+	for _, field := range s.Fields {
+		row[field.Name] = data[field.Name]
+		if data[field.Name] != nil {
+			found = true
+		}
+	}
+	if !found {
+		return rows
+	}
+	if s.Name != "" {
+		row["selection"] = s.Name
+	}
+	for i, dimension := range s.Dimensions {
+		if i < len(values) {
+			row[dimension] = values[i]
+		} else {
+			row[dimension] = nil
+		}
+	}
+	if s.Other {
+		row["other"] = data["other"] == true
+	}
+	return append(rows, row)
+}
@@ -17,6 +17,10 @@ type QuerySelectionField struct {
 	Expression string
 }
 
+// Matches session-level field expressions such as "session_count()" and
+// "session_first(action)".
+var querySessionFieldRegexp = regexp.MustCompile(`^ *session_(?:(count|duration|events)\(\)|(first|last)\((\w+)\)) *$`)
+
 //------------------------------------------------------------------------------
 //
 // Constructors
@@ -25,7 +29,7 @@ type QuerySelectionField struct {
 
 // Creates a new selection field.
 func NewQuerySelectionField(name string, expression string) *QuerySelectionField {
-	return &QuerySelectionField{Name:name, Expression:expression}
+	return &QuerySelectionField{Name: name, Expression: expression}
 }
 
 //------------------------------------------------------------------------------
@@ -61,7 +65,7 @@ func (f *QuerySelectionField) Deserialize(obj map[string]interface{}) error {
 	}
 
 	// Deserialize "name".
-	if name, ok := obj["name"].(string); ok && len(name) > 0 {
+	if name, ok := obj["name"].(string); ok && isValidIdentifier(name) {
 		f.Name = name
 	} else {
 		return fmt.Errorf("skyd.QuerySelectionField: Invalid name: %v", obj["name"])
@@ -74,8 +78,53 @@ func (f *QuerySelectionField) Deserialize(obj map[string]interface{}) error {
 // Code Generation
 //--------------------------------------
 
+// Returns whether the field is aggregated once per session.
+func (f *QuerySelectionField) IsSessionField() bool {
+	return querySessionFieldRegexp.MatchString(f.Expression)
+}
+
+// Returns whether the field is a count or a sum, including the session
+// counts and totals. These fields are scaled up when a query is sampled.
+func (f *QuerySelectionField) IsSampleScaled() bool {
+	return f.Rollup() == "sum"
+}
+
+// Returns how values of the field are combined across groups: "sum", "min",
+// "max" or a blank string if the values cannot be combined.
+func (f *QuerySelectionField) Rollup() string {
+	r, _ := regexp.Compile(`^ *(?:(count)\(\)|(sum|min|max)\(\w+\)|session_(count|duration|events)\(\)) *$`)
+	if m := r.FindStringSubmatch(f.Expression); m != nil {
+		if m[2] != "" {
+			return m[2]
+		}
+		return "sum"
+	}
+	return ""
+}
+
+// Returns whether the field counts the sessions for each value of a
+// property. These fields are histograms keyed by property value.
+func (f *QuerySelectionField) IsValueCount() bool {
+	m := querySessionFieldRegexp.FindStringSubmatch(f.Expression)
+	return m != nil && m[2] != ""
+}
+
+// Returns the property used by a session field or a blank string if the
+// field does not use a property.
+func (f *QuerySelectionField) SessionProperty() string {
+	if m := querySessionFieldRegexp.FindStringSubmatch(f.Expression); m != nil {
+		return m[3]
+	}
+	return ""
+}
+
 // Generates Lua code for the expression.
 func (f *QuerySelectionField) CodegenExpression() (string, error) {
+	// Session fields are aggregated at the end of each session.
+	if f.IsSessionField() {
+		return "", nil
+	}
+
 	r, _ := regexp.Compile(`^ *(?:count\(\)|(sum|min|max)\((\w+)\)|(\w+)) *$`)
 	if m := r.FindStringSubmatch(f.Expression); m != nil {
 		if len(m[1]) > 0 { // sum()/min()/max()
@@ -97,8 +146,32 @@ func (f *QuerySelectionField) CodegenExpression() (string, error) {
 	return "", fmt.Errorf("skyd.QuerySelectionField: Invalid expression: %q", f.Expression)
 }
 
+// Generates Lua code to aggregate a session field at the end of a session.
+func (f *QuerySelectionField) CodegenSessionExpression() (string, error) {
+	m := querySessionFieldRegexp.FindStringSubmatch(f.Expression)
+	if m == nil {
+		return "", fmt.Errorf("skyd.QuerySelectionField: Invalid session expression: %q", f.Expression)
+	}
+	switch m[1] {
+	case "count":
+		return fmt.Sprintf("data.%s = (data.%s or 0) + 1", f.Name, f.Name), nil
+	case "duration":
+		return fmt.Sprintf("data.%s = (data.%s or 0) + (sky_session.last - sky_session.first)", f.Name, f.Name), nil
+	case "events":
+		return fmt.Sprintf("data.%s = (data.%s or 0) + sky_session.events", f.Name, f.Name), nil
+	}
+	return fmt.Sprintf("local value = sky_session.%s_values.%s if value ~= nil then if data.%s == nil then data.%s = {} end data.%s[value] = (data.%s[value] or 0) + 1 end", m[2], m[3], f.Name, f.Name, f.Name, f.Name), nil
+}
+
 // Generates Lua code for the merge expression.
 func (f *QuerySelectionField) CodegenMergeExpression() (string, error) {
+	if m := querySessionFieldRegexp.FindStringSubmatch(f.Expression); m != nil {
+		if m[1] != "" {
+			return fmt.Sprintf("result.%s = (result.%s or 0) + (data.%s or 0)", f.Name, f.Name, f.Name), nil
+		}
+		return fmt.Sprintf("if data.%s ~= nil then if result.%s == nil then result.%s = {} end for k,v in pairs(data.%s) do result.%s[k] = (result.%s[k] or 0) + v end end", f.Name, f.Name, f.Name, f.Name, f.Name, f.Name), nil
+	}
+
 	r, _ := regexp.Compile(`^ *(?:count\(\)|(sum|min|max)\((\w+)\)|(\w+)) *$`)
 	if m := r.FindStringSubmatch(f.Expression); m != nil {
 		if len(m[1]) > 0 { // sum()/min()/max()
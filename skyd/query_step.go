@@ -14,6 +14,10 @@ import (
 const (
 	QueryStepTypeCondition = "condition"
 	QueryStepTypeSelection = "selection"
+	QueryStepTypeFunnel    = "funnel"
+	QueryStepTypeCohort    = "cohort"
+	QueryStepTypePaths     = "paths"
+	QueryStepTypeLua       = "lua"
 )
 
 //------------------------------------------------------------------------------
@@ -31,6 +35,26 @@ type QueryStep interface {
 	CodegenAggregateFunction() (string, error)
 	CodegenMergeFunction() (string, error)
 	Defactorize(data interface{}) error
+	Finalize(data interface{}) error
+}
+
+// A QueryObjectStep is a step that needs to be notified before and after the
+// events for each object are processed. Steps that don't currently need to be
+// notified can return blank function names.
+type QueryObjectStep interface {
+	QueryStep
+	ObjectBeginFunctionName() string
+	ObjectEndFunctionName() string
+}
+
+// A QuerySessionStep is a step that needs to be notified before and after
+// each session. Steps that don't currently need to be notified can return
+// blank function names.
+type QuerySessionStep interface {
+	QueryStep
+	SessionBeginFunctionName() string
+	SessionEndFunctionName() string
+	SessionProperties() []string
 }
 
 type QueryStepList []QueryStep
@@ -66,6 +90,14 @@ func DeserializeQueryStepList(obj interface{}, q *Query) (QueryStepList, error)
 					step = NewQueryCondition(q)
 				case QueryStepTypeSelection:
 					step = NewQuerySelection(q)
+				case QueryStepTypeFunnel:
+					step = NewQueryFunnel(q)
+				case QueryStepTypeCohort:
+					step = NewQueryCohort(q)
+				case QueryStepTypePaths:
+					step = NewQueryPaths(q)
+				case QueryStepTypeLua:
+					step = NewQueryLua(q)
 				default:
 					return nil, fmt.Errorf("Invalid query step type: %v", s["type"])
 				}
@@ -114,6 +146,44 @@ func (l QueryStepList) CodegenMergeFunctions() (string, error) {
 	return buffer.String(), nil
 }
 
+// Retrieves all steps, including child steps, that need to be notified
+// before and after each object.
+func (l QueryStepList) ObjectSteps() []QueryObjectStep {
+	steps := make([]QueryObjectStep, 0)
+	for _, step := range l {
+		if objectStep, ok := step.(QueryObjectStep); ok && objectStep.ObjectEndFunctionName() != "" {
+			steps = append(steps, objectStep)
+		}
+		steps = append(steps, step.GetSteps().ObjectSteps()...)
+	}
+	return steps
+}
+
+// Retrieves all steps, including child steps, that need to be notified
+// before and after each session.
+func (l QueryStepList) SessionSteps() []QuerySessionStep {
+	steps := make([]QuerySessionStep, 0)
+	for _, step := range l {
+		if sessionStep, ok := step.(QuerySessionStep); ok && sessionStep.SessionEndFunctionName() != "" {
+			steps = append(steps, sessionStep)
+		}
+		steps = append(steps, step.GetSteps().SessionSteps()...)
+	}
+	return steps
+}
+
+// Retrieves all selections, including child steps.
+func (l QueryStepList) Selections() []*QuerySelection {
+	selections := make([]*QuerySelection, 0)
+	for _, step := range l {
+		if selection, ok := step.(*QuerySelection); ok {
+			selections = append(selections, selection)
+		}
+		selections = append(selections, step.GetSteps().Selections()...)
+	}
+	return selections
+}
+
 // Generates merge invocations.
 func (l QueryStepList) CodegenMergeInvoke() string {
 	buffer := new(bytes.Buffer)
@@ -146,3 +216,18 @@ func (l QueryStepList) Defactorize(data interface{}) error {
 	}
 	return nil
 }
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Reshapes the merged results after all servlets have been merged.
+func (l QueryStepList) Finalize(data interface{}) error {
+	for _, step := range l {
+		err := step.Finalize(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -28,3 +28,51 @@ func TestQueryEncodeDecode(t *testing.T) {
 		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
 	}
 }
+
+// Ensure that we can encode queries with funnels.
+func TestQueryFunnelEncodeDecode(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	json := `{"sessionIdleTime":0,"steps":[{"dimensions":["channel"],"name":"signup","steps":["action == 'home'","action == 'signup'"],"type":"funnel","within":[1,5],"withinUnits":"steps"}]}` + "\n"
+
+	// Decode
+	q := NewQuery(table, nil)
+	buffer := bytes.NewBufferString(json)
+	err := q.Decode(buffer)
+	if err != nil {
+		t.Fatalf("Query decoding error: %v", err)
+	}
+
+	// Encode
+	buffer = new(bytes.Buffer)
+	q.Encode(buffer)
+	if buffer.String() != json {
+		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
+	}
+}
+
+// Ensure that we can encode queries with cohorts.
+func TestQueryCohortEncodeDecode(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	json := `{"sessionIdleTime":0,"steps":[{"expression":"action == 'signup'","name":"retention","period":86400,"periods":30,"returnExpression":"action == 'login'","type":"cohort"}]}` + "\n"
+
+	// Decode
+	q := NewQuery(table, nil)
+	buffer := bytes.NewBufferString(json)
+	err := q.Decode(buffer)
+	if err != nil {
+		t.Fatalf("Query decoding error: %v", err)
+	}
+
+	// Encode
+	buffer = new(bytes.Buffer)
+	q.Encode(buffer)
+	if buffer.String() != json {
+		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
+	}
+}
@@ -0,0 +1,477 @@
+package skyd
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+//
+// Globals
+//
+//------------------------------------------------------------------------------
+
+// Words that separate the clauses of a textual query. Keywords are not case
+// sensitive and cannot be used as property names in expressions.
+var queryTextKeywords = map[string]bool{
+	"ABSENT":   true,
+	"AS":       true,
+	"BY":       true,
+	"END":      true,
+	"GROUP":    true,
+	"IDLE":     true,
+	"INTO":     true,
+	"SECONDS":  true,
+	"SELECT":   true,
+	"SESSION":  true,
+	"SESSIONS": true,
+	"STEPS":    true,
+	"THEN":     true,
+	"WHERE":    true,
+	"WITHIN":   true,
+}
+
+// Matches the characters that are replaced when naming a field after its
+// expression.
+var queryTextFieldNameRegexp = regexp.MustCompile(`\W+`)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A queryTextParser converts a textual query into the untyped map used by
+// Query.Deserialize(). The grammar is:
+//
+//	query     = [ "SESSION" "IDLE" number ] { step }
+//	step      = selection | condition
+//	selection = "SELECT" field { "," field } [ "GROUP" "BY" name { "," name } ] [ "INTO" string ]
+//	field     = expression [ "AS" name ]
+//	condition = "WHERE" clause { "THEN" clause } { step } [ "END" ]
+//	clause    = [ "ABSENT" ] [ "WITHIN" number ".." number ( "STEPS" | "SESSIONS" | "SECONDS" ) ] expression
+//
+// Each "THEN" clause is nested inside the previous clause and the steps that
+// follow are nested inside the last one. "END" closes the whole chain. Only
+// "ABSENT" clauses can use "SESSIONS" or "SECONDS" since other conditions
+// are always matched by steps.
+type queryTextParser struct {
+	runes  []rune
+	tokens []*expressionToken
+	index  int
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Query
+//--------------------------------------
+
+// Decodes a query from its textual form.
+func (q *Query) DeserializeText(text string) error {
+	obj, err := ParseQueryText(text)
+	if err != nil {
+		return err
+	}
+	return q.Deserialize(obj)
+}
+
+// Encodes a query into its textual form. Only selections and conditions can
+// be written as text.
+func (q *Query) SerializeText() (string, error) {
+	if !q.Start.IsZero() || !q.End.IsZero() || q.Filter != "" || q.IsSampled() {
+		return "", fmt.Errorf("skyd.QueryText: Ranges, filters and samples cannot be written as text.")
+	}
+
+	buffer := new(bytes.Buffer)
+	if q.SessionIdleTime > 0 {
+		fmt.Fprintf(buffer, "SESSION IDLE %d\n", q.SessionIdleTime)
+	}
+	if err := formatQueryTextSteps(buffer, q.Steps, 0); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+//--------------------------------------
+// Parsing
+//--------------------------------------
+
+// Parses a textual query into an untyped map.
+func ParseQueryText(text string) (map[string]interface{}, error) {
+	tokens, err := tokenizeExpression(text)
+	if err != nil {
+		return nil, fmt.Errorf("skyd.QueryText: %v", err)
+	}
+	p := &queryTextParser{runes: []rune(text), tokens: tokens}
+
+	obj := map[string]interface{}{}
+	if p.accept("SESSION") {
+		if !p.accept("IDLE") {
+			return nil, p.errorf("Expected IDLE")
+		}
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		obj["sessionIdleTime"] = n
+	}
+
+	steps, err := p.parseSteps(false)
+	if err != nil {
+		return nil, err
+	}
+	obj["steps"] = steps
+	return obj, nil
+}
+
+// Parses steps until the end of the text or, when nested, an "END".
+func (p *queryTextParser) parseSteps(nested bool) ([]interface{}, error) {
+	steps := make([]interface{}, 0)
+	for p.index < len(p.tokens) {
+		var step map[string]interface{}
+		var err error
+		switch {
+		case p.peek("SELECT"):
+			step, err = p.parseSelection()
+		case p.peek("WHERE"):
+			step, err = p.parseCondition()
+		case p.peek("END") && nested:
+			return steps, nil
+		default:
+			return nil, p.errorf("Unexpected '%v'", p.tokens[p.index].value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Parses a selection.
+func (p *queryTextParser) parseSelection() (map[string]interface{}, error) {
+	p.accept("SELECT")
+
+	// Parse fields.
+	fields := make([]interface{}, 0)
+	for {
+		expression := p.expression(true)
+		if expression == "" {
+			return nil, p.errorf("Expected field expression")
+		}
+		name := queryTextFieldName(expression)
+		if p.accept("AS") {
+			var err error
+			if name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, map[string]interface{}{"name": name, "expression": expression})
+		if !p.acceptOperator(",") {
+			break
+		}
+	}
+
+	// Parse dimensions.
+	dimensions := make([]interface{}, 0)
+	if p.accept("GROUP") {
+		if !p.accept("BY") {
+			return nil, p.errorf("Expected BY")
+		}
+		for {
+			dimension, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			dimensions = append(dimensions, dimension)
+			if !p.acceptOperator(",") {
+				break
+			}
+		}
+	}
+
+	step := map[string]interface{}{"type": QueryStepTypeSelection, "fields": fields, "dimensions": dimensions}
+
+	// Parse name.
+	if p.accept("INTO") {
+		if p.index >= len(p.tokens) || p.tokens[p.index].tokenType != expressionTokenString {
+			return nil, p.errorf("Expected selection name")
+		}
+		step["name"] = p.tokens[p.index].value
+		p.index++
+	}
+
+	return step, nil
+}
+
+// Parses a condition along with any conditions chained with "THEN".
+func (p *queryTextParser) parseCondition() (map[string]interface{}, error) {
+	p.accept("WHERE")
+	root, err := p.parseConditionClause()
+	if err != nil {
+		return nil, err
+	}
+
+	inner := root
+	for p.accept("THEN") {
+		condition, err := p.parseConditionClause()
+		if err != nil {
+			return nil, err
+		}
+		inner["steps"] = []interface{}{condition}
+		inner = condition
+	}
+
+	steps, err := p.parseSteps(true)
+	if err != nil {
+		return nil, err
+	}
+	inner["steps"] = steps
+	p.accept("END")
+
+	return root, nil
+}
+
+// Parses the range and expression of a single condition.
+func (p *queryTextParser) parseConditionClause() (map[string]interface{}, error) {
+	step := map[string]interface{}{"type": QueryStepTypeCondition}
+	if p.accept("ABSENT") {
+		step["absent"] = true
+	}
+
+	if p.accept("WITHIN") {
+		start, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptOperator("..") {
+			return nil, p.errorf("Expected '..'")
+		}
+		end, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		step["within"] = []interface{}{start, end}
+
+		switch {
+		case p.accept("STEPS"):
+			step["withinUnits"] = QueryConditionUnitSteps
+		case step["absent"] == true && p.accept("SESSIONS"):
+			step["withinUnits"] = QueryConditionUnitSessions
+		case step["absent"] == true && p.accept("SECONDS"):
+			step["withinUnits"] = QueryConditionUnitSeconds
+		case p.peek("SESSIONS") || p.peek("SECONDS"):
+			return nil, p.errorf("SESSIONS and SECONDS are only supported on ABSENT conditions")
+		default:
+			return nil, p.errorf("Expected STEPS, SESSIONS or SECONDS")
+		}
+	}
+
+	expression := p.expression(false)
+	if expression == "" {
+		return nil, p.errorf("Expected condition expression")
+	}
+	step["expression"] = expression
+
+	return step, nil
+}
+
+//--------------------------------------
+// Tokens
+//--------------------------------------
+
+// Checks if the next token is a given keyword.
+func (p *queryTextParser) peek(keyword string) bool {
+	if p.index >= len(p.tokens) {
+		return false
+	}
+	token := p.tokens[p.index]
+	return token.tokenType == expressionTokenIdentifier && strings.ToUpper(token.value) == keyword
+}
+
+// Consumes the next token if it is a given keyword.
+func (p *queryTextParser) accept(keyword string) bool {
+	if p.peek(keyword) {
+		p.index++
+		return true
+	}
+	return false
+}
+
+// Consumes the next token if it is a given operator.
+func (p *queryTextParser) acceptOperator(op string) bool {
+	if p.index < len(p.tokens) && p.tokens[p.index].tokenType == expressionTokenOperator && p.tokens[p.index].value == op {
+		p.index++
+		return true
+	}
+	return false
+}
+
+// Consumes an identifier that is not a keyword.
+func (p *queryTextParser) name() (string, error) {
+	if p.index >= len(p.tokens) {
+		return "", p.errorf("Expected name")
+	}
+	token := p.tokens[p.index]
+	if token.tokenType != expressionTokenIdentifier || queryTextKeywords[strings.ToUpper(token.value)] {
+		return "", p.errorf("Expected name")
+	}
+	p.index++
+	return token.value, nil
+}
+
+// Consumes an optionally negative number.
+func (p *queryTextParser) number() (float64, error) {
+	sign := 1.0
+	if p.acceptOperator("-") {
+		sign = -1
+	}
+	if p.index >= len(p.tokens) || p.tokens[p.index].tokenType != expressionTokenNumber {
+		return 0, p.errorf("Expected number")
+	}
+	value, _ := strconv.ParseFloat(p.tokens[p.index].value, 64)
+	p.index++
+	return sign * value, nil
+}
+
+// Consumes tokens up to the next keyword and returns the text they span.
+// Commas outside of parentheses also end the expression if requested.
+func (p *queryTextParser) expression(stopAtComma bool) string {
+	start := p.index
+	depth := 0
+	for ; p.index < len(p.tokens); p.index++ {
+		token := p.tokens[p.index]
+		if token.tokenType == expressionTokenIdentifier && queryTextKeywords[strings.ToUpper(token.value)] {
+			break
+		} else if token.tokenType == expressionTokenOperator {
+			if token.value == "(" {
+				depth++
+			} else if token.value == ")" {
+				depth--
+			} else if token.value == "," && stopAtComma && depth == 0 {
+				break
+			}
+		}
+	}
+	if p.index == start {
+		return ""
+	}
+
+	end := len(p.runes)
+	if p.index < len(p.tokens) {
+		end = p.tokens[p.index].pos
+	}
+	return strings.TrimSpace(string(p.runes[p.tokens[start].pos:end]))
+}
+
+// Returns an error at the position of the current token.
+func (p *queryTextParser) errorf(format string, v ...interface{}) error {
+	pos := len(p.runes)
+	if p.index < len(p.tokens) {
+		pos = p.tokens[p.index].pos
+	}
+	return fmt.Errorf("skyd.QueryText: %v at position %d", fmt.Sprintf(format, v...), pos)
+}
+
+// Generates the default name of a field from its expression. For example,
+// "count()" is named "count" and "sum(price)" is named "sum_price".
+func queryTextFieldName(expression string) string {
+	return strings.Trim(queryTextFieldNameRegexp.ReplaceAllString(expression, "_"), "_")
+}
+
+//--------------------------------------
+// Formatting
+//--------------------------------------
+
+// Writes a list of steps as text, indenting each line by a given depth.
+func formatQueryTextSteps(buffer *bytes.Buffer, steps QueryStepList, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	for _, step := range steps {
+		switch step := step.(type) {
+		case *QuerySelection:
+			str, err := formatQueryTextSelection(step)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(buffer, "%s%s\n", indent, str)
+
+		case *QueryCondition:
+			// Chain conditions that only contain another condition.
+			str, err := formatQueryTextCondition(step)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(buffer, "%sWHERE %s\n", indent, str)
+			inner, innerDepth := step, depth+1
+			for len(inner.Steps) == 1 {
+				child, ok := inner.Steps[0].(*QueryCondition)
+				if !ok {
+					break
+				}
+				if str, err = formatQueryTextCondition(child); err != nil {
+					return err
+				}
+				fmt.Fprintf(buffer, "%sTHEN %s\n", strings.Repeat("  ", innerDepth), str)
+				inner, innerDepth = child, innerDepth+1
+			}
+			if err := formatQueryTextSteps(buffer, inner.Steps, innerDepth); err != nil {
+				return err
+			}
+			fmt.Fprintf(buffer, "%sEND\n", indent)
+
+		default:
+			return fmt.Errorf("skyd.QueryText: %v steps cannot be written as text.", step.Serialize()["type"])
+		}
+	}
+	return nil
+}
+
+// Formats a selection as text.
+func formatQueryTextSelection(s *QuerySelection) (string, error) {
+	if s.Scope == QuerySelectionScopeObject || s.Sort != "" {
+		return "", fmt.Errorf("skyd.QueryText: Object scope and sorted selections cannot be written as text.")
+	}
+
+	fields := make([]string, 0, len(s.Fields))
+	for _, field := range s.Fields {
+		if field.Name == queryTextFieldName(field.Expression) {
+			fields = append(fields, field.Expression)
+		} else {
+			fields = append(fields, fmt.Sprintf("%s AS %s", field.Expression, field.Name))
+		}
+	}
+
+	str := "SELECT " + strings.Join(fields, ", ")
+	if len(s.Dimensions) > 0 {
+		str += " GROUP BY " + strings.Join(s.Dimensions, ", ")
+	}
+	if s.Name != "" {
+		str += fmt.Sprintf(` INTO "%s"`, strings.Replace(strings.Replace(s.Name, `\`, `\\`, -1), `"`, `\"`, -1))
+	}
+	return str, nil
+}
+
+// Formats the range and expression of a single condition. Only absent
+// conditions can use a range that isn't measured in steps.
+func formatQueryTextCondition(c *QueryCondition) (string, error) {
+	if !c.Absent && c.WithinUnits != QueryConditionUnitSteps {
+		return "", fmt.Errorf("skyd.QueryText: Only absent conditions can be written with a range of %s.", c.WithinUnits)
+	}
+
+	str := ""
+	if c.Absent {
+		str += "ABSENT "
+	}
+	if c.WithinRangeStart != 0 || c.WithinRangeEnd != 0 || c.WithinUnits != QueryConditionUnitSteps {
+		str += fmt.Sprintf("WITHIN %d..%d %s ", c.WithinRangeStart, c.WithinRangeEnd, strings.ToUpper(c.WithinUnits))
+	}
+	return str + c.Expression, nil
+}
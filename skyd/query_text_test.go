@@ -0,0 +1,95 @@
+package skyd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Ensure that we can parse textual queries into steps.
+func TestQueryDeserializeText(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	text := `SELECT count() GROUP BY action WHERE action == "signup" THEN WITHIN 1..5 STEPS action == "checkout" SELECT count()`
+	json := `{"sessionIdleTime":0,"steps":[{"dimensions":["action"],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"},{"expression":"action == \"signup\"","steps":[{"expression":"action == \"checkout\"","steps":[{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}],"type":"condition","within":[1,5],"withinUnits":"steps"}],"type":"condition","within":[0,0],"withinUnits":"steps"}]}` + "\n"
+
+	q := NewQuery(table, nil)
+	if err := q.DeserializeText(text); err != nil {
+		t.Fatalf("Query text decoding error: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	q.Encode(buffer)
+	if buffer.String() != json {
+		t.Fatalf("Query text decoding error:\nexp: %s\ngot: %s", json, buffer.String())
+	}
+
+	// Invalid text returns the position of the error.
+	q = NewQuery(table, nil)
+	if err := q.DeserializeText(`SELECT count() GROUP action`); err == nil || err.Error() != "skyd.QueryText: Expected BY at position 21" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Only absent conditions can use a range of seconds or sessions.
+	q = NewQuery(table, nil)
+	if err := q.DeserializeText(`WHERE WITHIN 0..10 SECONDS foo == 1`); err == nil || err.Error() != "skyd.QueryText: SESSIONS and SECONDS are only supported on ABSENT conditions at position 19" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensure that we can write queries as text and parse them back.
+func TestQuerySerializeText(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{
+			`SELECT count() GROUP BY action WHERE action == "signup" THEN WITHIN 1..5 STEPS action == "checkout" SELECT count()`,
+			"SELECT count() GROUP BY action\nWHERE action == \"signup\"\n  THEN WITHIN 1..5 STEPS action == \"checkout\"\n    SELECT count()\nEND\n",
+		},
+		{
+			`session idle 1800 select sum(x) as total into "xyz" where absent within 0..10 seconds baz == 'hello' end where foo == 1 select min(x), max(x) where bar == 2 end select count()`,
+			"SESSION IDLE 1800\nSELECT sum(x) AS total INTO \"xyz\"\nWHERE ABSENT WITHIN 0..10 SECONDS baz == 'hello'\nEND\nWHERE foo == 1\n  SELECT min(x), max(x)\n  WHERE bar == 2\n  END\n  SELECT count()\nEND\n",
+		},
+	}
+	for i, test := range tests {
+		q := NewQuery(table, nil)
+		if err := q.DeserializeText(test.input); err != nil {
+			t.Fatalf("[%d] Query text decoding error: %v", i, err)
+		}
+		output, err := q.SerializeText()
+		if err != nil {
+			t.Fatalf("[%d] Query text encoding error: %v", i, err)
+		}
+		if output != test.output {
+			t.Fatalf("[%d] Query text encoding error:\nexp: %s\ngot: %s", i, test.output, output)
+		}
+
+		// The output should parse to the same text.
+		q = NewQuery(table, nil)
+		if err := q.DeserializeText(output); err != nil {
+			t.Fatalf("[%d] Query text decoding error: %v", i, err)
+		}
+		if roundtrip, _ := q.SerializeText(); roundtrip != output {
+			t.Fatalf("[%d] Query text round trip error:\nexp: %s\ngot: %s", i, output, roundtrip)
+		}
+	}
+
+	// Other step types cannot be written as text.
+	q := NewQuery(table, nil)
+	q.Decode(bytes.NewBufferString(`{"steps":[{"type":"funnel","steps":["action == 'home'","action == 'signup'"]}]}`))
+	if _, err := q.SerializeText(); err == nil || err.Error() != "skyd.QueryText: funnel steps cannot be written as text." {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Ranges of seconds or sessions have no effect on other conditions.
+	q = NewQuery(table, nil)
+	q.Decode(bytes.NewBufferString(`{"steps":[{"type":"condition","expression":"foo == 1","within":[0,10],"withinUnits":"seconds"}]}`))
+	if _, err := q.SerializeText(); err == nil || err.Error() != "skyd.QueryText: Only absent conditions can be written with a range of seconds." {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
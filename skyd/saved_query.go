@@ -0,0 +1,228 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+//------------------------------------------------------------------------------
+//
+// Globals
+//
+//------------------------------------------------------------------------------
+
+var savedQueryNameRegexp = regexp.MustCompile(`^\w+$`)
+
+var savedQueryParamRegexp = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+var savedQueryWordRegexp = regexp.MustCompile(`^\w*$`)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A SavedQuery is a named query stored with a table. String values in the
+// query can contain "{{param}}" placeholders that are bound when the query
+// is run. A value that is only a placeholder is replaced by the parameter
+// value itself so it can be used for numbers such as "within" ranges.
+// Parameters must be strings, numbers or booleans.
+type SavedQuery struct {
+	Name  string                 `json:"name"`
+	Query map[string]interface{} `json:"query"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// NewSavedQuery returns a new SavedQuery.
+func NewSavedQuery(name string, query map[string]interface{}) (*SavedQuery, error) {
+	if !savedQueryNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("skyd.SavedQuery: Invalid name: %v", name)
+	}
+	if query == nil {
+		return nil, errors.New("skyd.SavedQuery: Query is required.")
+	}
+	return &SavedQuery{Name: name, Query: query}, nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a saved query into an untyped map.
+func (q *SavedQuery) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"name":   q.Name,
+		"query":  q.Query,
+		"params": q.Params(),
+	}
+}
+
+//--------------------------------------
+// Parameters
+//--------------------------------------
+
+// Retrieves a sorted list of the parameter names used in the query.
+func (q *SavedQuery) Params() []string {
+	lookup := make(map[string]bool)
+	savedQueryParams(q.Query, lookup)
+
+	params := make([]string, 0, len(lookup))
+	for param := range lookup {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	return params
+}
+
+// Recursively finds parameter names in a value.
+func savedQueryParams(value interface{}, lookup map[string]bool) {
+	switch v := value.(type) {
+	case string:
+		for _, m := range savedQueryParamRegexp.FindAllStringSubmatch(v, -1) {
+			lookup[m[1]] = true
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			savedQueryParams(item, lookup)
+		}
+	case []interface{}:
+		for _, item := range v {
+			savedQueryParams(item, lookup)
+		}
+	}
+}
+
+// Returns a copy of the query with each placeholder replaced by the value of
+// its parameter.
+func (q *SavedQuery) Bind(params map[string]interface{}) (map[string]interface{}, error) {
+	value, err := bindSavedQueryValue(q.Query, params)
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[string]interface{}), nil
+}
+
+// Recursively binds parameters to a value.
+func bindSavedQueryValue(value interface{}, params map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		// Replace the whole value if it is a single placeholder.
+		if m := savedQueryParamRegexp.FindStringSubmatch(v); m != nil && m[0] == v {
+			return savedQueryParam(params, m[1])
+		}
+
+		// Otherwise substitute each placeholder within the string. Values
+		// within a string literal are escaped and strings outside of one can
+		// only contain word characters so they can't change an expression.
+		buffer := new(bytes.Buffer)
+		var quote byte
+		index := 0
+		for _, loc := range savedQueryParamRegexp.FindAllStringSubmatchIndex(v, -1) {
+			quote = savedQueryQuoteState(v[index:loc[0]], quote)
+			buffer.WriteString(v[index:loc[0]])
+			index = loc[1]
+
+			name := v[loc[2]:loc[3]]
+			param, err := savedQueryParam(params, name)
+			if err != nil {
+				return nil, err
+			}
+			switch param := param.(type) {
+			case string:
+				if quote != 0 {
+					buffer.WriteString(escapeStringLiteral(param))
+				} else if savedQueryWordRegexp.MatchString(param) {
+					buffer.WriteString(param)
+				} else {
+					return nil, fmt.Errorf("skyd.SavedQuery: Invalid parameter: %v", name)
+				}
+			case float64:
+				buffer.WriteString(strconv.FormatFloat(param, 'f', -1, 64))
+			default:
+				fmt.Fprintf(buffer, "%v", param)
+			}
+		}
+		buffer.WriteString(v[index:])
+		return buffer.String(), nil
+
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, item := range v {
+			bound, err := bindSavedQueryValue(item, params)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = bound
+		}
+		return m, nil
+
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			bound, err := bindSavedQueryValue(item, params)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, bound)
+		}
+		return list, nil
+	}
+
+	return value, nil
+}
+
+// Retrieves a parameter value. Only strings, numbers and booleans can be
+// bound.
+func savedQueryParam(params map[string]interface{}, name string) (interface{}, error) {
+	param, ok := params[name]
+	if !ok {
+		return nil, fmt.Errorf("skyd.SavedQuery: Missing parameter: %v", name)
+	}
+	switch param.(type) {
+	case string, float64, bool:
+		return param, nil
+	}
+	return nil, fmt.Errorf("skyd.SavedQuery: Invalid parameter: %v", name)
+}
+
+// Returns the quote character of the string literal that is open after a
+// string, starting from a given quote. Returns zero if no literal is open.
+func savedQueryQuoteState(str string, quote byte) byte {
+	for i := 0; i < len(str); i++ {
+		switch ch := str[i]; {
+		case quote != 0 && ch == '\\':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote == 0 && (ch == '"' || ch == '\''):
+			quote = ch
+		}
+	}
+	return quote
+}
+
+//--------------------------------------
+// Sorting
+//--------------------------------------
+
+type savedQueryList []*SavedQuery
+
+func (l savedQueryList) Len() int           { return len(l) }
+func (l savedQueryList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l savedQueryList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -17,9 +17,24 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The amount of data on disk that a single engine scans before a servlet is
+// split into multiple ranges.
+const DefaultScanRangeSize = 64 * 1024 * 1024
+
+// The maximum number of ranges that each servlet is split into.
+const DefaultMaxScanRanges = 4
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -36,6 +51,12 @@ type Server struct {
 	servlets        []*Servlet
 	tables          map[string]*Table
 	factors         *Factors
+	factorsLock     sync.RWMutex
+	conversions     sync.WaitGroup
+	queryCache      *QueryCache
+	enginePool      *ExecutionEnginePool
+	scanRangeSize   uint64
+	maxScanRanges   int
 	shutdownChannel chan bool
 }
 
@@ -68,11 +89,15 @@ func (e *TextPlainContentTypeError) Error() string {
 func NewServer(port uint, path string) *Server {
 	r := mux.NewRouter()
 	s := &Server{
-		httpServer: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: r},
-		router:     r,
-		logger:     log.New(os.Stdout, "", log.LstdFlags),
-		path:       path,
-		tables:     make(map[string]*Table),
+		httpServer:    &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: r},
+		router:        r,
+		logger:        log.New(os.Stdout, "", log.LstdFlags),
+		path:          path,
+		tables:        make(map[string]*Table),
+		queryCache:    NewQueryCache(DefaultQueryCacheSize, DefaultQueryCacheTTL),
+		enginePool:    NewExecutionEnginePool(DefaultExecutionEnginePoolSize),
+		scanRangeSize: DefaultScanRangeSize,
+		maxScanRanges: DefaultMaxScanRanges,
 	}
 
 	s.router.HandleFunc("/debug/pprof", pprof.Index)
@@ -83,8 +108,10 @@ func NewServer(port uint, path string) *Server {
 	s.addHandlers()
 	s.addTableHandlers()
 	s.addPropertyHandlers()
+	s.addAdminHandlers()
 	s.addEventHandlers()
 	s.addQueryHandlers()
+	s.addSavedQueryHandlers()
 
 	return s
 }
@@ -120,6 +147,16 @@ func (s *Server) FactorsPath() string {
 	return fmt.Sprintf("%v/factors", s.path)
 }
 
+// Retrieves the cache of query results.
+func (s *Server) QueryCache() *QueryCache {
+	return s.queryCache
+}
+
+// Retrieves the pool of idle execution engines.
+func (s *Server) EnginePool() *ExecutionEnginePool {
+	return s.enginePool
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -232,6 +269,12 @@ func (s *Server) open() error {
 
 // Closes the data directory and servlets.
 func (s *Server) close() {
+	// Wait for background factor conversions to finish.
+	s.conversions.Wait()
+
+	// Destroy idle engines.
+	s.enginePool.Purge()
+
 	// Close servlets.
 	if s.servlets != nil {
 		for _, servlet := range s.servlets {
@@ -297,7 +340,9 @@ func (s *Server) ApiHandleFunc(route string, handlerFunction func(http.ResponseW
 
 		// If we're returning plain text then just dump out what's returned.
 		if _, ok := err.(*TextPlainContentTypeError); ok {
-			w.Header().Set("Content-Type", "text/plain")
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", "text/plain")
+			}
 			w.WriteHeader(http.StatusOK)
 			if str, ok := ret.(string); ok {
 				w.Write([]byte(str))
@@ -342,16 +387,57 @@ func (s *Server) ApiHandleFunc(route string, handlerFunction func(http.ResponseW
 
 // Decodes the body of the message into parameters.
 func (s *Server) decodeParams(w http.ResponseWriter, req *http.Request) (map[string]interface{}, error) {
-	// Parses body parameters.
+	// Parses body parameters. Plain text bodies are left for the handler.
 	params := make(map[string]interface{})
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "text/plain") {
+		return params, nil
+	}
 	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
 	err := decoder.Decode(&params)
 	if err != nil && err != io.EOF {
 		return nil, errors.New("Malformed json request.")
 	}
+
+	// Event data keeps integer literals as integers so that data types can be
+	// inferred from them. Every other number is a float.
+	for k, v := range params {
+		if data, ok := v.(map[string]interface{}); ok && k == "data" {
+			for dk, dv := range data {
+				data[dk] = convertJsonNumbers(dv, true)
+			}
+		} else {
+			params[k] = convertJsonNumbers(v, false)
+		}
+	}
+
 	return params, nil
 }
 
+// Converts decoded json.Number values into float64 values. Integer literals
+// are converted to int64 instead if integers is set.
+func convertJsonNumbers(value interface{}, integers bool) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if integers {
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = convertJsonNumbers(item, false)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertJsonNumbers(item, false)
+		}
+	}
+	return value
+}
+
 //--------------------------------------
 // Servlet Management
 //--------------------------------------
@@ -484,22 +570,189 @@ func (s *Server) DeleteTable(name string) error {
 		}
 	}
 
+	// Remove the table's factors so a new table with the same name starts clean.
+	if err := s.factors.DeleteNamespace(table.Name); err != nil {
+		return err
+	}
+
+	// Remove cached results and engines so they aren't used for a new table.
+	s.queryCache.PurgeTable(table.Name)
+	s.enginePool.PurgeTable(table.Name)
+
 	// Remove the table from the lookup and remove it's schema.
 	delete(s.tables, name)
 	return table.Delete()
 }
 
+//--------------------------------------
+// Factor Management
+//--------------------------------------
+
+// Removes factor values that are no longer referenced by any stored event or
+// object state. Ingestion is blocked while the collection runs. Returns the
+// number of factors that were removed.
+func (s *Server) CollectFactors() (int, error) {
+	s.factorsLock.Lock()
+	defer s.factorsLock.Unlock()
+
+	tables, err := s.GetAllTables()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, t := range tables {
+		table, err := s.OpenTable(t.Name)
+		if err != nil {
+			return count, err
+		}
+
+		// Find the factor properties on the table.
+		properties, err := table.GetProperties()
+		if err != nil {
+			return count, err
+		}
+		refs := make(map[int64]map[uint64]bool)
+		for _, property := range properties {
+			if property.DataType == FactorDataType {
+				refs[property.Id] = make(map[uint64]bool)
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+
+		// Mark every factor that is referenced.
+		for _, servlet := range s.servlets {
+			err = servlet.EachEvent(table, func(event *Event) error {
+				for k, v := range event.Data {
+					if m := refs[k]; m != nil {
+						if sequence, ok := normalize(v).(int64); ok {
+							m[uint64(sequence)] = true
+						}
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return count, err
+			}
+		}
+
+		// Sweep the factors that were not marked.
+		for _, property := range properties {
+			m := refs[property.Id]
+			if m == nil {
+				continue
+			}
+			factors, _, err := s.factors.Find(table.Name, property.Name, "", 0, 0)
+			if err != nil {
+				return count, err
+			}
+			for _, factor := range factors {
+				if !m[factor.Id] {
+					if err = s.factors.Delete(table.Name, property.Name, factor); err != nil {
+						return count, err
+					}
+					count++
+				}
+			}
+		}
+	}
+
+	return count, nil
+}
+
 //--------------------------------------
 // Query
 //--------------------------------------
 
-// Runs a query against a table.
-func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
+// Generates the key used to cache the results of a query. The key includes
+// the generated source, the serialized query for options that are applied
+// outside of Lua and the table's data version at the time of the query.
+func (s *Server) QueryCacheKey(table *Table, query *Query) (string, error) {
+	source, err := query.Codegen()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(query.Serialize())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\n%d\n%s\n%s", table.Name, table.Version(), b, source), nil
+}
+
+// Validates a query and describes how it would be executed without running
+// it. The Lua source is compiled in an execution engine to find any errors
+// that are not caught during code generation. The scan size is the
+// approximate size of the table on disk across all servlets.
+func (s *Server) ExplainQuery(table *Table, obj map[string]interface{}) (map[string]interface{}, []error) {
+	query := NewQuery(table, s.factors)
+	if errs := query.Validate(obj); len(errs) > 0 {
+		return nil, errs
+	}
+
+	// Generate and compile the source.
+	source, err := query.Codegen()
+	if err != nil {
+		return nil, []error{err}
+	}
+	engine, err := s.enginePool.Get(table, source)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer s.enginePool.Put(engine)
+
+	// Estimate the amount of data that will be scanned.
+	var scanSize uint64
+	for _, servlet := range s.servlets {
+		size, err := servlet.ApproximateSize(table)
+		if err != nil {
+			return nil, []error{err}
+		}
+		scanSize += size
+	}
+
+	plan := query.Serialize()
+	plan["properties"] = engine.propertyRefs
+	plan["factors"] = query.FactorLiterals()
+	plan["scanSize"] = scanSize
+	return plan, nil
+}
+
+// Splits a servlet's data for a table into ranges that are scanned in
+// parallel. Each range holds about the scan range size on disk.
+func (s *Server) scanRanges(servlet *Servlet, table *Table) ([]levigo.Range, error) {
+	size, err := servlet.ApproximateSize(table)
+	if err != nil {
+		return nil, err
+	}
+	n := int((size + s.scanRangeSize - 1) / s.scanRangeSize)
+	if n > s.maxScanRanges {
+		n = s.maxScanRanges
+	}
+	return servlet.SplitRanges(table, n)
+}
+
+// Runs a query against a table. Each servlet is split into ranges that are
+// scanned in parallel by separate engines and the results are merged.
+// Engines are taken from the pool and are returned to it once the query
+// succeeds.
+func (s *Server) RunQuery(table *Table, query *Query) (result interface{}, err error) {
+	table.dataMutex.RLock()
+	defer table.dataMutex.RUnlock()
+
 	var engine *ExecutionEngine
 	engines := make([]*ExecutionEngine, 0)
-
-	// Create a channel to receive aggregate responses.
-	rchannel := make(chan interface{}, len(s.servlets))
+	defer func() {
+		for _, e := range engines {
+			if err == nil {
+				s.enginePool.Put(e)
+			} else {
+				e.Destroy()
+			}
+		}
+	}()
 
 	// Generate the query source code.
 	source, err := query.Codegen()
@@ -507,37 +760,58 @@ func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
 		return nil, err
 	}
 
-	// Create an engine for merging results.
-	engine, err = NewExecutionEngine(table, source)
+	// Parse the object filter.
+	filter, err := query.ObjectFilter()
 	if err != nil {
 		return nil, err
 	}
-	defer engine.Destroy()
+
+	// Retrieve an engine for merging results.
+	engine, err = s.enginePool.Get(table, source)
+	if err != nil {
+		return nil, err
+	}
+	engines = append(engines, engine)
 	//fmt.Println(engine.FullAnnotatedSource())
 
-	// Initialize one execution engine for each servlet.
+	// Initialize one execution engine for each range of each servlet.
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	scanEngines := make([]*ExecutionEngine, 0)
 	for _, servlet := range s.servlets {
-		// Create an engine for each servlet.
-		e, err := NewExecutionEngine(table, source)
+		ranges, err := s.scanRanges(servlet, table)
 		if err != nil {
 			return nil, err
 		}
-
-		// Initialize iterator.
-		ro := levigo.NewReadOptions()
-		iterator := servlet.db.NewIterator(ro)
-		err = e.SetIterator(iterator)
-		if err != nil {
-			return nil, err
+		for _, r := range ranges {
+			// Retrieve an engine for each range.
+			e, err := s.enginePool.Get(table, source)
+			if err != nil {
+				return nil, err
+			}
+			engines = append(engines, e)
+			scanEngines = append(scanEngines, e)
+			e.SetRange(query.Start, query.End)
+			e.SetFilter(filter)
+			e.SetSample(query.Sample)
+			e.SetKeyRange(r.Start, r.Limit)
+
+			// Initialize iterator.
+			iterator := servlet.db.NewIterator(ro)
+			err = e.SetIterator(iterator)
+			if err != nil {
+				return nil, err
+			}
 		}
-
-		engines = append(engines, e)
 	}
 
-	// Execute servlets asynchronously and retrieve responses outside
+	// Create a channel to receive aggregate responses.
+	rchannel := make(chan interface{}, len(scanEngines))
+
+	// Execute ranges asynchronously and retrieve responses outside
 	// of the server context.
-	for index, _ := range s.servlets {
-		e := engines[index]
+	for _, e := range scanEngines {
+		e := e
 		go func() {
 			if result, err := e.Aggregate(); err != nil {
 				rchannel <- err
@@ -547,20 +821,21 @@ func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
 		}()
 	}
 
-	// Wait for each servlet to complete and then merge the results.
+	// Wait for each range to complete and then merge the results.
 	var servletError error
-	var result interface{}
 	result = make(map[interface{}]interface{})
-	for i := 0; i < len(s.servlets); i++ {
+	for i := 0; i < len(scanEngines); i++ {
 		ret := <-rchannel
 		if err, ok := ret.(error); ok {
 			fmt.Printf("skyd.Server: Aggregate error: %v", err)
 			servletError = err
 		} else {
-			// Defactorize aggregate results.
+			// Defactorize aggregate results. Keep waiting on the other
+			// servlets so their engines aren't destroyed while running.
 			err = query.Defactorize(ret)
 			if err != nil {
-				return nil, err
+				servletError = err
+				continue
 			}
 
 			// Merge results.
@@ -575,10 +850,9 @@ func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
 	}
 	err = servletError
 
-	// Clean up engines.
-	// TODO: Defer clean up earlier on in case of failure.
-	for _, e := range engines {
-		e.Destroy()
+	// Finalize the merged results.
+	if err == nil {
+		err = query.Finalize(result)
 	}
 
 	return result, err
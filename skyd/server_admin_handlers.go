@@ -0,0 +1,53 @@
+package skyd
+
+import (
+	"net/http"
+)
+
+func (s *Server) addAdminHandlers() {
+	s.ApiHandleFunc("/admin/factors/gc", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.collectFactorsHandler(w, req, params)
+	}).Methods("POST")
+	s.ApiHandleFunc("/admin/factors/stats", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.factorStatsHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/admin/queries/purge", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.purgeQueryCacheHandler(w, req, params)
+	}).Methods("POST")
+	s.ApiHandleFunc("/admin/queries/stats", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.queryCacheStatsHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/admin/engines/stats", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.enginePoolStatsHandler(w, req, params)
+	}).Methods("GET")
+}
+
+// POST /admin/factors/gc
+func (s *Server) collectFactorsHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	count, err := s.CollectFactors()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"deleted": count}, nil
+}
+
+// GET /admin/factors/stats
+func (s *Server) factorStatsHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	return s.factors.Stats(), nil
+}
+
+// POST /admin/queries/purge
+func (s *Server) purgeQueryCacheHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	s.queryCache.Purge()
+	return nil, nil
+}
+
+// GET /admin/queries/stats
+func (s *Server) queryCacheStatsHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	return s.queryCache.Stats(), nil
+}
+
+// GET /admin/engines/stats
+func (s *Server) enginePoolStatsHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	return s.enginePool.Stats(), nil
+}
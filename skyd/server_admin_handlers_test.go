@@ -0,0 +1,46 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that unreferenced factors are removed by the collector.
+func TestServerCollectFactors(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"fruit":"pear"}}`},
+		})
+		resp, _ := sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo/objects/a1/events/2012-01-01T00:00:00Z", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name/objects/:objectId/events/:timestamp failed.")
+
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/admin/factors/gc", "application/json", "")
+		assertResponse(t, resp, 200, `{"deleted":1}`+"\n", "POST /admin/factors/gc failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/fruit/factors", "application/json", "")
+		assertResponse(t, resp, 200, `{"cardinality":2,"count":2,"factors":[{"id":1,"value":"apple"},{"id":3,"value":"pear"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+	})
+}
+
+// Ensure that factors are removed when a table is deleted.
+func TestServerDeleteTableFactors(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+		})
+		resp, _ := sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name failed.")
+
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+		})
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/fruit/factors", "application/json", "")
+		assertResponse(t, resp, 200, `{"cardinality":1,"count":1,"factors":[{"id":1,"value":"grape"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+	})
+}
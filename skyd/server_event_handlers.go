@@ -46,11 +46,11 @@ func (s *Server) getEventsHandler(w http.ResponseWriter, req *http.Request, para
 	// Denormalize events.
 	output := make([]map[string]interface{}, 0)
 	for _, event := range events {
-		e, err := table.SerializeEvent(event)
+		err = table.DefactorizeEvent(event, s.factors)
 		if err != nil {
 			return nil, err
 		}
-		err = table.DefactorizeEvent(event, s.factors)
+		e, err := table.SerializeEvent(event)
 		if err != nil {
 			return nil, err
 		}
@@ -96,56 +96,152 @@ func (s *Server) getEventHandler(w http.ResponseWriter, req *http.Request, param
 	}
 
 	// Convert an event to a serializable object.
-	e, err := table.SerializeEvent(event)
-	if err != nil {
-		return nil, err
-	}
 	err = table.DefactorizeEvent(event, s.factors)
 	if err != nil {
 		return nil, err
 	}
-	return e, nil
+	return table.SerializeEvent(event)
 }
 
 // PUT /tables/:name/objects/:objectId/events/:timestamp
 func (s *Server) replaceEventHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (ret interface{}, err error) {
+	return s.putEvent(req, params, true)
+}
+
+// PATCH /tables/:name/objects/:objectId/events/:timestamp
+func (s *Server) updateEventHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (ret interface{}, err error) {
+	return s.putEvent(req, params, false)
+}
+
+// Deserializes an event from the request and either replaces or merges it
+// into the object's existing event at the same timestamp. Inferred string
+// properties are converted to factors in the background once their samples
+// are complete.
+func (s *Server) putEvent(req *http.Request, params map[string]interface{}, replace bool) (interface{}, error) {
 	vars := mux.Vars(req)
 	table, servlet, err := s.GetObjectContext(vars["name"], vars["objectId"])
 	if err != nil {
 		return nil, err
 	}
 
-	params["timestamp"] = vars["timestamp"]
-	event, err := table.DeserializeEvent(params)
+	inferred, ready, err := s.writeEvent(table, servlet, vars["objectId"], vars["timestamp"], params, replace)
 	if err != nil {
 		return nil, err
 	}
-	err = table.FactorizeEvent(event, s.factors, true)
-	if err != nil {
-		return nil, err
+	if ready {
+		s.conversions.Add(1)
+		go func() {
+			defer s.conversions.Done()
+			if err := s.convertInferredFactors(table); err != nil {
+				s.logger.Printf("ERROR Unable to convert inferred factors: %v", err)
+			}
+		}()
 	}
 
-	return nil, servlet.PutEvent(table, vars["objectId"], event, true)
+	// Report any properties that were added to the schema.
+	if len(inferred) > 0 {
+		return map[string]interface{}{"inferred": inferred}, nil
+	}
+	return nil, nil
 }
 
-// PATCH /tables/:name/objects/:objectId/events/:timestamp
-func (s *Server) updateEventHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (ret interface{}, err error) {
-	vars := mux.Vars(req)
-	table, servlet, err := s.GetObjectContext(vars["name"], vars["objectId"])
-	if err != nil {
-		return nil, err
+// Validates and stores a single event. Any unknown keys are only added to
+// the schema once the rest of the event is known to be valid. Returns the
+// inferred properties and whether an inferred string sample is complete.
+func (s *Server) writeEvent(table *Table, servlet *Servlet, objectId string, timestamp string, params map[string]interface{}, replace bool) ([]*Property, bool, error) {
+	table.dataMutex.RLock()
+	defer table.dataMutex.RUnlock()
+
+	// Split out any keys that need to be created if the table allows it.
+	data, _ := params["data"].(map[string]interface{})
+	data, unknown := table.SplitUnknownKeys(data)
+	if unknown != nil {
+		params["data"] = data
 	}
 
-	params["timestamp"] = vars["timestamp"]
+	params["timestamp"] = timestamp
 	event, err := table.DeserializeEvent(params)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	// Hold the factors lock until the event is stored so that a factor
+	// collection cannot remove a value that is about to be referenced. The
+	// servlet is locked as well so the constraints are checked against the
+	// same events that the new event is written into.
+	s.factorsLock.RLock()
+	defer s.factorsLock.RUnlock()
+	servlet.Lock()
+	defer servlet.Unlock()
+
+	// Apply required and default values. A merge into an existing event only
+	// needs to satisfy the constraints on the values being changed. The
+	// object is only read if the table has constraints.
+	if table.HasConstraints() {
+		var existing, state *Event
+		if !replace {
+			existing, err = servlet.GetEvent(table, objectId, event.Timestamp)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		if existing == nil {
+			if state, _, err = servlet.GetState(table, objectId); err != nil {
+				return nil, false, err
+			}
+			if err = table.ApplyConstraints(event, state); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	// Create any missing properties now that the event is valid.
+	inferred, err := table.InferProperties(event, unknown)
+	if err != nil {
+		return nil, false, err
 	}
+
+	// New factors are written before the event that references them.
 	err = table.FactorizeEvent(event, s.factors, true)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if err = s.factors.Flush(); err != nil {
+		return nil, false, err
+	}
+	err = servlet.putEvent(table, objectId, event, replace)
+	if err != nil {
+		return nil, false, err
 	}
-	return nil, servlet.PutEvent(table, vars["objectId"], event, false)
+
+	ready, err := table.SampleInferredStrings(objectId, event)
+	if err != nil {
+		return nil, false, err
+	}
+	return inferred, ready, nil
+}
+
+// Converts inferred string properties with complete samples to factors and
+// rewrites the values already stored for them. Writes and queries on the
+// table are blocked during the conversion.
+func (s *Server) convertInferredFactors(table *Table) error {
+	table.dataMutex.Lock()
+	defer table.dataMutex.Unlock()
+	s.factorsLock.RLock()
+	defer s.factorsLock.RUnlock()
+
+	return table.ConvertInferredFactors(func(property *Property, objectIds []string) error {
+		for _, objectId := range objectIds {
+			_, servlet, err := s.GetObjectContext(table.Name, objectId)
+			if err != nil {
+				return err
+			}
+			if err = servlet.FactorizeProperty(table, objectId, property, s.factors); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // DELETE /tables/:name/objects/:objectId/events/:timestamp
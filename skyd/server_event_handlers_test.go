@@ -1,7 +1,9 @@
 package skyd
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 // Ensure that we can put an event on the server.
@@ -35,6 +37,21 @@ func TestServerUpdateEvents(t *testing.T) {
 	})
 }
 
+// Ensure that factor values are returned as strings.
+func TestServerFactorEvents(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		resp, _ := sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"action":"signup"}}`)
+		assertResponse(t, resp, 200, "", "PUT /tables/:name/objects/:objectId/events failed.")
+
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/objects/xyz/events", "application/json", "")
+		assertResponse(t, resp, 200, `[{"data":{"action":"signup"},"timestamp":"2012-01-01T02:00:00Z"}]`+"\n", "GET /tables/:name/objects/:objectId/events failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", "")
+		assertResponse(t, resp, 200, `{"data":{"action":"signup"},"timestamp":"2012-01-01T02:00:00Z"}`+"\n", "GET /tables/:name/objects/:objectId/events/:timestamp failed.")
+	})
+}
+
 // Ensure that we can delete all events for an object.
 func TestServerDeleteEvent(t *testing.T) {
 	runTestServer(func(s *Server) {
@@ -78,3 +95,129 @@ func TestServerDeleteEvents(t *testing.T) {
 		assertResponse(t, resp, 200, "[]\n", "GET /tables/:name/objects/:objectId/events failed.")
 	})
 }
+
+// Ensure that unknown properties are created when a table is in auto schema mode.
+func TestServerAutoSchemaEvents(t *testing.T) {
+	runTestServer(func(s *Server) {
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables", "application/json", `{"name":"foo", "autoSchema":true, "autoSchemaTransient":true}`)
+		assertResponse(t, resp, 200, `{"name":"foo","autoSchema":true,"autoSchemaTransient":true}`+"\n", "POST /tables failed.")
+		setupTestProperty("foo", "bar", false, "string")
+
+		// Send an event with unknown keys.
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"bar":"myValue", "action":"signup", "price":10.5, "ratio":10.0, "count":3, "member":true}}`)
+		assertResponse(t, resp, 200, `{"inferred":[{"id":-1,"name":"action","transient":true,"dataType":"string"},{"id":-2,"name":"count","transient":true,"dataType":"integer"},{"id":-3,"name":"member","transient":true,"dataType":"boolean"},{"id":-4,"name":"price","transient":true,"dataType":"float"},{"id":-5,"name":"ratio","transient":true,"dataType":"float"}]}`+"\n", "PUT /tables/:name/objects/:objectId/events failed.")
+
+		// Known keys should not be reported again.
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T03:00:00Z", "application/json", `{"data":{"action":"login", "ratio":10.5}}`)
+		assertResponse(t, resp, 200, "", "PUT /tables/:name/objects/:objectId/events failed.")
+
+		// Check our work.
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/objects/xyz/events", "application/json", "")
+		assertResponse(t, resp, 200, `[{"data":{"action":"signup","bar":"myValue","count":3,"member":true,"price":10.5,"ratio":10},"timestamp":"2012-01-01T02:00:00Z"},{"data":{"action":"login","ratio":10.5},"timestamp":"2012-01-01T03:00:00Z"}]`+"\n", "GET /tables/:name/objects/:objectId/events failed.")
+	})
+}
+
+// Ensure that properties are not inferred for events that are rejected.
+func TestServerAutoSchemaInvalidEvent(t *testing.T) {
+	runTestServer(func(s *Server) {
+		sendTestHttpRequest("POST", "http://localhost:8586/tables", "application/json", `{"name":"foo", "autoSchema":true}`)
+		setupTestProperty("foo", "bar", false, "integer")
+
+		resp, _ := sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"bar":"abc", "action":"signup"}}`)
+		assertResponse(t, resp, 500, `{"message":"Invalid integer value for property 'bar': \"abc\""}`+"\n", "PUT /tables/:name/objects/:objectId/events failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties", "application/json", "")
+		assertResponse(t, resp, 200, `[{"id":1,"name":"bar","transient":false,"dataType":"integer"}]`+"\n", "GET /tables/:name/properties failed.")
+	})
+}
+
+// Ensure that inferred strings with a low cardinality are converted to factors.
+func TestServerAutoSchemaFactors(t *testing.T) {
+	runTestServer(func(s *Server) {
+		sendTestHttpRequest("POST", "http://localhost:8586/tables", "application/json", `{"name":"foo", "autoSchema":true, "autoSchemaTransient":true}`)
+
+		actions := []string{"signup", "login"}
+		for i := 0; i < InferredFactorSampleSize; i++ {
+			timestamp := time.Unix(1325376000+int64(i), 0).UTC().Format(time.RFC3339)
+			body := fmt.Sprintf(`{"data":{"action":"%s", "token":"t%d"}}`, actions[i%2], i)
+			resp, _ := sendTestHttpRequest("PUT", fmt.Sprintf("http://localhost:8586/tables/foo/objects/o%d/events/%s", i%10, timestamp), "application/json", body)
+			if resp.StatusCode != 200 {
+				t.Fatalf("Expected 200, got %v.", resp.StatusCode)
+			}
+			resp.Body.Close()
+		}
+		s.conversions.Wait()
+
+		// Only the low cardinality property is converted.
+		resp, _ := sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties", "application/json", "")
+		assertResponse(t, resp, 200, `[{"id":-2,"name":"token","transient":true,"dataType":"string"},{"id":-1,"name":"action","transient":true,"dataType":"factor"}]`+"\n", "GET /tables/:name/properties failed.")
+
+		// Values written before the conversion are stored as factors.
+		query := `{"steps":[{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"login":{"count":50},"signup":{"count":50}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that unknown properties are rejected when a table is not in auto schema mode.
+func TestServerStrictSchemaEvents(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		resp, _ := sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"action":"signup"}}`)
+		if resp.StatusCode != 500 {
+			t.Fatalf("Expected 500, got %v.", resp.StatusCode)
+		}
+		resp.Body.Close()
+	})
+}
+
+// Ensure that event values are validated and optionally coerced to their property's data type.
+func TestServerCoerceEvents(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "bar", false, "string")
+		setupTestProperty("foo", "baz", true, "integer")
+
+		// Send an invalid value.
+		resp, _ := sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"bar":12, "baz":"100"}}`)
+		if resp.StatusCode != 500 {
+			t.Fatalf("Expected 500, got %v.", resp.StatusCode)
+		}
+		resp.Body.Close()
+
+		// Turn on coercion and send it again.
+		resp, _ = sendTestHttpRequest("PATCH", "http://localhost:8586/tables/foo", "application/json", `{"coerceTypes":true}`)
+		assertResponse(t, resp, 200, `{"name":"foo","coerceTypes":true}`+"\n", "PATCH /tables/:name failed.")
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"bar":12, "baz":"100"}}`)
+		assertResponse(t, resp, 200, "", "PUT /tables/:name/objects/:objectId/events failed.")
+
+		// Check our work.
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/objects/xyz/events", "application/json", "")
+		assertResponse(t, resp, 200, `[{"data":{"bar":"12","baz":100},"timestamp":"2012-01-01T02:00:00Z"}]`+"\n", "GET /tables/:name/objects/:objectId/events failed.")
+	})
+}
+
+// Ensure that property constraints are enforced on events.
+func TestServerEventConstraints(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"action", "transient":true, "dataType":"string", "required":true, "enum":["signup","login"]}`)
+		sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"price", "transient":true, "dataType":"float", "default":0, "min":0}`)
+
+		// Missing required values and invalid values are rejected.
+		resp, _ := sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"price":10}}`)
+		assertResponse(t, resp, 500, `{"message":"Property required: action"}`+"\n", "PUT /tables/:name/objects/:objectId/events failed.")
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"action":"logout", "price":-1}}`)
+		assertResponse(t, resp, 500, `{"message":"Value for property 'action' must be one of [signup login]: \"logout\"; Value for property 'price' must be at least 0: -1"}`+"\n", "PUT /tables/:name/objects/:objectId/events failed.")
+
+		// Defaults are filled in.
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"action":"signup"}}`)
+		assertResponse(t, resp, 200, "", "PUT /tables/:name/objects/:objectId/events failed.")
+
+		// Merges only validate the changed values.
+		resp, _ = sendTestHttpRequest("PATCH", "http://localhost:8586/tables/foo/objects/xyz/events/2012-01-01T02:00:00Z", "application/json", `{"data":{"price":20}}`)
+		assertResponse(t, resp, 200, "", "PATCH /tables/:name/objects/:objectId/events failed.")
+
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/objects/xyz/events", "application/json", "")
+		assertResponse(t, resp, 200, `[{"data":{"action":"signup","price":20},"timestamp":"2012-01-01T02:00:00Z"}]`+"\n", "GET /tables/:name/objects/:objectId/events failed.")
+	})
+}
@@ -2,8 +2,10 @@ package skyd
 
 import (
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strconv"
 )
 
 func (s *Server) addPropertyHandlers() {
@@ -23,6 +25,10 @@ func (s *Server) addPropertyHandlers() {
 	s.ApiHandleFunc("/tables/{name}/properties/{propertyName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.deletePropertyHandler(w, req, params)
 	}).Methods("DELETE")
+
+	s.ApiHandleFunc("/tables/{name}/properties/{propertyName}/factors", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getPropertyFactorsHandler(w, req, params)
+	}).Methods("GET")
 }
 
 // GET /tables/:name/properties
@@ -48,7 +54,21 @@ func (s *Server) createPropertyHandler(w http.ResponseWriter, req *http.Request,
 	name, _ := params["name"].(string)
 	transient, _ := params["transient"].(bool)
 	dataType, _ := params["dataType"].(string)
-	return table.CreateProperty(name, transient, dataType)
+	property, err := NewProperty(0, name, transient, dataType)
+	if err != nil {
+		return nil, err
+	}
+	property.Expression, _ = params["expression"].(string)
+	err = property.DeserializeConstraints(params)
+	if err != nil {
+		return nil, err
+	}
+	err = table.AddProperty(property)
+	if err != nil {
+		return nil, err
+	}
+
+	return property, nil
 }
 
 // GET /tables/:name/properties/:propertyName
@@ -79,15 +99,21 @@ func (s *Server) updatePropertyHandler(w http.ResponseWriter, req *http.Request,
 		return nil, errors.New("Property does not exist.")
 	}
 
-	// Update property and save property file.
-	name, _ := params["name"].(string)
-	property.Name = name
-	err = table.SavePropertyFile()
+	// Update constraints on a copy so a failure leaves the property intact.
+	clone := *property
+	err = clone.DeserializeConstraints(params)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := params["name"].(string); ok {
+		clone.Name = name
+	}
+	err = table.UpdateProperty(property, &clone)
 	if err != nil {
 		return nil, err
 	}
 
-	return property, nil
+	return &clone, nil
 }
 
 // DELETE /tables/:name/properties/:propertyName
@@ -107,11 +133,64 @@ func (s *Server) deletePropertyHandler(w http.ResponseWriter, req *http.Request,
 	}
 
 	// Delete property and save property file.
-	table.DeleteProperty(property)
+	err = table.DeleteProperty(property)
+	if err != nil {
+		return nil, err
+	}
 	err = table.SavePropertyFile()
 	if err != nil {
 		return nil, err
 	}
 
+	// Remove any factors stored for the property.
+	err = s.factors.DeleteId(table.Name, property.Name)
+	if err != nil {
+		return nil, err
+	}
+
 	return nil, nil
 }
+
+// GET /tables/:name/properties/:propertyName/factors
+func (s *Server) getPropertyFactorsHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+	property, err := table.GetPropertyByName(vars["propertyName"])
+	if err != nil {
+		return nil, err
+	}
+	if property == nil {
+		return nil, errors.New("Property does not exist.")
+	}
+	if property.DataType != FactorDataType {
+		return nil, fmt.Errorf("Property is not a factor: %v", property.Name)
+	}
+
+	// Read paging options from the query string.
+	query := req.URL.Query()
+	offset, limit := 0, DefaultFactorLimit
+	if str := query.Get("offset"); str != "" {
+		if offset, err = strconv.Atoi(str); err != nil || offset < 0 {
+			return nil, fmt.Errorf("Invalid offset: %v", str)
+		}
+	}
+	if str := query.Get("limit"); str != "" {
+		if limit, err = strconv.Atoi(str); err != nil || limit < 0 {
+			return nil, fmt.Errorf("Invalid limit: %v", str)
+		}
+	}
+
+	cardinality, err := s.factors.Cardinality(table.Name, property.Name)
+	if err != nil {
+		return nil, err
+	}
+	factors, count, err := s.factors.Find(table.Name, property.Name, query.Get("prefix"), offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"cardinality": cardinality, "count": count, "factors": factors}, nil
+}
@@ -58,3 +58,41 @@ func TestServerDeleteProperty(t *testing.T) {
 		assertResponse(t, resp, 200, `[{"id":-1,"name":"baz","transient":true,"dataType":"integer"}]`+"\n", "GET /tables/:name/properties after delete failed.")
 	})
 }
+
+// Ensure that we can create a property with constraints through the server.
+func TestServerCreatePropertyWithConstraints(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"bar", "transient":true, "dataType":"integer", "required":true, "default":5, "enum":[1,5,10], "min":1, "max":10}`)
+		assertResponse(t, resp, 200, `{"id":-1,"name":"bar","transient":true,"dataType":"integer","required":true,"default":5,"enum":[1,5,10],"min":1,"max":10}`+"\n", "POST /tables/:name/properties failed.")
+
+		// Defaults must satisfy the other constraints.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"baz", "transient":true, "dataType":"integer", "default":20, "max":10}`)
+		assertResponse(t, resp, 500, `{"message":"Invalid 'default': Value for property 'baz' must be at most 10: 20"}`+"\n", "POST /tables/:name/properties failed.")
+
+		// Remove constraints.
+		resp, _ = sendTestHttpRequest("PATCH", "http://localhost:8586/tables/foo/properties/bar", "application/json", `{"default":null, "enum":null, "min":null}`)
+		assertResponse(t, resp, 200, `{"id":-1,"name":"bar","transient":true,"dataType":"integer","required":true,"max":10}`+"\n", "PATCH /tables/:name/properties/:propertyName failed.")
+	})
+}
+
+// Ensure that we can list the factors for a property.
+func TestServerPropertyFactors(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", false, "factor")
+		setupTestProperty("foo", "price", false, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apricot"}}`},
+			[]string{"a3", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+		})
+		resp, _ := sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/fruit/factors", "application/json", "")
+		assertResponse(t, resp, 200, `{"cardinality":3,"count":3,"factors":[{"id":2,"value":"apple"},{"id":3,"value":"apricot"},{"id":1,"value":"grape"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/fruit/factors?prefix=ap&offset=1&limit=1", "application/json", "")
+		assertResponse(t, resp, 200, `{"cardinality":3,"count":2,"factors":[{"id":3,"value":"apricot"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/price/factors", "application/json", "")
+		assertResponse(t, resp, 500, `{"message":"Property is not a factor: price"}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+	})
+}
@@ -1,8 +1,15 @@
 package skyd
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func (s *Server) addQueryHandlers() {
@@ -15,6 +22,12 @@ func (s *Server) addQueryHandlers() {
 	s.ApiHandleFunc("/tables/{name}/query/codegen", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.queryCodegenHandler(w, req, params)
 	}).Methods("POST")
+	s.ApiHandleFunc("/tables/{name}/query/text", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.queryTextHandler(w, req, params)
+	}).Methods("POST")
+	s.ApiHandleFunc("/tables/{name}/query/explain", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.queryExplainHandler(w, req, params)
+	}).Methods("POST")
 }
 
 // GET /tables/:name/stats
@@ -46,14 +59,131 @@ func (s *Server) queryHandler(w http.ResponseWriter, req *http.Request, params m
 		return nil, err
 	}
 
-	// Deserialize the query.
+	// Deserialize the query from JSON or from text.
 	query := NewQuery(table, s.factors)
-	err = query.Deserialize(params)
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "text/plain") {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = query.DeserializeText(string(body))
+	} else {
+		err = query.Deserialize(params)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return s.RunQuery(table, query)
+	return s.executeQuery(w, req, table, query)
+}
+
+// Runs a deserialized query and encodes the results in the format requested
+// by the "format" query parameter. Results are cached until the table is
+// written to unless the "cache" query parameter is "false".
+func (s *Server) executeQuery(w http.ResponseWriter, req *http.Request, table *Table, query *Query) (interface{}, error) {
+	var err error
+
+	// Validate the result format.
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "", "json", "rows", "csv":
+	default:
+		return nil, fmt.Errorf("Invalid format: %v", format)
+	}
+
+	// Report the sampling rate since counts and sums are estimates. The rate
+	// is also added to the results below.
+	if query.IsSampled() {
+		w.Header().Set("X-Sky-Sample-Rate", strconv.FormatFloat(query.Sample, 'f', -1, 64))
+	}
+
+	// Use cached results unless the cache is bypassed. The key is generated
+	// before the query runs so that writes during the query invalidate it.
+	var result interface{}
+	if req.URL.Query().Get("cache") == "false" {
+		w.Header().Set("X-Sky-Cache", "BYPASS")
+		if result, err = s.RunQuery(table, query); err != nil {
+			return nil, err
+		}
+	} else {
+		key, err := s.QueryCacheKey(table, query)
+		if err != nil {
+			return nil, err
+		}
+		if cached, ok := s.queryCache.Get(key); ok {
+			w.Header().Set("X-Sky-Cache", "HIT")
+			result = cached
+		} else {
+			w.Header().Set("X-Sky-Cache", "MISS")
+			if result, err = s.RunQuery(table, query); err != nil {
+				return nil, err
+			}
+			s.queryCache.Put(table.Name, key, result)
+		}
+	}
+
+	// Flatten the selections if requested.
+	switch format {
+	case "rows":
+		return query.Rows(result), nil
+	case "csv":
+		str, err := encodeRowsCSV(query.Columns(), query.Rows(result))
+		if err != nil {
+			return nil, err
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		return str, &TextPlainContentTypeError{}
+	}
+
+	// Add the sampling rate to a copy so the cached results aren't changed.
+	if m, ok := result.(map[interface{}]interface{}); ok && query.IsSampled() {
+		annotated := make(map[interface{}]interface{}, len(m)+1)
+		for k, v := range m {
+			annotated[k] = v
+		}
+		annotated["sampleRate"] = query.Sample
+		result = annotated
+	}
+	return result, nil
+}
+
+// Encodes rows as CSV with a header line. Numbers and booleans are written
+// as literals, missing values are left blank and any other values are
+// encoded as JSON.
+func encodeRowsCSV(columns []string, rows []map[string]interface{}) (string, error) {
+	buffer := new(bytes.Buffer)
+	writer := csv.NewWriter(buffer)
+	if err := writer.Write(columns); err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		record := make([]string, 0, len(columns))
+		for _, column := range columns {
+			switch v := normalize(row[column]).(type) {
+			case nil:
+				record = append(record, "")
+			case string:
+				record = append(record, v)
+			case int64:
+				record = append(record, strconv.FormatInt(v, 10))
+			case float64:
+				record = append(record, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				record = append(record, strconv.FormatBool(v))
+			default:
+				b, err := json.Marshal(ConvertToStringKeys(v))
+				if err != nil {
+					return "", err
+				}
+				record = append(record, string(b))
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	return buffer.String(), writer.Error()
 }
 
 // POST /tables/:name/query/codegen
@@ -81,3 +211,44 @@ func (s *Server) queryCodegenHandler(w http.ResponseWriter, req *http.Request, p
 
 	return source, &TextPlainContentTypeError{}
 }
+
+// POST /tables/:name/query/text
+func (s *Server) queryTextHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Deserialize the query and write it back out as text.
+	query := NewQuery(table, s.factors)
+	if err = query.Deserialize(params); err != nil {
+		return nil, err
+	}
+	text, err := query.SerializeText()
+	if err != nil {
+		return nil, err
+	}
+	return text, &TextPlainContentTypeError{}
+}
+
+// POST /tables/:name/query/explain
+func (s *Server) queryExplainHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Invalid queries return every error instead of failing on the first.
+	plan, errs := s.ExplainQuery(table, params)
+	if len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return map[string]interface{}{"valid": false, "errors": messages}, nil
+	}
+	plan["valid"] = true
+	return plan, nil
+}
@@ -1,6 +1,10 @@
 package skyd
 
 import (
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -166,3 +170,901 @@ func TestServerSessionizedFunnelAnalysisQuery(t *testing.T) {
 		assertResponse(t, resp, 200, `{"action":{"A1":{"count":1}}}`+"\n", "POST /tables/:name/query failed.")
 	})
 }
+
+// Ensure that computed properties can be used in conditions and selections.
+func TestServerComputedPropertyQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", false, "factor")
+		setupTestProperty("foo", "price", false, "float")
+		setupTestProperty("foo", "quantity", false, "integer")
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"revenue", "dataType":"float", "expression":"price * quantity"}`)
+		assertResponse(t, resp, 200, `{"id":-1,"name":"revenue","transient":true,"dataType":"float","expression":"price * quantity"}`+"\n", "POST /tables/:name/properties failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"citrus", "dataType":"boolean", "expression":"fruit in ['orange', 'lemon']"}`)
+		assertResponse(t, resp, 200, `{"id":-2,"name":"citrus","transient":true,"dataType":"boolean","expression":"fruit in ['orange', 'lemon']"}`+"\n", "POST /tables/:name/properties failed.")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple", "price":2, "quantity":3}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"orange", "price":1.5, "quantity":2}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"fruit":"orange", "price":0.5, "quantity":4}}`},
+		})
+
+		// Run query.
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[{"name":"revenue","expression":"sum(revenue)"}]},
+				{"type":"condition","expression":"citrus == true","within":[0,0],"withinUnits":"steps","steps":[
+					{"type":"selection","name":"citrus","dimensions":[],"fields":[{"name":"revenue","expression":"sum(revenue)"}]}
+				]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"citrus":{"revenue":5},"revenue":11}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that invalid computed properties are rejected.
+func TestServerInvalidComputedProperty(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "price", false, "float")
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"tax", "dataType":"float", "expression":"cost * 0.1"}`)
+		assertResponse(t, resp, 500, `{"message":"skyd.Property: Property not found: cost"}`+"\n", "POST /tables/:name/properties failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"tax", "dataType":"float", "expression":"price * 0.1"}`)
+		assertResponse(t, resp, 200, `{"id":-1,"name":"tax","transient":true,"dataType":"float","expression":"price * 0.1"}`+"\n", "POST /tables/:name/properties failed.")
+		resp, _ = sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo/properties/price", "application/json", "")
+		assertResponse(t, resp, 500, `{"message":"Property is referenced by computed property: tax"}`+"\n", "DELETE /tables/:name/properties/:propertyName failed.")
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/objects/a0/events/2012-01-01T00:00:00Z", "application/json", `{"data":{"tax":1}}`)
+		assertResponse(t, resp, 500, `{"message":"Property is computed: tax"}`+"\n", "PUT /tables/:name/objects/:objectId/events/:timestamp failed.")
+	})
+}
+
+// Ensure that we can perform a funnel analysis with a funnel step.
+func TestServerFunnelStepQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"d0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"d0", "2012-01-01T00:00:01Z", `{"data":{"action":"A1"}}`},
+			[]string{"d0", "2012-01-01T00:00:02Z", `{"data":{"action":"A2"}}`},
+			[]string{"d0", "2012-01-01T12:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"d0", "2012-01-01T13:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"d0", "2012-01-01T14:00:00Z", `{"data":{"action":"A1"}}`},
+			[]string{"e1", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"e1", "2012-01-01T00:00:01Z", `{"data":{"action":"A0"}}`},
+			[]string{"e1", "2012-01-01T00:00:02Z", `{"data":{"action":"A1"}}`},
+			[]string{"e1", "2012-01-02T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"e1", "2012-01-02T00:00:01Z", `{"data":{"action":"A0"}}`},
+			[]string{"e1", "2012-01-02T00:00:02Z", `{"data":{"action":"A0"}}`},
+			[]string{"e1", "2012-01-02T00:00:03Z", `{"data":{"action":"A1"}}`},
+			[]string{"f2", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"f2", "2012-01-01T00:00:01Z", `{"data":{"action":"A2"}}`},
+		})
+
+		// Run query. Each object is only counted once per stage.
+		query := `{
+			"steps":[
+				{"type":"funnel","steps":["action == 'A0'", "action == 'A1'"],"within":[1,2]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"funnel":{"stages":[{"conversionRate":1,"count":3,"expression":"action == 'A0'"},{"conversionRate":0.6666666666666666,"count":2,"expression":"action == 'A1'"}]}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query broken down by a dimension.
+		query = `{
+			"steps":[
+				{"type":"funnel","name":"checkout","dimensions":["action"],"steps":["action == 'A0'", "action == 'A1'"],"within":[1,2]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"checkout":{"action":{"A0":{"stages":[{"conversionRate":1,"count":3,"expression":"action == 'A0'"},{"conversionRate":0.6666666666666666,"count":2,"expression":"action == 'A1'"}]}}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Only steps are supported for the range between stages.
+		query = `{
+			"steps":[
+				{"type":"funnel","steps":["action == 'A0'", "action == 'A1'"],"within":[1,2],"withinUnits":"seconds"}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QueryFunnel: Invalid 'within units': seconds"}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can perform a cohort retention analysis.
+func TestServerCohortQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"o0", "2012-01-01T10:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"o0", "2012-01-01T12:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"o0", "2012-01-02T09:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"o1", "2012-01-01T23:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"o1", "2012-01-03T01:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"o2", "2012-01-02T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"o2", "2012-01-02T05:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"o2", "2012-01-10T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"o3", "2012-01-01T00:00:00Z", `{"data":{"action":"login"}}`},
+		})
+
+		// Run query.
+		query := `{
+			"steps":[
+				{"type":"cohort","expression":"action == 'signup'","returnExpression":"action == 'login'","period":86400,"periods":3}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"cohort":{"2012-01-01T00:00:00Z":{"objects":2,"periods":[{"count":1,"rate":0.5},{"count":1,"rate":0.5},{"count":1,"rate":0.5}]},"2012-01-02T00:00:00Z":{"objects":1,"periods":[{"count":1,"rate":1},{"count":0,"rate":0},{"count":0,"rate":0}]}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run weekly query. Weeks begin on Mondays.
+		query = `{
+			"steps":[
+				{"type":"cohort","expression":"action == 'signup'","returnExpression":"action == 'login'","periods":2}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"cohort":{"2011-12-26T00:00:00Z":{"objects":2,"periods":[{"count":1,"rate":0.5},{"count":2,"rate":1}]},"2012-01-02T00:00:00Z":{"objects":1,"periods":[{"count":1,"rate":1},{"count":1,"rate":1}]}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with an anchor.
+		query = `{
+			"steps":[
+				{"type":"cohort","expression":"action == 'signup'","returnExpression":"action == 'login'","period":86400,"periods":3,"anchor":"2012-01-01T06:00:00Z"}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"cohort":{"2012-01-01T06:00:00Z":{"objects":3,"periods":[{"count":2,"rate":0.6666666666666666},{"count":2,"rate":0.6666666666666666},{"count":0,"rate":0}]}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query aligned to the query start.
+		query = `{
+			"start":"2012-01-01T06:00:00Z",
+			"steps":[
+				{"type":"cohort","expression":"action == 'signup'","returnExpression":"action == 'login'","period":86400,"periods":3}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"cohort":{"2012-01-01T06:00:00Z":{"objects":3,"periods":[{"count":2,"rate":0.6666666666666666},{"count":2,"rate":0.6666666666666666},{"count":0,"rate":0}]}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Invalid anchor.
+		query = `{"steps":[{"type":"cohort","expression":"action == 'signup'","returnExpression":"action == 'login'","anchor":"yesterday"}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QueryCohort: Invalid anchor: yesterday"}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can perform a path analysis.
+func TestServerPathsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"p0", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"p0", "2012-01-01T00:00:01Z", `{"data":{"action":"cart"}}`},
+			[]string{"p0", "2012-01-01T00:00:02Z", `{"data":{"action":"checkout"}}`},
+			[]string{"p0", "2012-01-01T00:00:03Z", `{"data":{"action":"buy"}}`},
+			[]string{"p1", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"p1", "2012-01-01T00:00:01Z", `{"data":{"action":"cart"}}`},
+			[]string{"p1", "2012-01-01T00:00:02Z", `{"data":{"action":"view"}}`},
+			[]string{"p2", "2012-01-01T00:00:00Z", `{"data":{"action":"cart"}}`},
+			[]string{"p2", "2012-01-01T00:00:01Z", `{"data":{"action":"view"}}`},
+		})
+
+		// Run query.
+		query := `{
+			"steps":[
+				{"type":"paths","expression":"action == 'cart'","property":"action","depth":2}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"paths":{"count":3,"next":{"checkout":{"count":1,"next":{"buy":{"count":1,"next":{}}}},"view":{"count":2,"next":{}}}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with rare branches folded.
+		query = `{
+			"steps":[
+				{"type":"paths","expression":"action == 'cart'","property":"action","depth":2,"limit":1}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"paths":{"count":3,"next":{"view":{"count":2,"next":{}}},"other":1}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can aggregate sessions.
+func TestServerSessionFieldsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"s0", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"s0", "2012-01-01T00:30:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"s0", "2012-01-01T05:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"s1", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+		})
+
+		setupTestTable("bar")
+		setupTestProperty("bar", "action", true, "factor")
+		setupTestData(t, "bar", [][]string{
+			[]string{"s0", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"s0", "2012-01-01T00:01:00Z", `{"data":{"action":"cart"}}`},
+			[]string{"s0", "2012-01-01T00:02:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"s1", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"s1", "2012-01-01T00:01:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"s1", "2012-01-01T05:00:00Z", `{"data":{"action":"home"}}`},
+			[]string{"s2", "2012-01-01T00:00:00Z", `{"data":{"action":"home"}}`},
+			[]string{"s2", "2012-01-01T00:01:00Z", `{"data":{"action":"view"}}`},
+			[]string{"s3", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+		})
+
+		// Run query.
+		query := `{
+			"sessionIdleTime":7200,
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[
+					{"name":"count","expression":"count()"},
+					{"name":"sessions","expression":"session_count()"},
+					{"name":"duration","expression":"session_duration()"},
+					{"name":"events","expression":"session_events()"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":4,"duration":1800,"events":4,"sessions":3}`+"\n", "POST /tables/:name/query failed.")
+
+		// Count the sessions for each first and last value.
+		query = `{
+			"sessionIdleTime":7200,
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[
+					{"name":"entry","expression":"session_first(action)"},
+					{"name":"exit","expression":"session_last(action)"}
+				]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/bar/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"entry":{"home":2,"view":3},"exit":{"buy":2,"home":1,"view":2}}`+"\n", "POST /tables/:name/query failed.")
+
+		// First and last values can't be summarized per object.
+		query = `{"steps":[{"type":"selection","scope":"object","fields":[{"name":"entry","expression":"session_first(action)"}]}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/bar/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QuerySelection: Object scoped selections cannot use session_first(action)"}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can aggregate per-object values across objects.
+func TestServerObjectScopeQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a1", "2012-01-01T00:00:01Z", `{"data":{"action":"buy"}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a2", "2012-01-01T00:00:01Z", `{"data":{"action":"view"}}`},
+			[]string{"a2", "2012-01-01T00:00:02Z", `{"data":{"action":"buy"}}`},
+			[]string{"a3", "2012-01-01T00:00:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"a3", "2012-01-01T00:00:01Z", `{"data":{"action":"buy"}}`},
+		})
+
+		// Run query.
+		query := `{
+			"steps":[
+				{"type":"selection","scope":"object","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":{"avg":2,"histogram":{"1":1,"2":2,"3":1},"max":3,"min":1,"objects":4,"percentiles":{"50":2,"90":3,"99":3}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with dimensions.
+		query = `{
+			"steps":[
+				{"type":"selection","scope":"object","percentiles":[50],"dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"buy":{"count":{"avg":1.3333333333333333,"histogram":{"1":2,"2":1},"max":2,"min":1,"objects":3,"percentiles":{"50":1}}},"view":{"count":{"avg":1.3333333333333333,"histogram":{"1":2,"2":1},"max":2,"min":1,"objects":3,"percentiles":{"50":1}}}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can match when an event does not occur.
+func TestServerAbsentConditionQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			// Purchased after the first two steps but within an hour.
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"a0", "2012-01-01T00:10:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a0", "2012-01-01T00:20:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a0", "2012-01-01T00:30:00Z", `{"data":{"action":"buy"}}`},
+
+			// Purchased immediately.
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"a1", "2012-01-01T00:01:00Z", `{"data":{"action":"buy"}}`},
+
+			// Never purchased.
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+		})
+
+		// Run query.
+		query := `{
+			"steps":[
+				{"type":"condition","expression":"action == 'signup'","steps":[
+					{"type":"condition","expression":"action == 'buy'","absent":true,"within":[1,2],"steps":[
+						{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":2}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with a window in seconds.
+		query = `{
+			"steps":[
+				{"type":"condition","expression":"action == 'signup'","steps":[
+					{"type":"condition","expression":"action == 'buy'","absent":true,"within":[0,3600],"withinUnits":"seconds","steps":[
+						{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that absent conditions don't move the cursor for the steps that
+// follow them and can look ahead a range of sessions.
+func TestServerAbsentConditionLookahead(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"b0", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"b0", "2012-01-01T00:01:00Z", `{"data":{"action":"view"}}`},
+			[]string{"b0", "2012-01-01T00:02:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"b1", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"b1", "2012-01-01T03:00:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"b2", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"b2", "2012-01-01T03:00:00Z", `{"data":{"action":"view"}}`},
+		})
+
+		// The second condition starts from the signup.
+		query := `{
+			"steps":[
+				{"type":"condition","expression":"action == 'signup'","steps":[
+					{"type":"condition","expression":"action == 'buy'","absent":true,"within":[1,1],"steps":[
+						{"type":"selection","name":"absent","fields":[{"name":"count","expression":"count()"}]}
+					]},
+					{"type":"condition","expression":"action == 'buy'","within":[2,2],"steps":[
+						{"type":"selection","name":"buy","fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"absent":{"count":2},"buy":{"count":1}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Sessions after the current one are checked.
+		query = `{
+			"sessionIdleTime":3600,
+			"steps":[
+				{"type":"condition","expression":"action == 'signup'","steps":[
+					{"type":"condition","expression":"action == 'buy'","absent":true,"within":[0,1],"withinUnits":"sessions","steps":[
+						{"type":"selection","fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that string literals in conditions are escaped.
+func TestServerConditionStringLiteralQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "name", false, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"name":"a\"b\\c"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"name":"x\" or \"\" == \""}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"name":"y"}}`},
+		})
+
+		query := `{"steps":[{"type":"condition","expression":"name == 'a\"b\\c'","steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}]}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+
+		query = `{"steps":[{"type":"condition","expression":"name == 'x\" or \"\" == \"'","steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can limit a query to a time range and filter objects.
+func TestServerQueryRangeAndFilter(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "plan", false, "factor")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"plan":"pro"}}`},
+			[]string{"a0", "2012-01-02T00:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a0", "2012-01-03T00:00:00Z", `{"data":{"action":"buy"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"plan":"free"}}`},
+			[]string{"a1", "2012-01-02T12:00:00Z", `{"data":{"action":"view"}}`},
+			[]string{"a2", "2011-12-01T00:00:00Z", `{"data":{"plan":"pro","action":"view"}}`},
+		})
+
+		// Run query with a range.
+		query := `{
+			"start":"2012-01-02T00:00:00Z",
+			"end":"2012-01-03T00:00:00Z",
+			"steps":[
+				{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"view":{"count":2}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with a range and a filter. Permanent values set before the start are still visible.
+		query = `{
+			"start":"2012-01-02T00:00:00Z",
+			"filter":"plan == 'pro'",
+			"steps":[
+				{"type":"selection","dimensions":["plan","action"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"plan":{"pro":{"action":{"buy":{"count":1},"view":{"count":1}}}}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with a filter on a value that doesn't exist.
+		query = `{
+			"filter":"plan == 'enterprise'",
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{}`+"\n", "POST /tables/:name/query failed.")
+
+		// Filters can only use permanent properties.
+		query = `{
+			"filter":"action == 'view'",
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QueryFilter: Property must be permanent: action"}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that objects that can't be decoded fail a filtered query instead of being skipped.
+func TestServerQueryInvalidObjectState(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "plan", false, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"plan":"pro"}}`},
+		})
+
+		// Write an object with an invalid state directly to its servlet.
+		table, servlet, _ := s.GetObjectContext("foo", "bad")
+		key, _ := table.EncodeObjectId("bad")
+		wo := levigo.NewWriteOptions()
+		defer wo.Close()
+		if err := servlet.db.Put(wo, key, []byte{0xc1}); err != nil {
+			t.Fatalf("Unable to write object: %v", err)
+		}
+
+		query := `{"filter":"plan == 'pro'","steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?cache=false", "application/json", query)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 500 || !strings.Contains(string(body), "Unable to decode object state") {
+			t.Fatalf("Unexpected response: %v: %s", resp.StatusCode, body)
+		}
+	})
+}
+
+// Ensure that we can sample objects and scale the results.
+func TestServerSampledQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "value", true, "integer")
+
+		// Add objects with two events each and count the ones in the sample.
+		table := NewTable("foo", "")
+		items := [][]string{}
+		included := 0
+		for i := 0; i < 20; i++ {
+			objectId := fmt.Sprintf("o%d", i)
+			items = append(items, []string{objectId, "2012-01-01T00:00:00Z", `{"data":{"value":1}}`})
+			items = append(items, []string{objectId, "2012-01-01T00:00:01Z", `{"data":{"value":2}}`})
+			encodedObjectId, _ := table.EncodeObjectId(objectId)
+			if sampleObject(encodedObjectId, 0.5) {
+				included++
+			}
+		}
+		setupTestData(t, "foo", items)
+		if included == 0 || included == 20 {
+			t.Fatalf("Unexpected sample size: %d", included)
+		}
+
+		// Run query.
+		query := `{
+			"sample":0.5,
+			"sessionIdleTime":7200,
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[
+					{"name":"count","expression":"count()"},
+					{"name":"total","expression":"sum(value)"},
+					{"name":"largest","expression":"max(value)"},
+					{"name":"sessions","expression":"session_count()"},
+					{"name":"events","expression":"session_events()"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		if rate := resp.Header.Get("X-Sky-Sample-Rate"); rate != "0.5" {
+			t.Fatalf("Unexpected sample rate header: %v", rate)
+		}
+		assertResponse(t, resp, 200, fmt.Sprintf(`{"count":%d,"events":%d,"largest":2,"sampleRate":0.5,"sessions":%d,"total":%d}`, included*4, included*4, included*2, included*6)+"\n", "POST /tables/:name/query failed.")
+
+		// Run query as CSV.
+		query = `{"sample":0.5,"steps":[{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?format=csv", "application/json", query)
+		assertResponse(t, resp, 200, fmt.Sprintf("count,sampleRate\n%d,0.5\n", included*4), "POST /tables/:name/query?format=csv failed.")
+
+		// Run cohort query.
+		query = `{
+			"sample":0.5,
+			"steps":[
+				{"type":"cohort","expression":"value == 1","returnExpression":"value == 2","period":86400,"periods":1}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, fmt.Sprintf(`{"cohort":{"2012-01-01T00:00:00Z":{"objects":%d,"periods":[{"count":%d,"rate":1}]}},"sampleRate":0.5}`, included*2, included*2)+"\n", "POST /tables/:name/query failed.")
+
+		// Run paths query.
+		query = `{
+			"sample":0.5,
+			"steps":[
+				{"type":"paths","expression":"value == 1","property":"value","depth":1}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, fmt.Sprintf(`{"paths":{"count":%d,"next":{"2":{"count":%d,"next":{}}}},"sampleRate":0.5}`, included*2, included*2)+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can sort and limit selection results.
+func TestServerSortedSelectionQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "country", false, "factor")
+		setupTestProperty("foo", "url", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"country":"us","url":"/a"}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"url":"/a"}}`},
+			[]string{"a0", "2012-01-01T00:00:02Z", `{"data":{"url":"/b"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"country":"us","url":"/a"}}`},
+			[]string{"a1", "2012-01-01T00:00:01Z", `{"data":{"url":"/c"}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"country":"uk","url":"/b"}}`},
+			[]string{"a2", "2012-01-01T00:00:01Z", `{"data":{"url":"/d"}}`},
+		})
+
+		// Run query with the top two and everything else.
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":["url"],"sort":"count","limit":2,"other":true,"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"url":[{"count":3,"url":"/a"},{"count":2,"url":"/b"},{"count":2,"other":true}]}`+"\n", "POST /tables/:name/query failed.")
+
+		// Run query with nested dimensions in ascending order.
+		query = `{
+			"steps":[
+				{"type":"selection","dimensions":["country","url"],"sort":"count","order":"asc","limit":1,"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"country":[{"country":"uk","url":[{"count":1,"url":"/b"}]}]}`+"\n", "POST /tables/:name/query failed.")
+
+		// A limit requires a sort field.
+		query = `{
+			"steps":[
+				{"type":"selection","dimensions":["url"],"limit":2,"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QuerySelection: A sort field is required when using a limit."}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can return query results as rows and CSV.
+func TestServerQueryRowFormats(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestProperty("foo", "level", true, "integer")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"view","level":1}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"action":"buy","level":2}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"view","level":1}}`},
+		})
+
+		// Run query as rows.
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":["action","level"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?format=rows", "application/json", query)
+		assertResponse(t, resp, 200, `[{"action":"buy","count":1,"level":2},{"action":"view","count":2,"level":1}]`+"\n", "POST /tables/:name/query?format=rows failed.")
+
+		// Run query as CSV.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?format=csv", "application/json", query)
+		if contentType := resp.Header.Get("Content-Type"); contentType != "text/csv" {
+			t.Fatalf("Unexpected content type: %v", contentType)
+		}
+		assertResponse(t, resp, 200, "action,level,count\nbuy,2,1\nview,1,2\n", "POST /tables/:name/query?format=csv failed.")
+
+		// Run a named and sorted query as rows.
+		query = `{
+			"steps":[
+				{"type":"selection","name":"top","dimensions":["action"],"sort":"count","limit":1,"other":true,"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?format=rows", "application/json", query)
+		assertResponse(t, resp, 200, `[{"action":"view","count":2,"other":false,"selection":"top"},{"action":null,"count":1,"other":true,"selection":"top"}]`+"\n", "POST /tables/:name/query?format=rows failed.")
+
+		// Run the same query as CSV.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?format=csv", "application/json", query)
+		assertResponse(t, resp, 200, "selection,action,other,count\ntop,view,false,2\ntop,,true,1\n", "POST /tables/:name/query?format=csv failed.")
+
+		// Invalid formats are rejected.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?format=xml", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"Invalid format: xml"}`+"\n", "POST /tables/:name/query?format=xml failed.")
+	})
+}
+
+// Ensure that query results are cached until the table is written to.
+func TestServerQueryCache(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		assertCache := func(url string, expected string, body string) {
+			resp, _ := sendTestHttpRequest("POST", url, "application/json", query)
+			if cache := resp.Header.Get("X-Sky-Cache"); cache != expected {
+				t.Fatalf("Unexpected cache header: %v (expected %v)", cache, expected)
+			}
+			assertResponse(t, resp, 200, body, "POST /tables/:name/query failed.")
+		}
+		assertCache("http://localhost:8586/tables/foo/query", "MISS", `{"count":1}`+"\n")
+		assertCache("http://localhost:8586/tables/foo/query", "HIT", `{"count":1}`+"\n")
+		assertCache("http://localhost:8586/tables/foo/query?cache=false", "BYPASS", `{"count":1}`+"\n")
+
+		// Writing to the table invalidates the cached results.
+		setupTestData(t, "foo", [][]string{
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+		})
+		assertCache("http://localhost:8586/tables/foo/query", "MISS", `{"count":2}`+"\n")
+
+		resp, _ := sendTestHttpRequest("GET", "http://localhost:8586/admin/queries/stats", "application/json", "")
+		assertResponse(t, resp, 200, `{"hits":1,"misses":2,"size":2}`+"\n", "GET /admin/queries/stats failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/admin/queries/purge", "application/json", "")
+		assertResponse(t, resp, 200, "", "POST /admin/queries/purge failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/admin/queries/stats", "application/json", "")
+		assertResponse(t, resp, 200, `{"hits":1,"misses":2,"size":0}`+"\n", "GET /admin/queries/stats failed.")
+	})
+}
+
+// Ensure that we can explain a query without running it.
+func TestServerQueryExplain(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+		})
+
+		// Explain a valid query.
+		query := `{
+			"steps":[
+				{"type":"condition","expression":"action == 'A0'","steps":[
+					{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query/explain", "application/json", query)
+		assertResponse(t, resp, 200, `{"factors":[{"id":1,"property":"action","value":"A0"}],"properties":[{"id":-1,"name":"action","transient":true,"dataType":"factor"}],"scanSize":0,"sessionIdleTime":0,"steps":[{"expression":"action == 'A0'","steps":[{"dimensions":["action"],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}],"type":"condition","within":[0,0],"withinUnits":"steps"}],"valid":true}`+"\n", "POST /tables/:name/query/explain failed.")
+
+		// Explain an invalid query.
+		query = `{
+			"sample":2,
+			"steps":[
+				{"type":"xyz"},
+				{"type":"condition","expression":"fruit == 'apple'"},
+				{"type":"selection","fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query/explain", "application/json", query)
+		assertResponse(t, resp, 200, `{"errors":["Invalid 'sample': 2","Step 0: Invalid query step type: xyz","Step 1: skyd.QueryCondition: Property not found: fruit"],"valid":false}`+"\n", "POST /tables/:name/query/explain failed.")
+	})
+}
+
+// Ensure that we can run textual queries and convert queries to text.
+func TestServerTextQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"action":"checkout"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+		})
+
+		// Run a textual query.
+		query := `SELECT count() GROUP BY action INTO "actions" WHERE action == "signup" THEN WITHIN 1..5 STEPS action == "checkout" SELECT count()`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "text/plain", query)
+		assertResponse(t, resp, 200, `{"actions":{"action":{"checkout":{"count":1},"signup":{"count":2}}},"count":1}`+"\n", "POST /tables/:name/query failed.")
+
+		// Invalid text is rejected.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "text/plain", `SELECT`)
+		assertResponse(t, resp, 500, `{"message":"skyd.QueryText: Expected field expression at position 6"}`+"\n", "POST /tables/:name/query failed.")
+
+		// Convert a JSON query to text.
+		query = `{
+			"steps":[
+				{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query/text", "application/json", query)
+		assertResponse(t, resp, 200, "SELECT count() GROUP BY action\n", "POST /tables/:name/query/text failed.")
+	})
+}
+
+// Ensure that names which can't be used as Lua identifiers are rejected.
+func TestServerQueryInvalidIdentifiers(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+
+		query := `{"steps":[{"type":"selection","fields":[{"name":"x = os.exit() --","expression":"count()"}]}]}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QuerySelectionField: Invalid name: x = os.exit() --"}`+"\n", "POST /tables/:name/query failed.")
+
+		query = `{"steps":[{"type":"selection","name":"a\"]","fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QuerySelection: Invalid name: a\"]"}`+"\n", "POST /tables/:name/query failed.")
+
+		query = `{"steps":[{"type":"selection","dimensions":["end"],"fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QuerySelection: Invalid dimension: end"}`+"\n", "POST /tables/:name/query failed.")
+
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties", "application/json", `{"name":"my-prop", "transient":true, "dataType":"integer"}`)
+		assertResponse(t, resp, 500, `{"message":"Invalid property name: my-prop"}`+"\n", "POST /tables/:name/properties failed.")
+	})
+}
+
+// Ensure that we can run a query with user-supplied Lua code.
+func TestServerLuaQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "price", true, "integer")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"price":10}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"price":20}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"price":5}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"price":40}}`},
+		})
+
+		// Find the total and maximum price.
+		query := `{
+			"steps":[
+				{"type":"lua","name":"prices","aggregate":"data.total = (data.total or 0) + cursor.event:price()\ndata.max = math.max(data.max or 0, cursor.event:price())","merge":"results.total = (results.total or 0) + data.total\nresults.max = math.max(results.max or 0, data.max)"}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"prices":{"max":40,"total":75}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Properties must exist.
+		query = `{"steps":[{"type":"lua","aggregate":"data.x = cursor.event:foo()","merge":"results.x = data.x"}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QueryLua: Property not found: 'foo'"}`+"\n", "POST /tables/:name/query failed.")
+
+		// Merge code is required.
+		query = `{"steps":[{"type":"lua","aggregate":"data.x = 1","merge":""}]}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 500, `{"message":"skyd.QueryLua: Invalid merge: "}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that execution engines are reused between queries.
+func TestServerEnginePool(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+		})
+		n := uint64(len(s.servlets) + 1)
+
+		// Globals set by a query don't carry over when an engine is reused.
+		query := `{"steps":[{"type":"lua","aggregate":"total = (total or 0) + 1\ndata.count = total","merge":"results.count = (results.count or 0) + data.count"}]}`
+		for i := 0; i < 2; i++ {
+			resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?cache=false", "application/json", query)
+			assertResponse(t, resp, 200, `{"lua":{"count":2}}`+"\n", "POST /tables/:name/query failed.")
+		}
+		if stats := s.EnginePool().Stats(); stats["hits"] != n || stats["misses"] != n || stats["size"] != int(n) {
+			t.Fatalf("Unexpected engine pool stats: %v", stats)
+		}
+
+		// Changing the schema requires new engines.
+		setupTestProperty("foo", "price", true, "integer")
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?cache=false", "application/json", query)
+		assertResponse(t, resp, 200, `{"lua":{"count":2}}`+"\n", "POST /tables/:name/query failed.")
+		if stats := s.EnginePool().Stats(); stats["hits"] != n || stats["misses"] != 2*n {
+			t.Fatalf("Unexpected engine pool stats: %v", stats)
+		}
+
+		// A table that is deleted and created again requires new engines.
+		resp, _ = sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name failed.")
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		setupTestProperty("foo", "price", true, "integer")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+		})
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?cache=false", "application/json", query)
+		assertResponse(t, resp, 200, `{"lua":{"count":1}}`+"\n", "POST /tables/:name/query failed.")
+		if stats := s.EnginePool().Stats(); stats["hits"] != n || stats["misses"] != 3*n {
+			t.Fatalf("Unexpected engine pool stats: %v", stats)
+		}
+	})
+}
+
+// Ensure that servlets split into multiple ranges return the same results.
+func TestServerQueryScanRanges(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		data := make([][]string, 0)
+		for i := 0; i < 100; i++ {
+			data = append(data, []string{fmt.Sprintf("a%d", i), "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`})
+		}
+		setupTestData(t, "foo", data)
+		for _, servlet := range s.servlets {
+			servlet.db.CompactRange(levigo.Range{})
+		}
+		s.scanRangeSize = 1
+
+		// Make sure the servlets are actually split into several ranges.
+		table, _ := s.OpenTable("foo")
+		for i, servlet := range s.servlets {
+			ranges, err := s.scanRanges(servlet, table)
+			if err != nil || len(ranges) <= 1 {
+				t.Fatalf("Expected multiple scan ranges for servlet %d: %v (%v)", i, len(ranges), err)
+			}
+		}
+
+		query := `{"steps":[{"type":"selection","dimensions":["fruit"],"fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query?cache=false", "application/json", query)
+		assertResponse(t, resp, 200, `{"fruit":{"apple":{"count":100}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
@@ -0,0 +1,198 @@
+package skyd
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func (s *Server) addSavedQueryHandlers() {
+	s.ApiHandleFunc("/tables/{name}/queries", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getSavedQueriesHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/tables/{name}/queries", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.createSavedQueryHandler(w, req, params)
+	}).Methods("POST")
+
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getSavedQueryHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.updateSavedQueryHandler(w, req, params)
+	}).Methods("PUT")
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.deleteSavedQueryHandler(w, req, params)
+	}).Methods("DELETE")
+
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}/run", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.runSavedQueryHandler(w, req, params)
+	}).Methods("POST")
+}
+
+// GET /tables/:name/queries
+func (s *Server) getSavedQueriesHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := table.GetSavedQueries()
+	if err != nil {
+		return nil, err
+	}
+	output := make([]interface{}, 0, len(queries))
+	for _, q := range queries {
+		output = append(output, q.Serialize())
+	}
+	return output, nil
+}
+
+// POST /tables/:name/queries
+func (s *Server) createSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := params["name"].(string)
+	query, _ := params["query"].(map[string]interface{})
+	savedQuery, err := s.newSavedQuery(table, name, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, err := table.GetSavedQuery(name); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, errors.New("Saved query already exists.")
+	}
+	if err = table.PutSavedQuery(savedQuery); err != nil {
+		return nil, err
+	}
+
+	return savedQuery.Serialize(), nil
+}
+
+// GET /tables/:name/queries/:queryName
+func (s *Server) getSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	savedQuery, err := table.GetSavedQuery(vars["queryName"])
+	if err != nil {
+		return nil, err
+	} else if savedQuery == nil {
+		return nil, errors.New("Saved query does not exist.")
+	}
+	return savedQuery.Serialize(), nil
+}
+
+// PUT /tables/:name/queries/:queryName
+func (s *Server) updateSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, err := table.GetSavedQuery(vars["queryName"]); err != nil {
+		return nil, err
+	} else if existing == nil {
+		return nil, errors.New("Saved query does not exist.")
+	}
+
+	query, _ := params["query"].(map[string]interface{})
+	savedQuery, err := s.newSavedQuery(table, vars["queryName"], query)
+	if err != nil {
+		return nil, err
+	}
+	if err = table.PutSavedQuery(savedQuery); err != nil {
+		return nil, err
+	}
+
+	return savedQuery.Serialize(), nil
+}
+
+// DELETE /tables/:name/queries/:queryName
+func (s *Server) deleteSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, err := table.GetSavedQuery(vars["queryName"]); err != nil {
+		return nil, err
+	} else if existing == nil {
+		return nil, errors.New("Saved query does not exist.")
+	}
+	return nil, table.DeleteSavedQuery(vars["queryName"])
+}
+
+// POST /tables/:name/queries/:queryName/run
+func (s *Server) runSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	savedQuery, err := table.GetSavedQuery(vars["queryName"])
+	if err != nil {
+		return nil, err
+	} else if savedQuery == nil {
+		return nil, errors.New("Saved query does not exist.")
+	}
+
+	// Bind the request parameters to the placeholders and validate the
+	// result before running it.
+	obj, err := savedQuery.Bind(params)
+	if err != nil {
+		return nil, err
+	}
+	if errs := NewQuery(table, s.factors).Validate(obj); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	query := NewQuery(table, s.factors)
+	if err = query.Deserialize(obj); err != nil {
+		return nil, err
+	}
+
+	return s.executeQuery(w, req, table, query)
+}
+
+// Creates a saved query from its name and untyped query. Queries without
+// parameters are validated and stored in their serialized form. Queries with
+// parameters can only be validated once they are bound so they are stored
+// as-is.
+func (s *Server) newSavedQuery(table *Table, name string, obj map[string]interface{}) (*SavedQuery, error) {
+	savedQuery, err := NewSavedQuery(name, obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(savedQuery.Params()) > 0 {
+		return savedQuery, nil
+	}
+
+	query := NewQuery(table, s.factors)
+	if err = query.Deserialize(obj); err != nil {
+		return nil, err
+	}
+
+	// Round trip through JSON so the stored query matches what is read back.
+	b, err := json.Marshal(query.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	savedQuery.Query = map[string]interface{}{}
+	if err = json.Unmarshal(b, &savedQuery.Query); err != nil {
+		return nil, err
+	}
+	return savedQuery, nil
+}
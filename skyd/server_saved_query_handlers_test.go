@@ -0,0 +1,113 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that we can create, update, delete and list saved queries.
+func TestServerSavedQueries(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+
+		// Create saved queries.
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"total","query":{"steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}}`)
+		assertResponse(t, resp, 200, `{"name":"total","params":[],"query":{"sessionIdleTime":0,"steps":[{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}]}}`+"\n", "POST /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"filtered","query":{"filter":"{{filter}}","steps":[]}}`)
+		assertResponse(t, resp, 200, `{"name":"filtered","params":["filter"],"query":{"filter":"{{filter}}","steps":[]}}`+"\n", "POST /tables/:name/queries failed.")
+
+		// Duplicate names and invalid queries are rejected.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"total","query":{"steps":[]}}`)
+		assertResponse(t, resp, 500, `{"message":"Saved query already exists."}`+"\n", "POST /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"bad","query":{"steps":[{"type":"xyz"}]}}`)
+		assertResponse(t, resp, 500, `{"message":"Invalid query step type: xyz"}`+"\n", "POST /tables/:name/queries failed.")
+
+		// Update a saved query.
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/queries/total", "application/json", `{"query":{"sessionIdleTime":60,"steps":[]}}`)
+		assertResponse(t, resp, 200, `{"name":"total","params":[],"query":{"sessionIdleTime":60,"steps":[]}}`+"\n", "PUT /tables/:name/queries/:queryName failed.")
+
+		// List and retrieve saved queries.
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/queries", "application/json", "")
+		assertResponse(t, resp, 200, `[{"name":"filtered","params":["filter"],"query":{"filter":"{{filter}}","steps":[]}},{"name":"total","params":[],"query":{"sessionIdleTime":60,"steps":[]}}]`+"\n", "GET /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/queries/total", "application/json", "")
+		assertResponse(t, resp, 200, `{"name":"total","params":[],"query":{"sessionIdleTime":60,"steps":[]}}`+"\n", "GET /tables/:name/queries/:queryName failed.")
+
+		// Delete a saved query.
+		resp, _ = sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo/queries/total", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name/queries/:queryName failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/queries/total", "application/json", "")
+		assertResponse(t, resp, 500, `{"message":"Saved query does not exist."}`+"\n", "GET /tables/:name/queries/:queryName failed.")
+	})
+}
+
+// Ensure that we can run a saved query with bound parameters.
+func TestServerRunSavedQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"action":"A1"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"a1", "2012-01-01T00:00:01Z", `{"data":{"action":"A2"}}`},
+		})
+
+		query := `{"name":"next","query":{
+			"steps":[
+				{"type":"condition","expression":"action == '{{first}}'","within":[0,0],"steps":[
+					{"type":"condition","expression":"action == '{{second}}'","within":["{{within}}","{{within}}"],"steps":[
+						{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", query)
+		assertResponse(t, resp, 200, `{"name":"next","params":["first","second","within"],"query":{"steps":[{"expression":"action == '{{first}}'","steps":[{"expression":"action == '{{second}}'","steps":[{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"type":"selection"}],"type":"condition","within":["{{within}}","{{within}}"]}],"type":"condition","within":[0,0]}]}}`+"\n", "POST /tables/:name/queries failed.")
+
+		// Run with different parameters.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/next/run", "application/json", `{"first":"A0","second":"A1","within":1}`)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/next/run", "application/json", `{"first":"A0","second":"A0","within":0}`)
+		assertResponse(t, resp, 200, `{"count":2}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+
+		// Run as rows.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/next/run?format=rows", "application/json", `{"first":"A0","second":"A2","within":1}`)
+		assertResponse(t, resp, 200, `[{"count":1}]`+"\n", "POST /tables/:name/queries/:queryName/run?format=rows failed.")
+
+		// Missing parameters are rejected.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/next/run", "application/json", `{"first":"A0","second":"A1"}`)
+		assertResponse(t, resp, 500, `{"message":"skyd.SavedQuery: Missing parameter: within"}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+	})
+}
+
+// Ensure that parameter values can't change the expressions they are bound to.
+func TestServerRunSavedQueryEscapedParams(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "name", true, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"name":"x\" || 1 == 1 || \"y"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"name":"it's"}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"name":"z"}}`},
+		})
+
+		query := `{"name":"byname","query":{"steps":[{"type":"condition","expression":"name == '{{name}}'","steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}]}}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", query)
+		assertResponse(t, resp, 200, `{"name":"byname","params":["name"],"query":{"steps":[{"expression":"name == '{{name}}'","steps":[{"fields":[{"expression":"count()","name":"count"}],"type":"selection"}],"type":"condition"}]}}`+"\n", "POST /tables/:name/queries failed.")
+
+		// Quotes in values are escaped.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/byname/run", "application/json", `{"name":"x\" || 1 == 1 || \"y"}`)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/byname/run", "application/json", `{"name":"it's"}`)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+
+		// Only scalar values can be bound.
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/byname/run", "application/json", `{"name":["z"]}`)
+		assertResponse(t, resp, 500, `{"message":"skyd.SavedQuery: Invalid parameter: name"}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+
+		// Strings outside of a literal can only contain word characters.
+		query = `{"name":"unquoted","query":{"steps":[{"type":"condition","expression":"name == {{name}}","steps":[]}]}}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", query)
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/unquoted/run", "application/json", `{"name":"'z' or true"}`)
+		assertResponse(t, resp, 500, `{"message":"skyd.SavedQuery: Invalid parameter: name"}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+	})
+}
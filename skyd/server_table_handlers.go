@@ -16,6 +16,9 @@ func (s *Server) addTableHandlers() {
 	s.ApiHandleFunc("/tables", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.createTableHandler(w, req, params)
 	}).Methods("POST")
+	s.ApiHandleFunc("/tables/{name}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.updateTableHandler(w, req, params)
+	}).Methods("PATCH")
 	s.ApiHandleFunc("/tables/{name}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.deleteTableHandler(w, req, params)
 	}).Methods("DELETE")
@@ -48,6 +51,9 @@ func (s *Server) createTableHandler(w http.ResponseWriter, req *http.Request, pa
 
 	// Otherwise create it.
 	table = NewTable(tableName, s.TablePath(tableName))
+	table.AutoSchema, _ = params["autoSchema"].(bool)
+	table.AutoSchemaTransient, _ = params["autoSchemaTransient"].(bool)
+	table.CoerceTypes, _ = params["coerceTypes"].(bool)
 	err = table.Create()
 	if err != nil {
 		return nil, err
@@ -56,6 +62,32 @@ func (s *Server) createTableHandler(w http.ResponseWriter, req *http.Request, pa
 	return table, nil
 }
 
+// PATCH /tables/:name
+func (s *Server) updateTableHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Update any options that were passed in and save them.
+	if autoSchema, ok := params["autoSchema"].(bool); ok {
+		table.AutoSchema = autoSchema
+	}
+	if autoSchemaTransient, ok := params["autoSchemaTransient"].(bool); ok {
+		table.AutoSchemaTransient = autoSchemaTransient
+	}
+	if coerceTypes, ok := params["coerceTypes"].(bool); ok {
+		table.CoerceTypes = coerceTypes
+	}
+	err = table.SaveOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
 // DELETE /tables/:name
 func (s *Server) deleteTableHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 	vars := mux.Vars(req)
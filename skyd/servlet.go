@@ -99,7 +99,12 @@ func (s *Servlet) Unlock() {
 func (s *Servlet) PutEvent(table *Table, objectId string, event *Event, replace bool) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.putEvent(table, objectId, event, replace)
+}
 
+// Adds an event for a given object without locking the servlet. The caller
+// must hold the servlet lock.
+func (s *Servlet) putEvent(table *Table, objectId string, event *Event, replace bool) error {
 	// Make sure the servlet is open.
 	if s.db == nil {
 		return fmt.Errorf("Servlet is not open: %v", s.path)
@@ -233,6 +238,38 @@ func (s *Servlet) DeleteEvent(table *Table, objectId string, timestamp time.Time
 	return nil
 }
 
+// Converts the string values stored for a factor property on an object's
+// events and state to factor identifiers.
+func (s *Servlet) FactorizeProperty(table *Table, objectId string, property *Property, factors *Factors) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// Make sure the servlet is open.
+	if s.db == nil {
+		return fmt.Errorf("Servlet is not open: %v", s.path)
+	}
+
+	events, state, err := s.GetEvents(table, objectId)
+	if err != nil || state == nil || len(events) == 0 {
+		return err
+	}
+	for _, event := range append(events, state) {
+		if value, ok := event.Data[property.Id].(string); ok {
+			sequence, err := factors.Factorize(table.Name, property.Name, value, true)
+			if err != nil {
+				return err
+			}
+			event.Data[property.Id] = sequence
+		}
+	}
+
+	// New factors are written before the events that reference them.
+	if err = factors.Flush(); err != nil {
+		return err
+	}
+	return s.SetEvents(table, objectId, events, state)
+}
+
 // Retrieves the state and the remaining serialized event stream for an object.
 func (s *Servlet) GetState(table *Table, objectId string) (*Event, []byte, error) {
 	// Make sure the servlet is open.
@@ -308,6 +345,67 @@ func (s *Servlet) GetEvents(table *Table, objectId string) ([]*Event, *Event, er
 	return events, state, nil
 }
 
+// Iterates over the state and events of every object in a table. The caller
+// is responsible for locking the servlet if needed.
+func (s *Servlet) EachEvent(table *Table, fn func(event *Event) error) error {
+	if s.db == nil {
+		return fmt.Errorf("Servlet is not open: %v", s.path)
+	}
+	prefix, err := TablePrefix(table.Name)
+	if err != nil {
+		return err
+	}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	iterator := s.db.NewIterator(ro)
+	defer iterator.Close()
+
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		if !bytes.HasPrefix(iterator.Key(), prefix) {
+			break
+		}
+		reader := bytes.NewReader(iterator.Value())
+
+		// The first item is the current state wrapped in a raw value.
+		var raw interface{}
+		decoder := msgpack.NewDecoder(reader, nil)
+		if err := decoder.Decode(&raw); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		b, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("skyd.Servlet: Invalid state: %v", raw)
+		}
+		state := &Event{}
+		if err = state.DecodeRaw(bytes.NewReader([]byte(b))); err != nil && err != io.EOF {
+			return err
+		} else if err == nil {
+			if err = fn(state); err != nil {
+				return err
+			}
+		}
+
+		// Then each event follows.
+		for {
+			event := &Event{}
+			err = event.DecodeRaw(reader)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err = fn(event); err != nil {
+				return err
+			}
+		}
+	}
+
+	return iterator.GetError()
+}
+
 // Writes a list of events for an object in table.
 func (s *Servlet) SetEvents(table *Table, objectId string, events []*Event, state *Event) error {
 	// Sort the events.
@@ -372,7 +470,11 @@ func (s *Servlet) SetRawEvents(table *Table, objectId string, data []byte, state
 	// Write bytes to the database.
 	wo := levigo.NewWriteOptions()
 	defer wo.Close()
-	return s.db.Put(wo, encodedObjectId, buffer.Bytes())
+	if err = s.db.Put(wo, encodedObjectId, buffer.Bytes()); err != nil {
+		return err
+	}
+	table.incrementVersion()
+	return nil
 }
 
 // Deletes all events for a given object in a table.
@@ -392,6 +494,76 @@ func (s *Servlet) DeleteEvents(table *Table, objectId string) error {
 	wo := levigo.NewWriteOptions()
 	err = s.db.Delete(wo, encodedObjectId)
 	wo.Close()
+	table.incrementVersion()
 
 	return nil
 }
+
+//--------------------------------------
+// Statistics
+//--------------------------------------
+
+// Retrieves the approximate number of bytes stored on disk for a table.
+// Recently written data that is still in memory is not included.
+func (s *Servlet) ApproximateSize(table *Table) (uint64, error) {
+	if s.db == nil {
+		return 0, fmt.Errorf("Servlet is not open: %v", s.path)
+	}
+	prefix, err := TablePrefix(table.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	sizes := s.db.GetApproximateSizes([]levigo.Range{{Start: prefix, Limit: prefixLimit(prefix)}})
+	if len(sizes) == 0 {
+		return 0, nil
+	}
+	return sizes[0], nil
+}
+
+// Splits the key range of a table into up to n contiguous ranges with about
+// the same amount of data on disk. The ranges cover every key in the table.
+// Fewer ranges are returned when there isn't enough data on disk to split.
+func (s *Servlet) SplitRanges(table *Table, n int) ([]levigo.Range, error) {
+	if s.db == nil {
+		return nil, fmt.Errorf("Servlet is not open: %v", s.path)
+	}
+	prefix, err := TablePrefix(table.Name)
+	if err != nil {
+		return nil, err
+	}
+	return s.splitRange(levigo.Range{Start: prefix, Limit: prefixLimit(prefix)}, n), nil
+}
+
+// Recursively splits a range in two. The split key is found with a binary
+// search over the key space so that the size of each side is in proportion
+// to the number of ranges it will be split into.
+func (s *Servlet) splitRange(r levigo.Range, n int) []levigo.Range {
+	if n <= 1 {
+		return []levigo.Range{r}
+	}
+	total := s.db.GetApproximateSizes([]levigo.Range{r})[0]
+	if total == 0 {
+		return []levigo.Range{r}
+	}
+	target := total * uint64(n/2) / uint64(n)
+
+	lo, hi := r.Start, r.Limit
+	for i := 0; i < 32; i++ {
+		mid := midpointKey(lo, hi)
+		if mid == nil {
+			break
+		}
+		if s.db.GetApproximateSizes([]levigo.Range{{Start: r.Start, Limit: mid}})[0] < target {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if bytes.Equal(hi, r.Start) || bytes.Equal(hi, r.Limit) {
+		return []levigo.Range{r}
+	}
+
+	ranges := s.splitRange(levigo.Range{Start: r.Start, Limit: hi}, n/2)
+	return append(ranges, s.splitRange(levigo.Range{Start: hi, Limit: r.Limit}, n-n/2)...)
+}
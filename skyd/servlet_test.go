@@ -1,8 +1,12 @@
 package skyd
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/jmhodges/levigo"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -67,3 +71,56 @@ func TestServletPutEvent(t *testing.T) {
 		}
 	}
 }
+
+// Ensure that a table's keys can be split into ranges by size on disk.
+func TestServletSplitRanges(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	table := NewTable("test", "/tmp/test")
+	servlet := NewServlet(path, nil)
+	defer servlet.Close()
+	_ = servlet.Open()
+
+	// Add objects and flush them to disk.
+	for i := 0; i < 1000; i++ {
+		event := NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{1: strings.Repeat("x", 100)})
+		if err = servlet.PutEvent(table, fmt.Sprintf("obj%04d", i), event, true); err != nil {
+			t.Fatalf("Unable to add event: %v", err)
+		}
+	}
+	servlet.db.CompactRange(levigo.Range{})
+
+	ranges, err := servlet.SplitRanges(table, 4)
+	if err != nil {
+		t.Fatalf("Unable to split ranges: %v", err)
+	}
+	if len(ranges) != 4 {
+		t.Fatalf("Expected %v ranges, got %v", 4, len(ranges))
+	}
+
+	// The ranges must cover the table without overlapping.
+	prefix, _ := TablePrefix(table.Name)
+	if !bytes.Equal(ranges[0].Start, prefix) || !bytes.Equal(ranges[3].Limit, prefixLimit(prefix)) {
+		t.Fatalf("Ranges do not cover the table: %v", ranges)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if !bytes.Equal(ranges[i-1].Limit, ranges[i].Start) {
+			t.Fatalf("Ranges are not contiguous: %v", ranges)
+		}
+	}
+
+	// Every range should contain some of the keys.
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	iterator := servlet.db.NewIterator(ro)
+	defer iterator.Close()
+	for _, r := range ranges {
+		count := 0
+		for iterator.Seek(r.Start); iterator.Valid() && bytes.Compare(iterator.Key(), r.Limit) < 0; iterator.Next() {
+			count++
+		}
+		if count == 0 {
+			t.Fatalf("Empty range: %v", r)
+		}
+	}
+}
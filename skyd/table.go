@@ -1,11 +1,16 @@
 package skyd
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/ugorji/go-msgpack"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,9 +22,28 @@ import (
 
 // A Table is a collection of objects.
 type Table struct {
-	Name         string `json:"name"`
-	path         string
-	propertyFile *PropertyFile
+	Name                string `json:"name"`
+	AutoSchema          bool   `json:"autoSchema,omitempty"`
+	AutoSchemaTransient bool   `json:"autoSchemaTransient,omitempty"`
+	CoerceTypes         bool   `json:"coerceTypes,omitempty"`
+	path                string
+	propertyFile        *PropertyFile
+	mutex               sync.Mutex
+	dataMutex           sync.RWMutex
+	version             uint64
+	inferredStrings     map[string]*inferredString
+}
+
+// An inferredString samples the values written to a string property that
+// was created by schema inference. The property is converted to a factor if
+// the sample has a low cardinality. The objects that were written to are
+// tracked so that their stored values can be converted. Samples are saved
+// next to the property file so they survive a restart.
+type inferredString struct {
+	Count      int             `json:"count"`
+	Values     map[string]bool `json:"values"`
+	ObjectIds  map[string]bool `json:"objectIds"`
+	converting bool
 }
 
 //------------------------------------------------------------------------------
@@ -52,6 +76,38 @@ func (t *Table) Path() string {
 	return t.path
 }
 
+// Retrieves the data version of the table. The version is incremented every
+// time an object's events are written or deleted.
+func (t *Table) Version() uint64 {
+	return atomic.LoadUint64(&t.version)
+}
+
+// Retrieves the schema version of the table. The version changes every time
+// a property is added, changed or removed and is never shared with another
+// table, including a deleted table with the same name.
+func (t *Table) SchemaVersion() uint64 {
+	if t.propertyFile == nil {
+		return 0
+	}
+	return t.propertyFile.Version()
+}
+
+// Retrieves the path to the table's options file.
+func (t *Table) OptionsPath() string {
+	return fmt.Sprintf("%v/%v", t.path, "options")
+}
+
+// Retrieves the path to the samples of the table's inferred string
+// properties. The samples are stored next to the property file.
+func (t *Table) InferredStringsPath() string {
+	return fmt.Sprintf("%v/%v", t.path, "properties.samples")
+}
+
+// Retrieves the path to the table's saved queries file.
+func (t *Table) SavedQueriesPath() string {
+	return fmt.Sprintf("%v/%v", t.path, "queries")
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -74,6 +130,12 @@ func (t *Table) Create() error {
 		return err
 	}
 
+	// Write the initial options.
+	err = t.SaveOptions()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -100,9 +162,22 @@ func (t *Table) Open() error {
 		return errors.New("Table does not exist")
 	}
 
+	// Load options.
+	err := t.loadOptions()
+	if err != nil {
+		return err
+	}
+
 	// Load property file.
 	t.propertyFile = NewPropertyFile(fmt.Sprintf("%v/%v", t.path, "properties"))
-	err := t.propertyFile.Open()
+	err = t.propertyFile.Open()
+	if err != nil {
+		t.Close()
+		return err
+	}
+
+	// Load the samples of inferred string properties.
+	err = t.loadInferredStrings()
 	if err != nil {
 		t.Close()
 		return err
@@ -117,6 +192,7 @@ func (t *Table) Close() {
 		t.propertyFile.Close()
 	}
 	t.propertyFile = nil
+	t.inferredStrings = nil
 }
 
 // Checks if the table is currently open.
@@ -132,6 +208,84 @@ func (t *Table) Exists() bool {
 	return true
 }
 
+// Reads the table options from disk. Tables created before options existed
+// will not have an options file so the defaults are used.
+func (t *Table) loadOptions() error {
+	if _, err := os.Stat(t.OptionsPath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	file, err := os.Open(t.OptionsPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Decode into a copy so the table name cannot be overwritten.
+	options := &Table{}
+	if err = json.NewDecoder(bufio.NewReader(file)).Decode(options); err != nil {
+		return fmt.Errorf("skyd.Table: Unable to decode options: %v", err)
+	}
+	t.AutoSchema = options.AutoSchema
+	t.AutoSchemaTransient = options.AutoSchemaTransient
+	t.CoerceTypes = options.CoerceTypes
+
+	return nil
+}
+
+// Writes the table options to disk.
+func (t *Table) SaveOptions() error {
+	file, err := os.Create(t.OptionsPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err = json.NewEncoder(w).Encode(t); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Reads the samples of inferred string properties from disk.
+func (t *Table) loadInferredStrings() error {
+	t.inferredStrings = nil
+	if _, err := os.Stat(t.InferredStringsPath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	file, err := os.Open(t.InferredStringsPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	samples := make(map[string]*inferredString)
+	if err = json.NewDecoder(bufio.NewReader(file)).Decode(&samples); err != nil {
+		return fmt.Errorf("skyd.Table: Unable to decode inferred strings: %v", err)
+	}
+	t.inferredStrings = samples
+
+	return nil
+}
+
+// Writes the samples of inferred string properties to disk. The caller must
+// hold the table lock.
+func (t *Table) saveInferredStrings() error {
+	file, err := os.Create(t.InferredStringsPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err = json.NewEncoder(w).Encode(t.inferredStrings); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
 // Generates a prefix key used for iterating over the table's data.
 func TablePrefix(tableName string) ([]byte, error) {
 	// The table prefix should match the encoded object id syntax but without the last item.
@@ -148,23 +302,245 @@ func TablePrefix(tableName string) ([]byte, error) {
 
 // Adds a property to the table.
 func (t *Table) CreateProperty(name string, transient bool, dataType string) (*Property, error) {
-	if !t.IsOpen() {
-		return nil, errors.New("Table is not open")
+	property, err := NewProperty(0, name, transient, dataType)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create property on property file.
-	property, err := t.propertyFile.CreateProperty(name, transient, dataType)
+	err = t.AddProperty(property)
 	if err != nil {
 		return nil, err
 	}
 
+	return property, err
+}
+
+// Adds an existing property to the table and generates an identifier for it.
+func (t *Table) AddProperty(property *Property) error {
+	if !t.IsOpen() {
+		return errors.New("Table is not open")
+	}
+
+	// Add property to property file.
+	err := t.propertyFile.AddProperty(property)
+	if err != nil {
+		return err
+	}
+
 	// Save the property file to disk.
-	err = t.propertyFile.Save()
+	return t.propertyFile.Save()
+}
+
+// Replaces a property on the table with an updated copy and saves the
+// property file.
+func (t *Table) UpdateProperty(property *Property, update *Property) error {
+	if !t.IsOpen() {
+		return errors.New("Table is not open")
+	}
+
+	err := t.propertyFile.UpdateProperty(property, update)
+	if err != nil {
+		return err
+	}
+	return t.propertyFile.Save()
+}
+
+// Splits a data map into the keys that exist on the table and the keys that
+// don't. Unknown keys are only split out when the table is in auto schema
+// mode so that they can be created by InferProperties().
+func (t *Table) SplitUnknownKeys(m map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	if !t.AutoSchema || !t.IsOpen() || len(m) == 0 {
+		return m, nil
+	}
+
+	known := make(map[string]interface{})
+	unknown := make(map[string]interface{})
+	for k, v := range m {
+		if t.propertyFile.GetPropertyByName(k) == nil {
+			unknown[k] = v
+		} else {
+			known[k] = v
+		}
+	}
+	return known, unknown
+}
+
+// Creates properties for the keys in the map that do not exist on the table
+// yet and adds their values to a normalized event. Data types are inferred
+// from the values. This only occurs when the table is in auto schema mode
+// and should only be called once the rest of the event has been validated.
+// The newly created properties are returned.
+func (t *Table) InferProperties(event *Event, m map[string]interface{}) ([]*Property, error) {
+	if !t.IsOpen() {
+		return nil, errors.New("Table is not open")
+	}
+	if !t.AutoSchema || len(m) == 0 {
+		return nil, nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Sort the keys so identifiers are assigned in a predictable order.
+	keys := make([]string, 0)
+	for k, _ := range m {
+		if t.propertyFile.GetPropertyByName(k) == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	// Infer all the data types before changing the schema.
+	dataTypes := make([]string, len(keys))
+	for i, k := range keys {
+		dataType, err := InferDataType(m[k])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to infer property '%v': %v", k, err)
+		}
+		dataTypes[i] = dataType
+	}
+
+	// Create the properties and save the property file. String properties
+	// are sampled to determine if they should be factors.
+	properties := make([]*Property, 0)
+	for i, k := range keys {
+		property, err := t.propertyFile.CreateProperty(k, t.AutoSchemaTransient, dataTypes[i])
+		if err != nil {
+			return nil, err
+		}
+		properties = append(properties, property)
+
+		if property.DataType == StringDataType {
+			if t.inferredStrings == nil {
+				t.inferredStrings = make(map[string]*inferredString)
+			}
+			t.inferredStrings[property.Name] = &inferredString{Values: make(map[string]bool), ObjectIds: make(map[string]bool)}
+		}
+	}
+	if len(properties) > 0 {
+		if err := t.propertyFile.Save(); err != nil {
+			return nil, err
+		}
+		if err := t.saveInferredStrings(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add the values to the event. Keys that were created by another request
+	// in the meantime are validated against the existing property.
+	data, err := t.NormalizeMap(m)
 	if err != nil {
 		return nil, err
 	}
+	if event.Data == nil {
+		event.Data = make(map[int64]interface{})
+	}
+	for k, v := range data {
+		event.Data[k] = v
+	}
 
-	return property, err
+	return properties, nil
+}
+
+// Adds the values of an event that was written to an object to the samples
+// of any inferred string properties. Properties with too many distinct
+// values stop being sampled. The samples are saved whenever they change.
+// Returns true the first time a sample is complete so that the caller can
+// run ConvertInferredFactors().
+func (t *Table) SampleInferredStrings(objectId string, event *Event) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ready, changed := false, false
+	for name, sample := range t.inferredStrings {
+		property := t.propertyFile.GetPropertyByName(name)
+		if property == nil || property.DataType != StringDataType {
+			delete(t.inferredStrings, name)
+			changed = true
+			continue
+		}
+
+		// Complete samples are only waiting to be converted. This also
+		// converts samples that were completed before a restart.
+		if sample.Count >= InferredFactorSampleSize {
+			if !sample.converting {
+				sample.converting = true
+				ready = true
+			}
+			continue
+		}
+
+		value, ok := event.Data[property.Id].(string)
+		if !ok {
+			continue
+		}
+
+		sample.Count++
+		sample.Values[value] = true
+		sample.ObjectIds[objectId] = true
+		changed = true
+		if len(sample.Values) > MaxInferredFactorCardinality {
+			delete(t.inferredStrings, name)
+		} else if sample.Count >= InferredFactorSampleSize {
+			sample.converting = true
+			ready = true
+		}
+	}
+
+	if changed {
+		if err := t.saveInferredStrings(); err != nil {
+			return false, err
+		}
+	}
+	return ready, nil
+}
+
+// Converts the inferred string properties with complete samples to factors.
+// The function is called with each converted property and the objects that
+// have values stored for it so the values can be converted as well. The
+// caller must hold the data lock for writing so that no events are written
+// or queried while the stored values are inconsistent.
+func (t *Table) ConvertInferredFactors(fn func(property *Property, objectIds []string) error) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for name, sample := range t.inferredStrings {
+		if sample.Count < InferredFactorSampleSize {
+			continue
+		}
+		delete(t.inferredStrings, name)
+
+		// Skip properties that have been changed in the meantime.
+		property := t.propertyFile.GetPropertyByName(name)
+		if property == nil || property.DataType != StringDataType {
+			if err := t.saveInferredStrings(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		update := *property
+		update.DataType = FactorDataType
+		if err := t.propertyFile.UpdateProperty(property, &update); err != nil {
+			return err
+		}
+		if err := t.propertyFile.Save(); err != nil {
+			return err
+		}
+		if err := t.saveInferredStrings(); err != nil {
+			return err
+		}
+
+		objectIds := make([]string, 0)
+		for objectId, _ := range sample.ObjectIds {
+			objectIds = append(objectIds, objectId)
+		}
+		sort.Strings(objectIds)
+		if err := fn(&update, objectIds); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Retrieves a list of all properties on the table.
@@ -196,6 +572,23 @@ func (t *Table) DeleteProperty(property *Property) error {
 	if !t.IsOpen() {
 		return errors.New("Table is not open")
 	}
+
+	// Don't allow properties to be removed out from under computed properties.
+	for _, other := range t.propertyFile.GetProperties() {
+		if !other.IsComputed() || other == property {
+			continue
+		}
+		refs, err := computedPropertyReferences(other, t.propertyFile)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if ref == property {
+				return fmt.Errorf("Property is referenced by computed property: %v", other.Name)
+			}
+		}
+	}
+
 	t.propertyFile.DeleteProperty(property)
 	return nil
 }
@@ -218,6 +611,120 @@ func (t *Table) DenormalizeMap(m map[int64]interface{}) (map[string]interface{},
 	return t.propertyFile.DenormalizeMap(m)
 }
 
+//--------------------------------------
+// Versioning
+//--------------------------------------
+
+// Increments the data version of the table.
+func (t *Table) incrementVersion() {
+	atomic.AddUint64(&t.version, 1)
+}
+
+//--------------------------------------
+// Saved Query Management
+//--------------------------------------
+
+// Retrieves a list of all saved queries on the table sorted by name.
+func (t *Table) GetSavedQueries() ([]*SavedQuery, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.loadSavedQueries()
+}
+
+// Retrieves a single saved query by name. Returns nil if the query does not
+// exist.
+func (t *Table) GetSavedQuery(name string) (*SavedQuery, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queries, err := t.loadSavedQueries()
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range queries {
+		if q.Name == name {
+			return q, nil
+		}
+	}
+	return nil, nil
+}
+
+// Adds a saved query to the table or replaces an existing query with the
+// same name.
+func (t *Table) PutSavedQuery(query *SavedQuery) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queries, err := t.loadSavedQueries()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, q := range queries {
+		if q.Name == query.Name {
+			queries[i] = query
+			found = true
+		}
+	}
+	if !found {
+		queries = append(queries, query)
+	}
+	return t.saveSavedQueries(queries)
+}
+
+// Removes a saved query from the table.
+func (t *Table) DeleteSavedQuery(name string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queries, err := t.loadSavedQueries()
+	if err != nil {
+		return err
+	}
+	for i, q := range queries {
+		if q.Name == name {
+			return t.saveSavedQueries(append(queries[:i], queries[i+1:]...))
+		}
+	}
+	return fmt.Errorf("skyd.Table: Saved query not found: %v", name)
+}
+
+// Reads the saved queries from disk.
+func (t *Table) loadSavedQueries() ([]*SavedQuery, error) {
+	queries := []*SavedQuery{}
+	if _, err := os.Stat(t.SavedQueriesPath()); os.IsNotExist(err) {
+		return queries, nil
+	}
+
+	file, err := os.Open(t.SavedQueriesPath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err = json.NewDecoder(bufio.NewReader(file)).Decode(&queries); err != nil {
+		return nil, fmt.Errorf("skyd.Table: Unable to decode saved queries: %v", err)
+	}
+	return queries, nil
+}
+
+// Writes the saved queries to disk.
+func (t *Table) saveSavedQueries(queries []*SavedQuery) error {
+	sort.Sort(savedQueryList(queries))
+
+	file, err := os.Create(t.SavedQueriesPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err = json.NewEncoder(w).Encode(queries); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
 //--------------------------------------
 // Event Encoding
 //--------------------------------------
@@ -244,6 +751,9 @@ func (t *Table) DeserializeEvent(m map[string]interface{}) (*Event, error) {
 
 	// Convert maps to use property identifiers.
 	if data, ok := m["data"].(map[string]interface{}); ok {
+		if t.CoerceTypes {
+			data = t.propertyFile.CoerceMap(data)
+		}
 		normalizedData, err := t.NormalizeMap(data)
 		if err != nil {
 			return nil, err
@@ -254,6 +764,26 @@ func (t *Table) DeserializeEvent(m map[string]interface{}) (*Event, error) {
 	return event, nil
 }
 
+// Returns whether the table has any required or default property
+// constraints.
+func (t *Table) HasConstraints() bool {
+	return t.propertyFile.HasConstraints()
+}
+
+// Applies required and default property constraints to a normalized event.
+// The object's current state is used to determine if permanent properties
+// already have a value.
+func (t *Table) ApplyConstraints(event *Event, state *Event) error {
+	if event.Data == nil {
+		event.Data = make(map[int64]interface{})
+	}
+	var stateData map[int64]interface{}
+	if state != nil {
+		stateData = state.Data
+	}
+	return t.propertyFile.ApplyConstraints(event.Data, stateData)
+}
+
 // Serializes a normalized event into a map.
 func (t *Table) SerializeEvent(event *Event) (map[string]interface{}, error) {
 	m := make(map[string]interface{})
@@ -302,7 +832,8 @@ func (t *Table) FactorizeEvent(event *Event, factors *Factors, createIfMissing b
 	return nil
 }
 
-// Defactorizes the values in an event.
+// Defactorizes the values in an event. Decoded events store factor ids as
+// int64 so any integer type is accepted.
 func (t *Table) DefactorizeEvent(event *Event, factors *Factors) error {
 	if event == nil {
 		return nil
@@ -312,8 +843,8 @@ func (t *Table) DefactorizeEvent(event *Event, factors *Factors) error {
 	for k, v := range event.Data {
 		property := propertyFile.GetProperty(k)
 		if property.DataType == FactorDataType {
-			if sequence, ok := v.(uint64); ok {
-				stringValue, err := factors.Defactorize(t.Name, property.Name, sequence)
+			if sequence, ok := normalize(v).(int64); ok {
+				stringValue, err := factors.Defactorize(t.Name, property.Name, uint64(sequence))
 				if err != nil {
 					return err
 				}
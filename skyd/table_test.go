@@ -39,3 +39,33 @@ func TestTableCreateProperty(t *testing.T) {
 		t.Fatalf("Invalid properties file:\n%v", string(content))
 	}
 }
+
+// Ensure that the samples of inferred strings are kept when a table is reopened.
+func TestTableInferredStringsReopen(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.AutoSchema = true
+
+	event := NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{})
+	if _, err := table.InferProperties(event, map[string]interface{}{"action": "signup"}); err != nil {
+		t.Fatalf("Unable to infer properties: %v", err)
+	}
+	for i := 0; i < InferredFactorSampleSize-1; i++ {
+		if ready, err := table.SampleInferredStrings(fmt.Sprintf("o%d", i), event); ready || err != nil {
+			t.Fatalf("Unexpected sample result: %v, %v", ready, err)
+		}
+	}
+
+	// The sample is completed after reopening and only reported once.
+	table.Close()
+	if err := table.Open(); err != nil {
+		t.Fatalf("Unable to reopen table: %v", err)
+	}
+	if ready, err := table.SampleInferredStrings("o0", event); !ready || err != nil {
+		t.Fatalf("Expected complete sample: %v, %v", ready, err)
+	}
+	if ready, err := table.SampleInferredStrings("o0", event); ready || err != nil {
+		t.Fatalf("Expected sample to be reported once: %v, %v", ready, err)
+	}
+}
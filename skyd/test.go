@@ -27,7 +27,7 @@ func assertProperty(t *testing.T, property *Property, id int64, name string, tra
 func assertResponse(t *testing.T, resp *http.Response, statusCode int, content string, message string) {
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 || content != string(body) {
+	if resp.StatusCode != statusCode || content != string(body) {
 		t.Fatalf("%v:\nexp:[%v] %s\ngot:[%v] %s.", message, statusCode, content, resp.StatusCode, string(body))
 	}
 }
@@ -1,10 +1,30 @@
 package skyd
 
 import (
+	"bytes"
 	"fmt"
+	"math/big"
 	"os"
+	"regexp"
+	"strings"
 )
 
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Matches a double or single quoted string literal. Quotes and backslashes
+// within the literal are escaped with a backslash.
+const stringLiteralPattern = `"((?:[^"\\]|\\.)*)"|'((?:[^'\\]|\\.)*)'`
+
+var stringLiteralEscapeRegexp = regexp.MustCompile(`(?s)\\(.)`)
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
 // Converts untyped map to a map[string]interface{} if passed a map.
 func ConvertToStringKeys(value interface{}) interface{} {
 	if m, ok := value.(map[interface{}]interface{}); ok {
@@ -14,6 +34,13 @@ func ConvertToStringKeys(value interface{}) interface{} {
 		}
 		return ret
 	}
+	if s, ok := value.([]interface{}); ok {
+		ret := make([]interface{}, len(s))
+		for i, v := range s {
+			ret[i] = ConvertToStringKeys(v)
+		}
+		return ret
+	}
 
 	return value
 }
@@ -22,3 +49,92 @@ func ConvertToStringKeys(value interface{}) interface{} {
 func warn(msg string, v ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg+"\n", v...)
 }
+
+// Returns the first key after every key beginning with a prefix. Returns nil
+// if there is no such key.
+func prefixLimit(prefix []byte) []byte {
+	limit := make([]byte, len(prefix))
+	copy(limit, prefix)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i] < 0xFF {
+			limit[i]++
+			return limit[:i+1]
+		}
+	}
+	return nil
+}
+
+// Returns a key that sorts halfway between two keys. The keys are compared
+// as if they were padded with zeros to the same length and the midpoint is
+// made one byte longer when there is no room between them at that length.
+// Returns nil if the start is not before the limit.
+func midpointKey(start []byte, limit []byte) []byte {
+	if bytes.Compare(start, limit) >= 0 {
+		return nil
+	}
+
+	sz := len(start)
+	if len(limit) > sz {
+		sz = len(limit)
+	}
+	for ; ; sz++ {
+		a := new(big.Int).SetBytes(padKey(start, sz))
+		b := new(big.Int).SetBytes(padKey(limit, sz))
+		mid := new(big.Int).Rsh(new(big.Int).Add(a, b), 1)
+		if mid.Cmp(a) > 0 {
+			key := make([]byte, sz)
+			value := mid.Bytes()
+			copy(key[sz-len(value):], value)
+			return key
+		}
+	}
+}
+
+// Pads a key with zeros on the right to a given size.
+func padKey(key []byte, sz int) []byte {
+	padded := make([]byte, sz)
+	copy(padded, key)
+	return padded
+}
+
+// Checks if a name can be used as an identifier in generated Lua code. Names
+// must be made of letters, digits and underscores, cannot start with a digit
+// and cannot be a Lua keyword.
+func isValidIdentifier(name string) bool {
+	return identifierRegexp.MatchString(name) && !luaKeywords[name]
+}
+
+// Removes the backslash escapes from the contents of a string literal.
+func unescapeStringLiteral(str string) string {
+	return stringLiteralEscapeRegexp.ReplaceAllString(str, "$1")
+}
+
+// Escapes quotes and backslashes so a string can be placed inside a string
+// literal.
+func escapeStringLiteral(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `'`, `\'`).Replace(str)
+}
+
+// Splits an expression on a separator that is not within a string literal.
+func splitExpression(expression string, sep string) []string {
+	parts := make([]string, 0)
+	var quote byte
+	start := 0
+	for i := 0; i < len(expression); i++ {
+		ch := expression[i]
+		switch {
+		case quote != 0 && ch == '\\':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case strings.HasPrefix(expression[i:], sep):
+			parts = append(parts, expression[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, expression[start:])
+}